@@ -0,0 +1,256 @@
+package superscribe
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/carpenterscode/superscribe/receipt"
+)
+
+// maxPeriods bounds counting periods, in case of a malformed duration
+const maxPeriods = 10000
+
+// Product is what superscribe knows about an auto-renewable subscription product
+type Product struct {
+	ID string `json:"id" yaml:"id"`
+
+	// Group is the subscription group, within which a customer subscribes to one product at a
+	// time
+	Group string `json:"group" yaml:"group"`
+
+	// Level ranks service within Group, where 1 is the highest like in App Store Connect.
+	// Products of the same level are crossgrades of each other.
+	Level int `json:"level" yaml:"level"`
+
+	// Duration is how long each paid period lasts
+	Duration Period `json:"duration" yaml:"duration"`
+
+	// Offers are the introductory offer, promotional offers and offer codes of the product
+	Offers []ProductOffer `json:"offers,omitempty" yaml:"offers,omitempty"`
+
+	// Prices are keyed by storefront country code, like USA
+	Prices map[string]Price `json:"prices" yaml:"prices"`
+}
+
+// Price is an amount in a storefront's currency
+type Price struct {
+	Currency string  `json:"currency" yaml:"currency"`
+	Amount   float64 `json:"amount" yaml:"amount"`
+}
+
+// ProductOffer is a discount on a product, which transactions refer to by type and identifier
+type ProductOffer struct {
+
+	// Type is one of the receipt.OfferType constants
+	Type int `json:"type" yaml:"type"`
+
+	// ID is the promotional offer ID or offer code reference name, and empty for the
+	// introductory offer
+	ID string `json:"id,omitempty" yaml:"id,omitempty"`
+
+	// DiscountType is one of the receipt.OfferDiscount constants
+	DiscountType string `json:"discount_type" yaml:"discount_type"`
+
+	// Duration is how long each discounted period lasts, for Periods periods
+	Duration Period `json:"duration" yaml:"duration"`
+	Periods  int    `json:"periods" yaml:"periods"`
+
+	// Prices are per discounted period, or for all of them when paid up front. Free trials
+	// don't need any.
+	Prices map[string]Price `json:"prices,omitempty" yaml:"prices,omitempty"`
+}
+
+// Price is the product's price in storefront
+func (product Product) Price(storefront string) (Price, bool) {
+	price, ok := product.Prices[storefront]
+	return price, ok
+}
+
+// Offer finds the product's offer of offerType, which must also match identifier unless it's
+// the introductory offer
+func (product Product) Offer(offerType int, identifier string) (ProductOffer, bool) {
+	for _, offer := range product.Offers {
+		if offer.Type != offerType {
+			continue
+		}
+		if offerType == receipt.OfferTypeIntroductory || offer.ID == identifier {
+			return offer, true
+		}
+	}
+	return ProductOffer{}, false
+}
+
+// Price is what the customer pays during the offer in storefront. Free trials cost nothing in
+// the product's currency.
+func (offer ProductOffer) Price(storefront string, regular Price) (Price, bool) {
+	if offer.DiscountType == receipt.OfferDiscountFreeTrial {
+		return Price{Currency: regular.Currency}, true
+	}
+	price, ok := offer.Prices[storefront]
+	return price, ok
+}
+
+// Period is an ISO 8601 duration in whole days, weeks, months or years, like P1M or P1Y, as
+// App Store Connect configures subscription durations
+type Period string
+
+func (p Period) parse() (years, months, days int, err error) {
+	s := string(p)
+	if len(s) < 3 || s[0] != 'P' {
+		return 0, 0, 0, fmt.Errorf("Period %q should have been an ISO 8601 duration", s)
+	}
+
+	n := 0
+	digits := false
+	for _, r := range s[1:] {
+		if r >= '0' && r <= '9' {
+			n = n*10 + int(r-'0')
+			digits = true
+			continue
+		}
+		if !digits {
+			return 0, 0, 0, fmt.Errorf("Period %q should have had a number before %c", s, r)
+		}
+		switch r {
+		case 'Y':
+			years += n
+		case 'M':
+			months += n
+		case 'W':
+			days += 7 * n
+		case 'D':
+			days += n
+		default:
+			return 0, 0, 0, fmt.Errorf("Period %q should have used Y, M, W or D", s)
+		}
+		n = 0
+		digits = false
+	}
+	if digits {
+		return 0, 0, 0, fmt.Errorf("Period %q should have ended with a unit", s)
+	}
+	return years, months, days, nil
+}
+
+// AddTo returns t after n periods, or t itself if the period is malformed
+func (p Period) AddTo(t time.Time, n int) time.Time {
+	years, months, days, err := p.parse()
+	if err != nil {
+		return t
+	}
+	return t.AddDate(years*n, months*n, days*n)
+}
+
+// periodsBetween counts the whole periods from start until end
+func (p Period) periodsBetween(start, end time.Time) (int, bool) {
+	if _, _, _, err := p.parse(); err != nil || p.AddTo(start, 1).Equal(start) {
+		return 0, false
+	}
+
+	n := 0
+	for n < maxPeriods && !p.AddTo(start, n+1).After(end) {
+		n++
+	}
+	return n, true
+}
+
+// LoadCatalog reads a JSON catalog of the form {"products": [...]}
+func LoadCatalog(r io.Reader) (Products, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return ParseCatalog(data, json.Unmarshal)
+}
+
+// ParseCatalog decodes a catalog with unmarshal, such as yaml.Unmarshal for a YAML catalog with
+// the same fields as LoadCatalog
+func ParseCatalog(data []byte, unmarshal func([]byte, interface{}) error) (Products, error) {
+
+	var file struct {
+		Products []Product `json:"products" yaml:"products"`
+	}
+	if err := unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	products := make(Products, len(file.Products))
+	for _, product := range file.Products {
+		if product.ID == "" {
+			return nil, errors.New("Catalog products should have had IDs")
+		}
+		if _, ok := products[product.ID]; ok {
+			return nil, fmt.Errorf("Catalog should have listed %s once", product.ID)
+		}
+
+		periods := []Period{product.Duration}
+		for _, offer := range product.Offers {
+			periods = append(periods, offer.Duration)
+		}
+		for _, period := range periods {
+			if period == "" {
+				continue
+			}
+			if _, _, _, err := period.parse(); err != nil {
+				return nil, fmt.Errorf("%s: %v", product.ID, err)
+			}
+		}
+
+		products[product.ID] = product
+	}
+	return products, nil
+}
+
+// Catalog looks products up by product ID, so that changing between them can be told apart
+type Catalog interface {
+	Product(productID string) (Product, bool)
+}
+
+// Products is a Catalog keyed by product ID
+type Products map[string]Product
+
+func (products Products) Product(productID string) (Product, bool) {
+	product, ok := products[productID]
+	return product, ok
+}
+
+// productChange classifies moving from one product to another by their levels. It's false
+// without a catalog, for unknown products, or for products in different subscription groups.
+func productChange(catalog Catalog, from, to string) (ProductChange, bool) {
+	if catalog == nil || from == "" || to == "" || from == to {
+		return "", false
+	}
+
+	previous, ok := catalog.Product(from)
+	if !ok {
+		return "", false
+	}
+	next, ok := catalog.Product(to)
+	if !ok || next.Group != previous.Group {
+		return "", false
+	}
+
+	switch {
+	case next.Level < previous.Level:
+		return Upgrade, true
+	case next.Level > previous.Level:
+		return Downgrade, true
+	}
+	return Crossgrade, true
+}
+
+// upgradedFrom finds the transaction that an immediate upgrade cancelled. Apple refunds what's
+// left of it and flags it as upgraded, so it's the most recent cancellation in the history.
+func upgradedFrom(history []receipt.Transaction) (receipt.Transaction, bool) {
+	var last receipt.Transaction
+	for _, txn := range history {
+		if txn.CancelledAt.After(last.CancelledAt) {
+			last = txn
+		}
+	}
+	return last, last.IsUpgraded
+}
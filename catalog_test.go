@@ -0,0 +1,271 @@
+package superscribe
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/carpenterscode/superscribe/receipt"
+	"github.com/golang/mock/gomock"
+)
+
+func TestProductChange(t *testing.T) {
+	catalog := Products{
+		"month-basic":   {ID: "month-basic", Group: "app", Level: 2},
+		"month-premium": {ID: "month-premium", Group: "app", Level: 1},
+		"year-premium":  {ID: "year-premium", Group: "app", Level: 1},
+		"storage":       {ID: "storage", Group: "storage", Level: 1},
+	}
+
+	cases := []struct {
+		from, to string
+		change   ProductChange
+		ok       bool
+	}{
+		{"month-basic", "year-premium", Upgrade, true},
+		{"year-premium", "month-basic", Downgrade, true},
+		{"year-premium", "month-premium", Crossgrade, true},
+		{"year-premium", "year-premium", "", false},
+		{"year-premium", "storage", "", false},
+		{"year-premium", "unknown", "", false},
+	}
+
+	for _, c := range cases {
+		change, ok := productChange(catalog, c.from, c.to)
+		if change != c.change || ok != c.ok {
+			t.Errorf("Should have classified %s to %s as %q %v, got %q %v", c.from, c.to,
+				c.change, c.ok, change, ok)
+		}
+	}
+
+	if _, ok := productChange(nil, "month-basic", "year-premium"); ok {
+		t.Error("Should not have classified without a catalog")
+	}
+}
+
+func TestUpgradedFrom(t *testing.T) {
+	start := time.Date(2019, time.March, 1, 0, 0, 0, 0, time.UTC)
+	basic := receipt.Transaction{ProductID: "month-basic", PurchasedAt: start,
+		CancelledAt: start.AddDate(0, 0, 5), IsUpgraded: true}
+	premium := receipt.Transaction{ProductID: "year-premium", PurchasedAt: start.AddDate(0, 0, 5)}
+
+	if previous, ok := upgradedFrom([]receipt.Transaction{basic, premium}); !ok ||
+		previous.ProductID != "month-basic" {
+		t.Error("Should have found the upgraded transaction", previous)
+	}
+
+	// Refunding the upgraded product later is a refund after all
+	premium.CancelledAt = start.AddDate(0, 1, 0)
+	if _, ok := upgradedFrom([]receipt.Transaction{basic, premium}); ok {
+		t.Error("Should have treated the latest cancellation as a refund")
+	}
+
+	if _, ok := upgradedFrom([]receipt.Transaction{premium}); ok {
+		t.Error("Should not have found an upgrade without one")
+	}
+}
+
+const testCatalogJSON = `{"products": [{
+	"id": "month-premium",
+	"group": "app",
+	"level": 1,
+	"duration": "P1M",
+	"offers": [
+		{"type": 1, "discount_type": "FREE_TRIAL", "duration": "P1W", "periods": 1},
+		{"type": 3, "id": "SPRING", "discount_type": "PAY_AS_YOU_GO", "duration": "P1M",
+			"periods": 3, "prices": {"USA": {"currency": "USD", "amount": 4.99}}}
+	],
+	"prices": {
+		"USA": {"currency": "USD", "amount": 9.99},
+		"GBR": {"currency": "GBP", "amount": 8.99}
+	}
+}]}`
+
+func TestLoadCatalog(t *testing.T) {
+	products, err := LoadCatalog(strings.NewReader(testCatalogJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	product, ok := products.Product("month-premium")
+	if !ok || product.Group != "app" || product.Level != 1 || product.Duration != "P1M" {
+		t.Fatal("Should have loaded month-premium", product)
+	}
+	if price, _ := product.Price("GBR"); price != (Price{"GBP", 8.99}) {
+		t.Error("Should have priced month-premium in GBR", price)
+	}
+	if price, ok := product.Price("FRA"); ok {
+		t.Error("Should not have priced month-premium in another storefront's currency", price)
+	}
+	if offer, ok := product.Offer(receipt.OfferTypeOfferCode, "SPRING"); !ok || offer.Periods != 3 {
+		t.Error("Should have found the SPRING offer code", offer)
+	}
+	if _, ok := product.Offer(receipt.OfferTypeOfferCode, "FALL"); ok {
+		t.Error("Should not have found an unknown offer code")
+	}
+
+	// ParseCatalog takes any unmarshal func, like yaml.Unmarshal
+	if _, err := ParseCatalog([]byte(testCatalogJSON), json.Unmarshal); err != nil {
+		t.Error(err)
+	}
+
+	invalid := []string{
+		`{"products": [{"group": "app"}]}`,
+		`{"products": [{"id": "a"}, {"id": "a"}]}`,
+		`{"products": [{"id": "a", "duration": "1 month"}]}`,
+		`{"products": [{"id": "a", "offers": [{"duration": "P1X"}]}]}`,
+	}
+	for _, doc := range invalid {
+		if _, err := LoadCatalog(strings.NewReader(doc)); err == nil {
+			t.Error("Should have rejected", doc)
+		}
+	}
+}
+
+func TestPeriod(t *testing.T) {
+	start := time.Date(2019, time.January, 31, 0, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		period Period
+		end    time.Time
+	}{
+		{"P1W", start.AddDate(0, 0, 14)},
+		{"P3D", start.AddDate(0, 0, 6)},
+		{"P1M", start.AddDate(0, 2, 0)},
+		{"P1Y", start.AddDate(2, 0, 0)},
+		{"P1Y6M", start.AddDate(3, 0, 0)},
+	}
+	for _, c := range cases {
+		if end := c.period.AddTo(start, 2); !end.Equal(c.end) {
+			t.Errorf("Should have added 2 × %s to get %v, got %v", c.period, c.end, end)
+		}
+		if n, ok := c.period.periodsBetween(start, c.end.Add(time.Hour)); !ok || n != 2 {
+			t.Errorf("Should have counted 2 × %s, got %d", c.period, n)
+		}
+	}
+
+	for _, period := range []Period{"", "P", "PM", "P1", "P1H", "1M"} {
+		if _, ok := period.periodsBetween(start, start.AddDate(1, 0, 0)); ok {
+			t.Errorf("Should have rejected %q", period)
+		}
+	}
+}
+
+func TestPipelineRevenue(t *testing.T) {
+	products, err := LoadCatalog(strings.NewReader(testCatalogJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline := Pipeline{Catalog: products, DefaultStorefront: "USA"}
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	unpriced := NewMockSubscription(ctrl)
+	unpriced.EXPECT().Currency().Return("").AnyTimes()
+	unpriced.EXPECT().Price().Return(0.0).AnyTimes()
+
+	paidAt := time.Date(2019, time.June, 1, 0, 0, 0, 0, time.UTC)
+	gbr := []receipt.Transaction{{ProductID: "month-premium", PurchasedAt: paidAt,
+		Storefront: "GBR"}}
+
+	cases := []struct {
+		info     fakeInfo
+		currency string
+		price    float64
+	}{
+		{fakeInfo{productID: "month-premium"}, "USD", 9.99},
+		{fakeInfo{productID: "month-premium", transactions: gbr}, "GBP", 8.99},
+		{fakeInfo{productID: "month-premium", offerType: receipt.OfferTypeIntroductory}, "USD", 0},
+		{fakeInfo{productID: "month-premium", offerType: receipt.OfferTypeOfferCode,
+			offerIdentifier: "SPRING"}, "USD", 4.99},
+		{fakeInfo{productID: "unknown"}, "", 0},
+	}
+	for _, c := range cases {
+		if currency, price := pipeline.revenue(unpriced, c.info); currency != c.currency ||
+			price != c.price {
+			t.Errorf("Should have priced %v at %s %.2f, got %s %.2f", c.info, c.currency, c.price,
+				currency, price)
+		}
+	}
+
+	priced := NewMockSubscription(ctrl)
+	priced.EXPECT().Currency().Return("EUR").AnyTimes()
+	priced.EXPECT().Price().Return(10.99).AnyTimes()
+	if currency, price := pipeline.revenue(priced, fakeInfo{productID: "month-premium"}); currency !=
+		"EUR" || price != 10.99 {
+		t.Error("Should have preferred the store's price", currency, price)
+	}
+}
+
+// storefrontSub is a subscription whose store keeps the App Store country
+type storefrontSub struct {
+	Subscription
+	storefront string
+}
+
+func (sub storefrontSub) Storefront() string {
+	return sub.storefront
+}
+
+func TestPipelineRevenueWithoutHistory(t *testing.T) {
+	yearly := Product{ID: "year-premium", Prices: map[string]Price{
+		"USA": {Currency: "USD", Amount: 59.99},
+		"GBR": {Currency: "GBP", Amount: 49.99},
+	}}
+	pipeline := Pipeline{Catalog: Products{yearly.ID: yearly}}
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	unpriced := NewMockSubscription(ctrl)
+	unpriced.EXPECT().Currency().Return("").AnyTimes()
+	unpriced.EXPECT().Price().Return(0.0).AnyTimes()
+
+	// V1 notifications from before 2019 have neither history nor storefront
+	n := notificationFromFile("RENEWAL.json")
+	if currency, price := pipeline.revenue(storefrontSub{unpriced, "GBR"}, n); currency != "GBP" ||
+		price != 49.99 {
+		t.Error("Should have priced in the subscription's storefront", currency, price)
+	}
+	if currency, price := pipeline.revenue(unpriced, n); currency != "" || price != 0 {
+		t.Error("Should not have priced without a storefront", currency, price)
+	}
+
+	pipeline.DefaultStorefront = "USA"
+	if currency, price := pipeline.revenue(unpriced, n); currency != "USD" || price != 59.99 {
+		t.Error("Should have priced in the default storefront", currency, price)
+	}
+}
+
+func TestPipelinePayment(t *testing.T) {
+	products, err := LoadCatalog(strings.NewReader(testCatalogJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline := Pipeline{Catalog: products}
+
+	// Without history, months since the original purchase estimate the renewal count
+	start := time.Date(2018, time.January, 15, 0, 0, 0, 0, time.UTC)
+	info := originalInfo{fakeInfo{productID: "month-premium", paidAt: start.AddDate(1, 1, 0)},
+		start}
+
+	if kind, count := pipeline.payment(info, PaidRenewal); kind != PaidRenewal || count != 13 {
+		t.Error("Should have estimated 13 renewals", kind, count)
+	}
+	if _, count := (Pipeline{}).payment(info, PaidRenewal); count != -1 {
+		t.Error("Should not have estimated renewals without a catalog", count)
+	}
+	if rate, oneYear := pipeline.commission(info); rate != ReducedCommission || !oneYear {
+		t.Error("Should have estimated a year of paid service", rate, oneYear)
+	}
+}
+
+// originalInfo is fakeInfo purchased originally before it was paid
+type originalInfo struct {
+	fakeInfo
+	originalPurchaseDate time.Time
+}
+
+func (info originalInfo) OriginalPurchaseDate() time.Time { return info.originalPurchaseDate }
@@ -0,0 +1,75 @@
+package superscribe
+
+import (
+	"sort"
+	"time"
+
+	"github.com/carpenterscode/superscribe/receipt"
+)
+
+// App Store commission rates on auto-renewable subscriptions. Apple takes the reduced rate after
+// a subscriber accumulates a year of paid service, or always for Small Business Program members.
+// https://developer.apple.com/app-store/small-business-program/
+const (
+	StandardCommission = 0.30
+	ReducedCommission  = 0.15
+)
+
+const (
+	// paidServiceYear of paid days qualifies a subscriber for the reduced commission
+	paidServiceYear = 365 * 24 * time.Hour
+
+	// retentionLapse is how long a subscription can lapse without losing accumulated paid days
+	retentionLapse = 60 * 24 * time.Hour
+)
+
+// paidService adds up the paid days before paidAt, starting over whenever the subscription lapsed
+// for more than 60 days. Free trials don't count toward paid service, but don't break it either.
+func paidService(history []receipt.Transaction, paidAt time.Time) time.Duration {
+
+	sorted := make([]receipt.Transaction, len(history))
+	copy(sorted, history)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].PurchasedAt.Before(sorted[j].PurchasedAt)
+	})
+
+	var total time.Duration
+	var lastExpiry time.Time
+
+	for _, txn := range sorted {
+		if !txn.PurchasedAt.Before(paidAt) {
+			break
+		}
+		if !lastExpiry.IsZero() && txn.PurchasedAt.Sub(lastExpiry) > retentionLapse {
+			total = 0
+		}
+		if !txn.IsTrialPeriod {
+			end := txn.ExpiresAt
+			if end.After(paidAt) {
+				end = paidAt
+			}
+			total += end.Sub(txn.PurchasedAt)
+		}
+		if txn.ExpiresAt.After(lastExpiry) {
+			lastExpiry = txn.ExpiresAt
+		}
+	}
+
+	if !lastExpiry.IsZero() && paidAt.Sub(lastExpiry) > retentionLapse {
+		return 0
+	}
+	return total
+}
+
+// commission returns the rate Apple takes from the payment made at paidAt, and whether the
+// subscriber had a year of paid service by then. History that's missing earlier transactions
+// undercounts paid service, so the rate errs toward the standard commission.
+func commission(history []receipt.Transaction, paidAt time.Time,
+	smallBusiness bool) (float64, bool) {
+
+	oneYear := paidService(history, paidAt) >= paidServiceYear
+	if smallBusiness || oneYear {
+		return ReducedCommission, oneYear
+	}
+	return StandardCommission, oneYear
+}
@@ -0,0 +1,66 @@
+package superscribe
+
+import (
+	"testing"
+	"time"
+
+	"github.com/carpenterscode/superscribe/receipt"
+)
+
+// yearlyHistory returns consecutive yearly transactions starting at start, each starting after
+// the previous one expired plus gap
+func yearlyHistory(start time.Time, gap time.Duration, count int) []receipt.Transaction {
+	var history []receipt.Transaction
+	purchasedAt := start
+	for i := 0; i < count; i++ {
+		history = append(history, receipt.Transaction{
+			OriginalTransactionID: originalTransactionID,
+			PurchasedAt:           purchasedAt,
+			ExpiresAt:             purchasedAt.AddDate(1, 0, 0),
+		})
+		purchasedAt = purchasedAt.AddDate(1, 0, 0).Add(gap)
+	}
+	return history
+}
+
+func TestCommission(t *testing.T) {
+	start := time.Date(2019, time.March, 2, 7, 27, 19, 0, time.UTC)
+
+	trial := []receipt.Transaction{{
+		IsTrialPeriod: true,
+		PurchasedAt:   start,
+		ExpiresAt:     start.AddDate(1, 0, 0),
+	}}
+	trialThenPaid := append(trial, yearlyHistory(start.AddDate(1, 0, 0), 0, 1)...)
+
+	cases := []struct {
+		name          string
+		history       []receipt.Transaction
+		smallBusiness bool
+		rate          float64
+		oneYear       bool
+	}{
+		{"first year", yearlyHistory(start, 0, 1), false, StandardCommission, false},
+		{"second year", yearlyHistory(start, 0, 2), false, ReducedCommission, true},
+		{"small business", yearlyHistory(start, 0, 1), true, ReducedCommission, false},
+		{"short lapse", yearlyHistory(start, 30*24*time.Hour, 2), false, ReducedCommission, true},
+		{"long lapse", yearlyHistory(start, 90*24*time.Hour, 2), false, StandardCommission, false},
+		{"free trial", trialThenPaid, false, StandardCommission, false},
+	}
+
+	for _, c := range cases {
+		paidAt := c.history[len(c.history)-1].PurchasedAt
+		rate, oneYear := commission(c.history, paidAt, c.smallBusiness)
+		if rate != c.rate || oneYear != c.oneYear {
+			t.Errorf("%s: should have charged %v commission (one year %v), got %v (%v)", c.name,
+				c.rate, c.oneYear, rate, oneYear)
+		}
+	}
+
+	evt := Event{}
+	evt.SetRevenue(currency, 10)
+	evt.SetCommission(StandardCommission, false)
+	if evt.Proceeds() != 7 {
+		t.Error("Should have subtracted commission from price", evt.Proceeds())
+	}
+}
@@ -0,0 +1,116 @@
+package superscribe
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ConsentCount is how many subscribers of a product were asked to agree to a price increase,
+// and how many accepted or declined
+type ConsentCount struct {
+	Requested int
+	Accepted  int
+	Declined  int
+}
+
+// Rate is the share of responses that accepted the increase, or 0 before any response
+func (count ConsentCount) Rate() float64 {
+	if count.Accepted+count.Declined == 0 {
+		return 0
+	}
+	return float64(count.Accepted) / float64(count.Accepted+count.Declined)
+}
+
+// PriceConsentReport is an EventListener that tallies responses to price increases by the
+// product set to renew, such as to watch consent rates while moving monthly subscriptions
+// from 7.99/mo to 9.99/mo
+type PriceConsentReport struct {
+	mu       sync.Mutex
+	products map[string]ConsentCount
+}
+
+func NewPriceConsentReport() *PriceConsentReport {
+	return &PriceConsentReport{products: make(map[string]ConsentCount)}
+}
+
+// Products returns a copy of the counts so far, keyed by product ID
+func (report *PriceConsentReport) Products() map[string]ConsentCount {
+	report.mu.Lock()
+	defer report.mu.Unlock()
+
+	products := make(map[string]ConsentCount, len(report.products))
+	for productID, count := range report.products {
+		products[productID] = count
+	}
+	return products
+}
+
+func (report *PriceConsentReport) String() string {
+	products := report.Products()
+
+	ids := make([]string, 0, len(products))
+	for productID := range products {
+		ids = append(ids, productID)
+	}
+	sort.Strings(ids)
+
+	lines := make([]string, len(ids))
+	for i, productID := range ids {
+		count := products[productID]
+		lines[i] = fmt.Sprintf("%s: %d requested, %d accepted, %d declined, %.1f%% consent",
+			productID, count.Requested, count.Accepted, count.Declined, 100*count.Rate())
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (report *PriceConsentReport) tally(evt PriceIncreaseEvent, add func(*ConsentCount)) {
+	productID := evt.AutoRenewProduct()
+	if productID == "" {
+		productID = evt.ProductID()
+	}
+
+	report.mu.Lock()
+	defer report.mu.Unlock()
+
+	count := report.products[productID]
+	add(&count)
+	report.products[productID] = count
+}
+
+func (report *PriceConsentReport) Name() string {
+	return "Price consent report"
+}
+
+func (report *PriceConsentReport) PriceIncreaseConsentRequested(evt PriceIncreaseEvent) error {
+	report.tally(evt, func(count *ConsentCount) { count.Requested++ })
+	return nil
+}
+
+func (report *PriceConsentReport) PriceIncreaseAccepted(evt PriceIncreaseEvent) error {
+	report.tally(evt, func(count *ConsentCount) { count.Accepted++ })
+	return nil
+}
+
+func (report *PriceConsentReport) PriceIncreaseDeclined(evt PriceIncreaseEvent) error {
+	report.tally(evt, func(count *ConsentCount) { count.Declined++ })
+	return nil
+}
+
+// The report ignores every other event
+
+func (report *PriceConsentReport) ChangedAutoRenewProduct(AutoRenewEvent) error { return nil }
+func (report *PriceConsentReport) ChangedAutoRenewStatus(AutoRenewEvent) error  { return nil }
+func (report *PriceConsentReport) Paid(PayEvent) error                          { return nil }
+func (report *PriceConsentReport) Refunded(RefundEvent) error                   { return nil }
+func (report *PriceConsentReport) StartedTrial(StartTrialEvent) error           { return nil }
+func (report *PriceConsentReport) Expired(ExpireEvent) error                    { return nil }
+func (report *PriceConsentReport) EnteredBillingRetry(BillingRetryEvent) error  { return nil }
+func (report *PriceConsentReport) EnteredGracePeriod(BillingRetryEvent) error   { return nil }
+func (report *PriceConsentReport) StillInGracePeriod(BillingRetryEvent) error   { return nil }
+func (report *PriceConsentReport) ExitedGracePeriod(BillingRetryEvent) error    { return nil }
+func (report *PriceConsentReport) RecoveredFromBillingRetry(PayEvent) error     { return nil }
+func (report *PriceConsentReport) Upgraded(ProductChangeEvent) error            { return nil }
+func (report *PriceConsentReport) Downgraded(ProductChangeEvent) error          { return nil }
+func (report *PriceConsentReport) Crossgraded(ProductChangeEvent) error         { return nil }
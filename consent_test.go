@@ -0,0 +1,36 @@
+package superscribe
+
+import (
+	"testing"
+)
+
+func TestPriceConsentReport(t *testing.T) {
+	report := NewPriceConsentReport()
+
+	var listener EventListener = report
+	monthly := Event{productID: "month-basic", autoRenewProductID: "month-premium"}
+	yearly := Event{productID: "year-premium"}
+
+	for i := 0; i < 4; i++ {
+		listener.PriceIncreaseConsentRequested(monthly)
+	}
+	listener.PriceIncreaseAccepted(monthly)
+	listener.PriceIncreaseAccepted(monthly)
+	listener.PriceIncreaseAccepted(monthly)
+	listener.PriceIncreaseDeclined(monthly)
+	listener.PriceIncreaseConsentRequested(yearly)
+
+	products := report.Products()
+	if count := products["month-premium"]; count != (ConsentCount{4, 3, 1}) || count.Rate() != 0.75 {
+		t.Error("Should have tallied the product set to renew", count, count.Rate())
+	}
+	if count := products["year-premium"]; count != (ConsentCount{1, 0, 0}) || count.Rate() != 0 {
+		t.Error("Should have tallied a request without responses", count, count.Rate())
+	}
+
+	expected := "month-premium: 4 requested, 3 accepted, 1 declined, 75.0% consent\n" +
+		"year-premium: 1 requested, 0 accepted, 0 declined, 0.0% consent"
+	if report.String() != expected {
+		t.Error("Should have reported by product", report.String())
+	}
+}
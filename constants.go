@@ -5,6 +5,9 @@ type Env string
 const (
 	Sandbox Env = "Sandbox"
 	Prod    Env = "PROD"
+
+	// Production is how App Store Server Notifications V2 name the production environment
+	Production Env = "Production"
 )
 
 type NoteType string
@@ -18,4 +21,65 @@ const (
 
 	// Introduced in June 2019 at WWDC
 	DidChangeRenewalStatus NoteType = "DID_CHANGE_RENEWAL_STATUS"
+
+	// Introduced with unified_receipt from 2019 onward
+	DidFailToRenew       NoteType = "DID_FAIL_TO_RENEW"
+	DidRecover           NoteType = "DID_RECOVER"
+	PriceIncreaseConsent NoteType = "PRICE_INCREASE_CONSENT"
+	Refund               NoteType = "REFUND"
+	Revoke               NoteType = "REVOKE"
+)
+
+// App Store Server Notifications V2 types and subtypes, in addition to the V1 types they share
+// https://developer.apple.com/documentation/appstoreservernotifications/notificationtype
+const (
+	ConsumptionRequest NoteType = "CONSUMPTION_REQUEST"
+	DidRenew           NoteType = "DID_RENEW"
+	Expired            NoteType = "EXPIRED"
+	GracePeriodExpired NoteType = "GRACE_PERIOD_EXPIRED"
+	OfferRedeemed      NoteType = "OFFER_REDEEMED"
+	PriceIncrease      NoteType = "PRICE_INCREASE"
+	RefundDeclined     NoteType = "REFUND_DECLINED"
+	RenewalExtended    NoteType = "RENEWAL_EXTENDED"
+	Subscribed         NoteType = "SUBSCRIBED"
+	TestNotification   NoteType = "TEST"
+)
+
+type NoteSubtype string
+
+const (
+	SubtypeAccepted          NoteSubtype = "ACCEPTED"
+	SubtypeAutoRenewDisabled NoteSubtype = "AUTO_RENEW_DISABLED"
+	SubtypeAutoRenewEnabled  NoteSubtype = "AUTO_RENEW_ENABLED"
+	SubtypeBillingRecovery   NoteSubtype = "BILLING_RECOVERY"
+	SubtypeBillingRetry      NoteSubtype = "BILLING_RETRY"
+	SubtypeDowngrade         NoteSubtype = "DOWNGRADE"
+	SubtypeGracePeriod       NoteSubtype = "GRACE_PERIOD"
+	SubtypeInitialBuy        NoteSubtype = "INITIAL_BUY"
+	SubtypePending           NoteSubtype = "PENDING"
+	SubtypePriceIncrease     NoteSubtype = "PRICE_INCREASE"
+	SubtypeProductNotForSale NoteSubtype = "PRODUCT_NOT_FOR_SALE"
+	SubtypeResubscribe       NoteSubtype = "RESUBSCRIBE"
+	SubtypeUpgrade           NoteSubtype = "UPGRADE"
+	SubtypeVoluntary         NoteSubtype = "VOLUNTARY"
+)
+
+// ProductChange is how a customer moved between products of a subscription group
+type ProductChange string
+
+const (
+	Upgrade    ProductChange = "UPGRADE"
+	Downgrade  ProductChange = "DOWNGRADE"
+	Crossgrade ProductChange = "CROSSGRADE"
+)
+
+// PaymentKind distinguishes conversions from recurring revenue
+type PaymentKind string
+
+const (
+	PaidInitialPurchase PaymentKind = "INITIAL_PURCHASE"
+	PaidTrialConversion PaymentKind = "TRIAL_CONVERSION"
+	PaidIntroOffer      PaymentKind = "INTRO_OFFER"
+	PaidRenewal         PaymentKind = "RENEWAL"
+	PaidResubscribe     PaymentKind = "RESUBSCRIBE"
 )
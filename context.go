@@ -0,0 +1,56 @@
+package superscribe
+
+import (
+	"context"
+	"time"
+
+	"github.com/carpenterscode/superscribe/receipt"
+)
+
+// WithContext adapts match to ExpiringSubscriptionsContext by ignoring the context
+func (match ExpiringSubscriptions) WithContext() ExpiringSubscriptionsContext {
+	return func(ctx context.Context, now time.Time) []string {
+		return match(now)
+	}
+}
+
+// WithContext adapts lookup to LookupSubscriptionContext by ignoring the context
+func (lookup LookupSubscription) WithContext() LookupSubscriptionContext {
+	return func(ctx context.Context, receiptData string) (receipt.Info, error) {
+		return lookup(receiptData)
+	}
+}
+
+// WithContext adapts fetch to SubscriptionFetchContext by ignoring the context
+func (fetch SubscriptionFetch) WithContext() SubscriptionFetchContext {
+	return func(ctx context.Context, originalTransactionID string) (Subscription, error) {
+		return fetch(originalTransactionID)
+	}
+}
+
+// UpdaterWithContext adapts updater to SubscriptionUpdaterContext by ignoring the contexts
+func UpdaterWithContext(updater SubscriptionUpdater) SubscriptionUpdaterContext {
+	return updaterAdapter{updater}
+}
+
+type updaterAdapter struct {
+	updater SubscriptionUpdater
+}
+
+func (a updaterAdapter) UpdateWithNotificationContext(ctx context.Context, note Note) error {
+	return a.updater.UpdateWithNotification(note)
+}
+
+func (a updaterAdapter) UpdateWithReceiptContext(ctx context.Context, info receipt.Info) error {
+	return a.updater.UpdateWithReceipt(info)
+}
+
+// UpdateWithLookupErrorContext passes the error on if the adapted updater is a LookupErrorUpdater
+func (a updaterAdapter) UpdateWithLookupErrorContext(ctx context.Context, receiptData string,
+	err error) error {
+
+	if updater, ok := a.updater.(LookupErrorUpdater); ok {
+		return updater.UpdateWithLookupError(receiptData, err)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package superscribe
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// Deduplicator remembers which notifications were processed, since Apple retries notifications
+// until they're acknowledged and sometimes delivers them more than once
+type Deduplicator interface {
+
+	// Claim leases key to one delivery of a notification. It returns Claimed when the key is new
+	// or an earlier delivery's lease expired, such as when its instance crashed, InProgress while
+	// another delivery holds the lease, and Processed once the notification was processed. It
+	// must be atomic, so that only one of several concurrent deliveries is processed.
+	Claim(ctx context.Context, key string) (ClaimStatus, error)
+
+	// Complete marks key processed after processing succeeded, so that later deliveries are
+	// acknowledged without processing
+	Complete(ctx context.Context, key string) error
+
+	// Release forgets key after processing failed, so that Apple's retry is processed again
+	Release(ctx context.Context, key string) error
+}
+
+// ClaimStatus is what a Deduplicator knows about a notification as it's delivered
+type ClaimStatus string
+
+const (
+	Claimed    ClaimStatus = "CLAIMED"
+	InProgress ClaimStatus = "IN_PROGRESS"
+	Processed  ClaimStatus = "PROCESSED"
+)
+
+// uniqueNote is a Note with an ID that every delivery of it shares, which only V2
+// notifications have
+type uniqueNote interface {
+	NotificationUUID() string
+}
+
+// dedupKey identifies a notification across deliveries by its type and the transaction it's
+// about, or by notificationUUID for V2. V1 renewal status changes also include when they changed,
+// and preference changes the product, since customers can switch back and forth within one
+// transaction. It's empty when the notification can't be identified.
+func dedupKey(n Note) string {
+	if unique, ok := n.(uniqueNote); ok && unique.NotificationUUID() != "" {
+		return strings.Join([]string{string(n.Type()), unique.NotificationUUID()}, ":")
+	}
+
+	history := n.Transactions()
+	if len(history) == 0 {
+		return ""
+	}
+	txn := history[len(history)-1]
+	if txn.TransactionID == "" && txn.WebOrderLineItemID == "" {
+		return ""
+	}
+
+	parts := []string{string(n.Type()), txn.TransactionID, txn.WebOrderLineItemID}
+	if v1, ok := n.(notification); ok && v1.body.AutoRenewStatusChangedAt != 0 {
+		parts = append(parts, strconv.FormatInt(int64(v1.body.AutoRenewStatusChangedAt), 10))
+	}
+	if n.Type() == DidChangeRenewalPref {
+		parts = append(parts, n.AutoRenewProduct())
+	}
+	return strings.Join(parts, ":")
+}
+
+// claim reports whether n still needs processing, along with the key to complete or release
+// once processing finishes. Notifications are processed anyway when the Deduplicator fails,
+// since a duplicate event is better than a lost one.
+func (p Pipeline) claim(ctx context.Context, n Note) (string, ClaimStatus) {
+	if p.Deduplicator == nil {
+		return "", Claimed
+	}
+
+	key := dedupKey(n)
+	if key == "" {
+		return "", Claimed
+	}
+
+	status, err := p.Deduplicator.Claim(ctx, key)
+	if err != nil {
+		log.Println("Should have checked for a duplicate notification", key, err)
+		return "", Claimed
+	}
+	return key, status
+}
+
+// complete acknowledges later deliveries of the notification claimed with key
+func (p Pipeline) complete(ctx context.Context, key string) {
+	if key == "" {
+		return
+	}
+	if err := p.Deduplicator.Complete(ctx, key); err != nil {
+		log.Println("Should have marked notification processed", key, err)
+	}
+}
+
+// release lets a retry of the notification claimed with key be processed again
+func (p Pipeline) release(ctx context.Context, key string) {
+	if key == "" {
+		return
+	}
+	if err := p.Deduplicator.Release(ctx, key); err != nil {
+		log.Println("Should have released notification for retry", key, err)
+	}
+}
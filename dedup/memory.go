@@ -0,0 +1,99 @@
+package dedup
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	ss "github.com/carpenterscode/superscribe"
+)
+
+// DefaultLease is how long one delivery of a notification has to process it before another
+// delivery takes it over
+const DefaultLease = 5 * time.Minute
+
+// Memory remembers processed notifications for TTL, which suits a single instance. Apple
+// retries a notification for a few days, so a TTL of a week or so covers every retry.
+type Memory struct {
+	TTL   time.Duration
+	Lease time.Duration
+
+	mu        sync.Mutex
+	claimed   map[string]claim
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// claim is when a key was claimed, or processed once it was
+type claim struct {
+	at        time.Time
+	processed bool
+}
+
+// NewMemory remembers notifications for ttl, leasing them for DefaultLease while they're
+// processed
+func NewMemory(ttl time.Duration) *Memory {
+	return &Memory{
+		TTL:     ttl,
+		Lease:   DefaultLease,
+		claimed: make(map[string]claim),
+		now:     time.Now,
+	}
+}
+
+// Claim leases key unless it was processed within TTL, or another delivery's lease is current
+func (m *Memory) Claim(ctx context.Context, key string) (ss.ClaimStatus, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	m.sweep(now)
+
+	if c, ok := m.claimed[key]; ok && !m.expired(c, now) {
+		if c.processed {
+			return ss.Processed, nil
+		}
+		return ss.InProgress, nil
+	}
+	m.claimed[key] = claim{at: now}
+	return ss.Claimed, nil
+}
+
+// Complete remembers key as processed for TTL
+func (m *Memory) Complete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.claimed[key] = claim{at: m.now(), processed: true}
+	return nil
+}
+
+// Release forgets key
+func (m *Memory) Release(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.claimed, key)
+	return nil
+}
+
+func (m *Memory) expired(c claim, now time.Time) bool {
+	if c.processed {
+		return now.Sub(c.at) >= m.TTL
+	}
+	return now.Sub(c.at) >= m.Lease
+}
+
+// sweep forgets expired keys at most once per TTL, so memory stays bounded by the notifications
+// of about two TTLs
+func (m *Memory) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < m.TTL {
+		return
+	}
+	for key, c := range m.claimed {
+		if m.expired(c, now) {
+			delete(m.claimed, key)
+		}
+	}
+	m.lastSweep = now
+}
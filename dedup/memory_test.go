@@ -0,0 +1,55 @@
+package dedup
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	ss "github.com/carpenterscode/superscribe"
+)
+
+func TestMemory(t *testing.T) {
+	now := time.Date(2019, time.March, 6, 0, 0, 0, 0, time.UTC)
+	memory := NewMemory(time.Hour)
+	memory.Lease = time.Minute
+	memory.now = func() time.Time { return now }
+
+	var deduplicator ss.Deduplicator = memory
+	ctx := context.Background()
+
+	if status, _ := deduplicator.Claim(ctx, "RENEWAL:1"); status != ss.Claimed {
+		t.Error("Should have claimed a new notification", status)
+	}
+	if status, _ := deduplicator.Claim(ctx, "RENEWAL:1"); status != ss.InProgress {
+		t.Error("Should not have claimed a notification another delivery is processing", status)
+	}
+
+	deduplicator.Release(ctx, "RENEWAL:1")
+	if status, _ := deduplicator.Claim(ctx, "RENEWAL:1"); status != ss.Claimed {
+		t.Error("Should have claimed a released notification again", status)
+	}
+
+	deduplicator.Complete(ctx, "RENEWAL:1")
+	if status, _ := deduplicator.Claim(ctx, "RENEWAL:1"); status != ss.Processed {
+		t.Error("Should not have claimed a processed notification", status)
+	}
+
+	// A delivery that never finished, such as from a crashed instance, gives up its lease
+	deduplicator.Claim(ctx, "RENEWAL:2")
+	now = now.Add(time.Minute)
+	if status, _ := deduplicator.Claim(ctx, "RENEWAL:2"); status != ss.Claimed {
+		t.Error("Should have taken over an expired lease", status)
+	}
+	if status, _ := deduplicator.Claim(ctx, "RENEWAL:1"); status != ss.Processed {
+		t.Error("Should have remembered a processed notification within TTL", status)
+	}
+
+	deduplicator.Claim(ctx, "RENEWAL:3")
+	now = now.Add(time.Hour)
+	if status, _ := deduplicator.Claim(ctx, "RENEWAL:1"); status != ss.Claimed {
+		t.Error("Should have forgotten a notification after TTL", status)
+	}
+	if _, ok := memory.claimed["RENEWAL:3"]; ok {
+		t.Error("Should have swept expired notifications")
+	}
+}
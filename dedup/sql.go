@@ -0,0 +1,122 @@
+package dedup
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	ss "github.com/carpenterscode/superscribe"
+)
+
+// SQL remembers notifications in a database table shared by every instance, such as
+//
+//	CREATE TABLE superscribe_notifications (
+//	    notification_key VARCHAR(255) PRIMARY KEY,
+//	    claimed_at TIMESTAMP NOT NULL,
+//	    completed_at TIMESTAMP NULL
+//	)
+//
+// Call Purge periodically to forget notifications Apple no longer retries.
+type SQL struct {
+	DB *sql.DB
+
+	// Lease is how long one delivery has to process a notification before another takes it over
+	Lease time.Duration
+
+	// ClaimQuery inserts a key and its claim time, or else updates the claim time of a key
+	// claimed before a lease cutoff and not completed, affecting no rows otherwise. StatusQuery
+	// selects whether a key was completed. CompleteQuery sets completed_at of a key, which is
+	// the last argument. ReleaseQuery deletes a key, and PurgeQuery deletes keys claimed before
+	// a time.
+	ClaimQuery    string
+	StatusQuery   string
+	CompleteQuery string
+	ReleaseQuery  string
+	PurgeQuery    string
+}
+
+// NewPostgres remembers notifications in table with INSERT ... ON CONFLICT DO UPDATE
+func NewPostgres(db *sql.DB, table string) *SQL {
+	return &SQL{
+		DB:    db,
+		Lease: DefaultLease,
+		ClaimQuery: fmt.Sprintf("INSERT INTO %s AS claim (notification_key, claimed_at) "+
+			"VALUES ($1, $2) ON CONFLICT (notification_key) DO UPDATE SET "+
+			"claimed_at = EXCLUDED.claimed_at WHERE claim.completed_at IS NULL AND "+
+			"claim.claimed_at < $3", table),
+		StatusQuery: fmt.Sprintf("SELECT completed_at IS NOT NULL FROM %s "+
+			"WHERE notification_key = $1", table),
+		CompleteQuery: fmt.Sprintf("UPDATE %s SET completed_at = $1 WHERE notification_key = $2",
+			table),
+		ReleaseQuery: fmt.Sprintf("DELETE FROM %s WHERE notification_key = $1", table),
+		PurgeQuery:   fmt.Sprintf("DELETE FROM %s WHERE claimed_at < $1", table),
+	}
+}
+
+// NewMySQL remembers notifications in table with INSERT ... ON DUPLICATE KEY UPDATE, which
+// counts only changed rows as affected unless the clientFoundRows option is set
+func NewMySQL(db *sql.DB, table string) *SQL {
+	return &SQL{
+		DB:    db,
+		Lease: DefaultLease,
+		ClaimQuery: fmt.Sprintf("INSERT INTO %s (notification_key, claimed_at) VALUES (?, ?) "+
+			"ON DUPLICATE KEY UPDATE claimed_at = IF(completed_at IS NULL AND claimed_at < ?, "+
+			"VALUES(claimed_at), claimed_at)", table),
+		StatusQuery: fmt.Sprintf("SELECT completed_at IS NOT NULL FROM %s "+
+			"WHERE notification_key = ?", table),
+		CompleteQuery: fmt.Sprintf("UPDATE %s SET completed_at = ? WHERE notification_key = ?",
+			table),
+		ReleaseQuery: fmt.Sprintf("DELETE FROM %s WHERE notification_key = ?", table),
+		PurgeQuery:   fmt.Sprintf("DELETE FROM %s WHERE claimed_at < ?", table),
+	}
+}
+
+// Claim inserts key or takes over an expired lease, which succeeded only if it affected a row
+func (d *SQL) Claim(ctx context.Context, key string) (ss.ClaimStatus, error) {
+	now := time.Now().UTC()
+	result, err := d.DB.ExecContext(ctx, d.ClaimQuery, key, now, now.Add(-d.Lease))
+	if err != nil {
+		return "", err
+	}
+
+	claimed, err := result.RowsAffected()
+	if err != nil {
+		return "", err
+	} else if claimed > 0 {
+		return ss.Claimed, nil
+	}
+
+	var completed bool
+	err = d.DB.QueryRowContext(ctx, d.StatusQuery, key).Scan(&completed)
+	if err == sql.ErrNoRows {
+		// Released since, so Apple's retry is processed
+		return ss.InProgress, nil
+	} else if err != nil {
+		return "", err
+	} else if completed {
+		return ss.Processed, nil
+	}
+	return ss.InProgress, nil
+}
+
+// Complete sets when key was processed
+func (d *SQL) Complete(ctx context.Context, key string) error {
+	_, err := d.DB.ExecContext(ctx, d.CompleteQuery, time.Now().UTC(), key)
+	return err
+}
+
+// Release deletes key
+func (d *SQL) Release(ctx context.Context, key string) error {
+	_, err := d.DB.ExecContext(ctx, d.ReleaseQuery, key)
+	return err
+}
+
+// Purge deletes keys claimed before cutoff, and returns how many
+func (d *SQL) Purge(ctx context.Context, cutoff time.Time) (int64, error) {
+	result, err := d.DB.ExecContext(ctx, d.PurgeQuery, cutoff.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,189 @@
+package dedup
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	ss "github.com/carpenterscode/superscribe"
+	"github.com/carpenterscode/superscribe/internal/fakedb"
+)
+
+// fakeClaim is a row of the notifications table
+type fakeClaim struct {
+	claimedAt time.Time
+	completed bool
+}
+
+// fakeTable executes the Postgres and MySQL statements against a map of claims, checking their
+// arguments
+type fakeTable struct {
+	fakedb.DB
+
+	t      *testing.T
+	claims map[string]fakeClaim
+
+	// rowsAffectedErr fails RowsAffected, as drivers that don't support it do
+	rowsAffectedErr error
+}
+
+func newFakeTable(t *testing.T) *fakeTable {
+	table := &fakeTable{t: t, claims: make(map[string]fakeClaim)}
+	table.Exec = table.exec
+	table.Query = table.query
+	return table
+}
+
+func (table *fakeTable) exec(conn *fakedb.Conn, query string,
+	args []driver.Value) (driver.Result, error) {
+
+	values := make([]driver.Value, 3)
+	copy(values, args)
+
+	var affected int64
+	switch {
+	case strings.HasPrefix(query, "INSERT"):
+		key, keyOK := values[0].(string)
+		claimedAt, timeOK := values[1].(time.Time)
+		cutoff, cutoffOK := values[2].(time.Time)
+		if len(args) != 3 || !keyOK || !timeOK || !cutoffOK {
+			table.t.Fatal("Should have claimed with key, time and lease cutoff", args)
+		}
+		if c, ok := table.claims[key]; !ok || !c.completed && c.claimedAt.Before(cutoff) {
+			table.claims[key] = fakeClaim{claimedAt: claimedAt}
+			affected = 1
+		}
+
+	case strings.HasPrefix(query, "UPDATE"):
+		_, timeOK := values[0].(time.Time)
+		key, keyOK := values[1].(string)
+		if len(args) != 2 || !timeOK || !keyOK {
+			table.t.Fatal("Should have completed with time and then key", args)
+		}
+		if c, ok := table.claims[key]; ok {
+			c.completed = true
+			table.claims[key] = c
+			affected = 1
+		}
+
+	case strings.HasSuffix(query, "notification_key = $1"),
+		strings.HasSuffix(query, "notification_key = ?"):
+
+		key, ok := values[0].(string)
+		if len(args) != 1 || !ok {
+			table.t.Fatal("Should have released by key", args)
+		}
+		if _, ok := table.claims[key]; ok {
+			delete(table.claims, key)
+			affected = 1
+		}
+
+	case strings.HasSuffix(query, "claimed_at < $1"), strings.HasSuffix(query, "claimed_at < ?"):
+		cutoff, ok := values[0].(time.Time)
+		if len(args) != 1 || !ok {
+			table.t.Fatal("Should have purged by claim time", args)
+		}
+		for key, c := range table.claims {
+			if c.claimedAt.Before(cutoff) {
+				delete(table.claims, key)
+				affected++
+			}
+		}
+
+	default:
+		table.t.Fatal("Should have executed a known statement", query)
+	}
+
+	if table.rowsAffectedErr != nil {
+		return errResult{table.rowsAffectedErr}, nil
+	}
+	return driver.RowsAffected(affected), nil
+}
+
+// query selects whether a key was completed
+func (table *fakeTable) query(conn *fakedb.Conn, query string,
+	args []driver.Value) ([][]driver.Value, error) {
+
+	key, ok := "", len(args) == 1
+	if ok {
+		key, ok = args[0].(string)
+	}
+	if !strings.HasPrefix(query, "SELECT completed_at IS NOT NULL") || !ok {
+		table.t.Fatal("Should have selected the status of a key", query, args)
+	}
+
+	if c, ok := table.claims[key]; ok {
+		return [][]driver.Value{{c.completed}}, nil
+	}
+	return nil, nil
+}
+
+type errResult struct {
+	err error
+}
+
+func (result errResult) LastInsertId() (int64, error) {
+	return 0, result.err
+}
+
+func (result errResult) RowsAffected() (int64, error) {
+	return 0, result.err
+}
+
+func TestSQL(t *testing.T) {
+	for _, newSQL := range []func(*sql.DB, string) *SQL{NewPostgres, NewMySQL} {
+		table := newFakeTable(t)
+		db := sql.OpenDB(table)
+		defer db.Close()
+
+		d := newSQL(db, "superscribe_notifications")
+		var deduplicator ss.Deduplicator = d
+		ctx := context.Background()
+
+		if status, err := deduplicator.Claim(ctx, "RENEWAL:1"); status != ss.Claimed || err != nil {
+			t.Error("Should have claimed a new notification", status, err)
+		}
+		if status, err := deduplicator.Claim(ctx, "RENEWAL:1"); status != ss.InProgress ||
+			err != nil {
+
+			t.Error("Should not have claimed a notification another delivery is processing",
+				status, err)
+		}
+
+		deduplicator.Release(ctx, "RENEWAL:1")
+		if status, _ := deduplicator.Claim(ctx, "RENEWAL:1"); status != ss.Claimed {
+			t.Error("Should have claimed a released notification again", status)
+		}
+
+		deduplicator.Complete(ctx, "RENEWAL:1")
+		if status, err := deduplicator.Claim(ctx, "RENEWAL:1"); status != ss.Processed ||
+			err != nil {
+
+			t.Error("Should not have claimed a processed notification", status, err)
+		}
+
+		// A delivery that never finished, such as from a crashed instance, gives up its lease
+		deduplicator.Claim(ctx, "RENEWAL:2")
+		table.claims["RENEWAL:2"] = fakeClaim{claimedAt: time.Now().Add(-2 * time.Hour)}
+		if status, _ := deduplicator.Claim(ctx, "RENEWAL:2"); status != ss.Claimed {
+			t.Error("Should have taken over an expired lease", status)
+		}
+
+		table.claims["RENEWAL:2"] = fakeClaim{claimedAt: time.Now().Add(-2 * time.Hour)}
+		if purged, err := d.Purge(ctx, time.Now().Add(-time.Hour)); purged != 1 || err != nil {
+			t.Error("Should have purged notifications claimed before the cutoff", purged, err)
+		} else if _, ok := table.claims["RENEWAL:1"]; !ok {
+			t.Error("Should have kept notifications claimed since the cutoff")
+		}
+
+		// Without a row count, a duplicate can't be told apart
+		table.rowsAffectedErr = errors.New("RowsAffected not supported")
+		if _, err := deduplicator.Claim(ctx, "RENEWAL:3"); err == nil {
+			t.Error("Should have returned the RowsAffected error")
+		}
+	}
+}
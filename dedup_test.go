@@ -0,0 +1,119 @@
+package superscribe
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+)
+
+// fakeDeduplicator remembers the status of claimed keys in a map, without leases expiring
+type fakeDeduplicator struct {
+	mu      sync.Mutex
+	claimed map[string]ClaimStatus
+}
+
+func (d *fakeDeduplicator) Claim(ctx context.Context, key string) (ClaimStatus, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if status, ok := d.claimed[key]; ok {
+		return status, nil
+	}
+	d.claimed[key] = InProgress
+	return Claimed, nil
+}
+
+func (d *fakeDeduplicator) Complete(ctx context.Context, key string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.claimed[key] = Processed
+	return nil
+}
+
+func (d *fakeDeduplicator) Release(ctx context.Context, key string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.claimed, key)
+	return nil
+}
+
+func TestDedupKey(t *testing.T) {
+	cases := []struct {
+		note Note
+		key  string
+	}{
+		{*notificationFromFile("DID_RECOVER.json"),
+			"DID_RECOVER:123456789012346:520000139327002"},
+		{*notificationFromFile("DID_CHANGE_RENEWAL_STATUS_to_off.json"),
+			"DID_CHANGE_RENEWAL_STATUS:123456789012345:520000139327002:1560202787000"},
+		{notificationV2{body: NotificationV2{NotificationType: DidRenew,
+			NotificationUUID: "002e14d5-51f5-4503-b5a8-c3a1af68eb20"}},
+			"RENEWAL:002e14d5-51f5-4503-b5a8-c3a1af68eb20"},
+		{*notificationFromFile("RENEWAL.json"), ""},
+	}
+
+	for _, c := range cases {
+		if key := dedupKey(c.note); key != c.key {
+			t.Errorf("Should have keyed %s as %q, got %q", c.note.Type(), c.key, key)
+		}
+	}
+}
+
+func TestHandleDuplicateNotification(t *testing.T) {
+
+	// Set up mocks and fakes
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSub := NewMockSubscription(ctrl)
+	mockSub.EXPECT().Currency().Return(currency).AnyTimes()
+	mockSub.EXPECT().Price().Return(price).AnyTimes()
+
+	mockListener := NewMockEventListener(ctrl)
+	mockListener.EXPECT().Paid(gomock.Any()).Times(1)
+	mockListener.EXPECT().RecoveredFromBillingRetry(gomock.Any()).Times(1)
+
+	fetchErr := errors.New("Subscription unavailable")
+	fakeMatcher := func(now time.Time) []string { return []string{} }
+	fakeFetcher := func(originalTransactionID string) (Subscription, error) {
+		if fetchErr != nil {
+			return nil, fetchErr
+		}
+		return mockSub, nil
+	}
+
+	srv := NewServer("http://example.com", testValidator, fakeMatcher, fakeFetcher, stubUpdater{}, 1)
+	srv.Listener.Add(mockListener)
+	deduplicator := &fakeDeduplicator{claimed: make(map[string]ClaimStatus)}
+	srv.Deduplicator = deduplicator
+
+	deliver := func(expected int) {
+		req := httptest.NewRequest("POST", "http://example.com/superscribe",
+			bytes.NewReader(dataFromFile("DID_RECOVER.json")))
+		w := httptest.NewRecorder()
+		srv.mux.ServeHTTP(w, req)
+		if w.Code != expected {
+			t.Errorf("Wrong status code: got %v want %v", w.Code, expected)
+		}
+	}
+
+	// A delivery while another is processing is retried in case the other fails
+	key := "DID_RECOVER:123456789012346:520000139327002"
+	deduplicator.claimed[key] = InProgress
+	deliver(http.StatusConflict)
+	delete(deduplicator.claimed, key)
+
+	// A failed delivery is processed again when Apple retries
+	deliver(http.StatusNotFound)
+	fetchErr = nil
+	deliver(http.StatusOK)
+
+	// Duplicates are acknowledged without notifying listeners again
+	deliver(http.StatusOK)
+}
@@ -18,6 +18,20 @@ type Event struct {
 	price                 float64
 	productID             string
 
+	// Billing state
+	expirationIntent       int
+	gracePeriodExpiresAt   time.Time
+	isInBillingRetryPeriod bool
+
+	// Renewal info is unknown when the receipt had none for this subscription
+	renewalUnknown bool
+
+	// Price increase, where nil consent status means none is pending
+	priceConsentStatus    *int
+	previousPrice         float64
+	newPrice              float64
+	priceConsentChangedAt time.Time
+
 	autoRenewChangedAt time.Time
 	cancelledAt        time.Time
 	expiresAt          time.Time
@@ -25,10 +39,37 @@ type Event struct {
 	refundedAt         time.Time
 	startedTrialAt     time.Time
 
+	// Offer in effect
+	isInIntroOfferPeriod bool
+	offerType            int
+	offerIdentifier      string
+	offerDiscountType    string
+
+	// Product change
+	productChange            ProductChange
+	previousProductID        string
+	productChangedAt         time.Time
+	isProductChangeImmediate bool
+
+	// Payment
+	paymentKind        PaymentKind
+	renewalCount       int
+	commissionRate     float64
+	oneYearPaidService bool
+
 	// User data
 	user User
 }
 
+// AccessExpiresAt is when a subscription stops entitling its user, which is the end of the
+// billing grace period if that's later than ExpiresAt
+func AccessExpiresAt(sub Subscription) time.Time {
+	if sub.GracePeriodExpiresAt().After(sub.ExpiresAt()) {
+		return sub.GracePeriodExpiresAt()
+	}
+	return sub.ExpiresAt()
+}
+
 func (evt *Event) SetNote(note Note) {
 	evt.cancelledAt = note.CancelledAt()
 	evt.expiresAt = note.ExpiresAt()
@@ -42,6 +83,13 @@ func (evt *Event) SetNote(note Note) {
 	evt.startedTrialAt = note.StartedTrialAt()
 	evt.autoRenewStatus = note.AutoRenewStatus()
 	evt.autoRenewChangedAt = note.AutoRenewChangedAt()
+
+	evt.expirationIntent = note.ExpirationIntent()
+	evt.gracePeriodExpiresAt = note.GracePeriodExpiresAt()
+	evt.isInBillingRetryPeriod = note.IsInBillingRetryPeriod()
+	evt.setPriceConsentStatus(note.PriceConsentStatus())
+
+	evt.setOffer(note)
 }
 
 func (evt *Event) SetReceiptInfo(resp receipt.Info) {
@@ -51,7 +99,38 @@ func (evt *Event) SetReceiptInfo(resp receipt.Info) {
 	evt.originalTransactionID = resp.OriginalTransactionID()
 	evt.paidAt = resp.PaidAt()
 	evt.productID = resp.ProductID()
+	evt.autoRenewProductID = resp.AutoRenewProduct()
 	evt.autoRenewStatus = resp.AutoRenewStatus()
+
+	evt.expirationIntent = resp.ExpirationIntent()
+	evt.gracePeriodExpiresAt = resp.GracePeriodExpiresAt()
+	evt.isInBillingRetryPeriod = resp.IsInBillingRetryPeriod()
+	evt.setPriceConsentStatus(resp.PriceConsentStatus())
+	if renewal, ok := resp.(renewalInfoReporter); ok {
+		evt.renewalUnknown = !renewal.HasRenewalInfo()
+	}
+
+	evt.setOffer(resp)
+}
+
+// renewalInfoReporter is receipt info that can tell missing renewal info from auto-renew being
+// off, which verifyReceipt responses with several subscription groups can
+type renewalInfoReporter interface {
+	HasRenewalInfo() bool
+}
+
+func (evt *Event) setOffer(info receipt.Info) {
+	evt.isInIntroOfferPeriod = info.IsInIntroOfferPeriod()
+	evt.offerType = info.OfferType()
+	evt.offerIdentifier = info.OfferIdentifier()
+	evt.offerDiscountType = info.OfferDiscountType()
+}
+
+func (evt *Event) setPriceConsentStatus(status int) {
+	evt.priceConsentStatus = nil
+	if status != receipt.PriceConsentNone {
+		evt.priceConsentStatus = &status
+	}
 }
 
 func (evt *Event) SetRevenue(currency string, price float64) {
@@ -59,6 +138,47 @@ func (evt *Event) SetRevenue(currency string, price float64) {
 	evt.price = price
 }
 
+func (evt *Event) SetAutoRenewChangedAt(autoRenewChangedAt time.Time) {
+	evt.autoRenewChangedAt = autoRenewChangedAt
+}
+
+func (evt *Event) SetRefundedAt(refundedAt time.Time) {
+	evt.refundedAt = refundedAt
+}
+
+// SetProductChange describes a change from previousProductID, which takes effect at the next
+// renewal unless immediate
+func (evt *Event) SetProductChange(change ProductChange, previousProductID string,
+	changedAt time.Time, immediate bool) {
+
+	evt.productChange = change
+	evt.previousProductID = previousProductID
+	evt.productChangedAt = changedAt
+	evt.isProductChangeImmediate = immediate
+}
+
+// SetPriceIncrease describes a price increase from previousPrice to newPrice, in Currency
+func (evt *Event) SetPriceIncrease(previousPrice, newPrice float64) {
+	evt.previousPrice = previousPrice
+	evt.newPrice = newPrice
+}
+
+func (evt *Event) SetPriceConsentChangedAt(priceConsentChangedAt time.Time) {
+	evt.priceConsentChangedAt = priceConsentChangedAt
+}
+
+// SetPayment classifies the payment for PayEvent, with -1 for an unknown renewal count
+func (evt *Event) SetPayment(kind PaymentKind, renewalCount int) {
+	evt.paymentKind = kind
+	evt.renewalCount = renewalCount
+}
+
+// SetCommission sets the App Store commission rate used to calculate proceeds
+func (evt *Event) SetCommission(rate float64, oneYearPaidService bool) {
+	evt.commissionRate = rate
+	evt.oneYearPaidService = oneYearPaidService
+}
+
 func (evt *Event) SetStartedTrialAt(startedTrialAt time.Time) {
 	evt.startedTrialAt = startedTrialAt
 }
@@ -91,6 +211,85 @@ func (evt Event) ExpiresAt() time.Time {
 	return evt.expiresAt
 }
 
+func (evt Event) ExpirationIntent() int {
+	return evt.expirationIntent
+}
+
+func (evt Event) GracePeriodExpiresAt() time.Time {
+	return evt.gracePeriodExpiresAt
+}
+
+func (evt Event) IsInBillingRetryPeriod() bool {
+	return evt.isInBillingRetryPeriod
+}
+
+func (evt Event) PriceConsentStatus() int {
+	if evt.priceConsentStatus == nil {
+		return receipt.PriceConsentNone
+	}
+	return *evt.priceConsentStatus
+}
+
+func (evt Event) PreviousPrice() float64 {
+	return evt.previousPrice
+}
+
+func (evt Event) NewPrice() float64 {
+	return evt.newPrice
+}
+
+func (evt Event) PriceConsentChangedAt() time.Time {
+	return evt.priceConsentChangedAt
+}
+
+func (evt Event) ProductChange() ProductChange {
+	return evt.productChange
+}
+
+func (evt Event) PreviousProductID() string {
+	return evt.previousProductID
+}
+
+func (evt Event) ProductChangedAt() time.Time {
+	return evt.productChangedAt
+}
+
+func (evt Event) IsProductChangeImmediate() bool {
+	return evt.isProductChangeImmediate
+}
+
+func (evt Event) IsInIntroOfferPeriod() bool {
+	return evt.isInIntroOfferPeriod
+}
+
+func (evt Event) OfferType() int {
+	return evt.offerType
+}
+
+func (evt Event) OfferIdentifier() string {
+	return evt.offerIdentifier
+}
+
+func (evt Event) OfferDiscountType() string {
+	return evt.offerDiscountType
+}
+
+// AccessExpiresAt is when access ends unless the subscription renews, which is after ExpiresAt
+// during a billing grace period
+func (evt Event) AccessExpiresAt() time.Time {
+	return AccessExpiresAt(evt)
+}
+
+// ExpiredAt is when access ended, which is after the billing grace period if there was one
+func (evt Event) ExpiredAt() time.Time {
+	return evt.AccessExpiresAt()
+}
+
+// EnteredBillingRetryAt is when the App Store failed to renew the subscription
+func (evt Event) EnteredBillingRetryAt() time.Time {
+	return evt.expiresAt
+}
+
 func (evt Event) Currency() string {
 	return evt.currency
 }
@@ -111,6 +310,26 @@ func (evt Event) PaidAt() time.Time {
 	return evt.paidAt
 }
 
+func (evt Event) PaymentKind() PaymentKind {
+	return evt.paymentKind
+}
+
+func (evt Event) RenewalCount() int {
+	return evt.renewalCount
+}
+
+func (evt Event) CommissionRate() float64 {
+	return evt.commissionRate
+}
+
+func (evt Event) Proceeds() float64 {
+	return evt.price * (1 - evt.commissionRate)
+}
+
+func (evt Event) OneYearPaidService() bool {
+	return evt.oneYearPaidService
+}
+
 func (evt Event) RefundedAt() time.Time {
 	return evt.refundedAt
 }
@@ -129,10 +348,29 @@ func (evt Event) String() string {
 		fmt.Sprintf("%s: %v\n", "isTrialPeriod", evt.isTrialPeriod) +
 		fmt.Sprintf("%s: %v\n", "originalTransactionID", evt.originalTransactionID) +
 		fmt.Sprintf("%s: %v\n", "productID", evt.productID) +
+		fmt.Sprintf("%s: %v\n", "expirationIntent", evt.expirationIntent) +
+		fmt.Sprintf("%s: %v\n", "gracePeriodExpiresAt", evt.gracePeriodExpiresAt) +
+		fmt.Sprintf("%s: %v\n", "isInBillingRetryPeriod", evt.isInBillingRetryPeriod) +
+		fmt.Sprintf("%s: %v\n", "priceConsentStatus", evt.PriceConsentStatus()) +
+		fmt.Sprintf("%s: %v\n", "previousPrice", evt.previousPrice) +
+		fmt.Sprintf("%s: %v\n", "newPrice", evt.newPrice) +
+		fmt.Sprintf("%s: %v\n", "priceConsentChangedAt", evt.priceConsentChangedAt) +
 		fmt.Sprintf("%s: %v\n", "autoRenewChangedAt", evt.autoRenewChangedAt) +
 		fmt.Sprintf("%s: %v\n", "cancelledAt", evt.cancelledAt) +
 		fmt.Sprintf("%s: %v\n", "expiresAt", evt.expiresAt) +
 		fmt.Sprintf("%s: %v\n", "paidAt", evt.paidAt) +
+		fmt.Sprintf("%s: %v\n", "isInIntroOfferPeriod", evt.isInIntroOfferPeriod) +
+		fmt.Sprintf("%s: %v\n", "offerType", evt.offerType) +
+		fmt.Sprintf("%s: %v\n", "offerIdentifier", evt.offerIdentifier) +
+		fmt.Sprintf("%s: %v\n", "offerDiscountType", evt.offerDiscountType) +
+		fmt.Sprintf("%s: %v\n", "productChange", evt.productChange) +
+		fmt.Sprintf("%s: %v\n", "previousProductID", evt.previousProductID) +
+		fmt.Sprintf("%s: %v\n", "productChangedAt", evt.productChangedAt) +
+		fmt.Sprintf("%s: %v\n", "isProductChangeImmediate", evt.isProductChangeImmediate) +
+		fmt.Sprintf("%s: %v\n", "paymentKind", evt.paymentKind) +
+		fmt.Sprintf("%s: %v\n", "renewalCount", evt.renewalCount) +
+		fmt.Sprintf("%s: %v\n", "commissionRate", evt.commissionRate) +
+		fmt.Sprintf("%s: %v\n", "oneYearPaidService", evt.oneYearPaidService) +
 		fmt.Sprintf("%s: %v\n", "refundedAt", evt.refundedAt) +
 		fmt.Sprintf("%s: %v\n", "startedTrialAt", evt.startedTrialAt)
 }
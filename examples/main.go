@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
 	"os/signal"
 	"time"
 
 	ss "github.com/carpenterscode/superscribe"
+	"github.com/carpenterscode/superscribe/journal"
 	"github.com/carpenterscode/superscribe/listener"
 	"github.com/carpenterscode/superscribe/receipt"
 )
@@ -35,7 +37,7 @@ func (u updater) UpdateWithReceipt(r receipt.Info) error {
 func main() {
 	srv := ss.NewServer(
 		":8080",
-		"password",
+		receipt.NewValidator("password"),
 		match,
 		fetch,
 		updater{},
@@ -43,6 +45,15 @@ func main() {
 	)
 	srv.AddListener(listener.AppsFlyer{})
 	srv.AddListener(listener.Stub{})
+	srv.Journal = journal.NewFile("notifications.jsonl")
+
+	// Replay journaled notifications, like `example replay -from 2019-03-06T00:00:00Z -failed`
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		if err := ss.ReplayCommand(context.Background(), srv, os.Args[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt)
@@ -4,6 +4,5 @@ go 1.12
 
 require (
 	github.com/carpenterscode/appsflyer-go v1.3.0
-	github.com/carpenterscode/superscribe/receipt v1.0.0
 	github.com/golang/mock v1.3.1
 )
@@ -1,6 +1,7 @@
 package superscribe
 
 import (
+	"context"
 	"time"
 
 	"github.com/carpenterscode/superscribe/receipt"
@@ -9,9 +10,15 @@ import (
 //go:generate mockgen -package=superscribe -destination=./mock.go -self_package=github.com/carpenterscode/superscribe github.com/carpenterscode/superscribe EventListener,Subscription
 
 // ExpiringSubscriptions returns a list of App Store receipts for subscriptions nearing
-// expiration for a specified current time.
+// expiration for a specified current time. When the server looks subscriptions up with the App
+// Store Server API, return original transaction IDs instead.
 type ExpiringSubscriptions func(time.Time) []string
 
+// LookupSubscription returns the latest App Store state for one result of ExpiringSubscriptions,
+// such as receipt.Validate for receipts or receipt.Client.SubscriptionStatus for original
+// transaction IDs.
+type LookupSubscription func(string) (receipt.Info, error)
+
 // SubscriptionFetch returns the last known state of a subscription by original transaction ID,
 // which can determine what changes have happened when compared to the latest receipt info.
 type SubscriptionFetch func(string) (Subscription, error)
@@ -22,7 +29,6 @@ type Note interface {
 
 	receipt.Info
 
-	AutoRenewProduct() string
 	AutoRenewChangedAt() time.Time
 	RefundedAt() time.Time
 	StartedTrialAt() time.Time
@@ -33,12 +39,55 @@ type SubscriptionUpdater interface {
 	UpdateWithReceipt(receipt.Info) error
 }
 
+// LookupErrorUpdater is optionally implemented by a SubscriptionUpdater to hear about receipts
+// that a scan couldn't look up. Classify err with helpers like receipt.IsPermanent, such as to flag
+// accounts whose receipts are malformed.
+type LookupErrorUpdater interface {
+	UpdateWithLookupError(receiptData string, err error) error
+}
+
+// ExpiringSubscriptionsContext is ExpiringSubscriptions with a context that's cancelled when the
+// server stops
+type ExpiringSubscriptionsContext func(context.Context, time.Time) []string
+
+// LookupSubscriptionContext is LookupSubscription with a context, such as receipt.ValidateContext
+// or receipt.Client.SubscriptionStatusContext
+type LookupSubscriptionContext func(context.Context, string) (receipt.Info, error)
+
+// SubscriptionFetchContext is SubscriptionFetch with a context that carries the notification
+// request's deadline, or is cancelled when the server stops during a scan
+type SubscriptionFetchContext func(context.Context, string) (Subscription, error)
+
+// SubscriptionUpdaterContext is SubscriptionUpdater with contexts like SubscriptionFetchContext
+type SubscriptionUpdaterContext interface {
+	UpdateWithNotificationContext(context.Context, Note) error
+	UpdateWithReceiptContext(context.Context, receipt.Info) error
+}
+
+// LookupErrorUpdaterContext is LookupErrorUpdater for a SubscriptionUpdaterContext
+type LookupErrorUpdaterContext interface {
+	UpdateWithLookupErrorContext(ctx context.Context, receiptData string, err error) error
+}
+
+// Locker elects which of several server instances scans expiring subscriptions. Every instance
+// still handles notifications.
+type Locker interface {
+
+	// Lock takes leadership without waiting, or confirms this instance still has it. It returns
+	// false while another instance leads.
+	Lock() (bool, error)
+
+	// Unlock gives up leadership so another instance can take over
+	Unlock() error
+}
+
 type EventListener interface {
 
 	// Name describes the listener for identification in the logs
 	Name() string
 
-	// ChangedAutoRenewProduct indicates the next renewal period's product ID
+	// ChangedAutoRenewProduct indicates the next renewal period's product ID, unless the change
+	// is reported as an upgrade, downgrade or crossgrade instead
 	ChangedAutoRenewProduct(AutoRenewEvent) error
 
 	// ChangedAutoRenewStatus indicates new on/off state
@@ -52,6 +101,42 @@ type EventListener interface {
 
 	// StartedTrial indicates a subscription free trial began
 	StartedTrial(StartTrialEvent) error
+
+	// Expired indicates access ended, with ExpirationIntent telling voluntary cancellations from
+	// billing failures
+	Expired(ExpireEvent) error
+
+	// EnteredBillingRetry indicates the App Store failed to charge and keeps retrying
+	EnteredBillingRetry(BillingRetryEvent) error
+
+	// EnteredGracePeriod indicates a failed charge while access continues until
+	// GracePeriodExpiresAt
+	EnteredGracePeriod(BillingRetryEvent) error
+
+	// StillInGracePeriod indicates a scan found a subscription already in its billing grace
+	// period, which stays entitled until AccessExpiresAt though it hasn't renewed
+	StillInGracePeriod(BillingRetryEvent) error
+
+	// ExitedGracePeriod indicates the billing grace period ran out without a successful charge,
+	// so access ended while the App Store keeps retrying
+	ExitedGracePeriod(BillingRetryEvent) error
+
+	// RecoveredFromBillingRetry indicates a charge succeeded after billing retry, in addition to
+	// Paid
+	RecoveredFromBillingRetry(PayEvent) error
+
+	// Upgraded, Downgraded and Crossgraded indicate the customer changed to another product of
+	// the same subscription group. Immediate upgrades are reported here instead of as refunds.
+	Upgraded(ProductChangeEvent) error
+	Downgraded(ProductChangeEvent) error
+	Crossgraded(ProductChangeEvent) error
+
+	// PriceIncreaseConsentRequested indicates the App Store asked the customer to agree to a
+	// price increase, which they accept with PriceIncreaseAccepted or decline with
+	// PriceIncreaseDeclined when the subscription expires without renewing
+	PriceIncreaseConsentRequested(PriceIncreaseEvent) error
+	PriceIncreaseAccepted(PriceIncreaseEvent) error
+	PriceIncreaseDeclined(PriceIncreaseEvent) error
 }
 
 type User interface {
@@ -74,25 +159,58 @@ type Subscription interface {
 	OriginalTransactionID() string
 	ProductID() string
 
+	AutoRenewProduct() string
 	AutoRenewStatus() bool
+	CancelledAt() time.Time
 	IsTrialPeriod() bool
 	ExpiresAt() time.Time
 
+	// Billing state as last updated from receipt info or notifications
+	ExpirationIntent() int
+	GracePeriodExpiresAt() time.Time
+	IsInBillingRetryPeriod() bool
+
+	// PriceConsentStatus is one of the receipt.PriceConsent constants, as last updated
+	PriceConsentStatus() int
+
 	Currency() string
 	Price() float64
 
 	User
 }
 
+// StorefrontSubscription is optionally implemented by a Subscription to price it from the catalog
+// in the App Store country it was last known to be bought in, when receipt info doesn't say
+type StorefrontSubscription interface {
+	Subscription
+	Storefront() string
+}
+
 type AutoRenewEvent interface {
 	Subscription
-	AutoRenewProduct() string
 	AutoRenewChangedAt() time.Time
 }
 
 type PayEvent interface {
 	Subscription
 	PaidAt() time.Time
+
+	// PaymentKind tells conversions and resubscribes apart from recurring renewals
+	PaymentKind() PaymentKind
+
+	// RenewalCount is how many paid periods came before this one, or -1 if the history wasn't
+	// available to count them
+	RenewalCount() int
+
+	// CommissionRate is the share of Price that Apple keeps, and Proceeds is the rest
+	CommissionRate() float64
+	Proceeds() float64
+
+	// OneYearPaidService reports whether the subscriber had accumulated a year of paid service,
+	// which qualifies the payment for the reduced commission
+	OneYearPaidService() bool
+
+	Offer
 }
 
 type RefundEvent interface {
@@ -103,4 +221,61 @@ type RefundEvent interface {
 type StartTrialEvent interface {
 	Subscription
 	StartedTrialAt() time.Time
+	Offer
+}
+
+// Offer describes the introductory offer, promotional offer or offer code a payment or trial
+// came from, such as to attribute offer code campaigns
+type Offer interface {
+	IsInIntroOfferPeriod() bool
+
+	// OfferType is one of the receipt.OfferType constants, or 0 without an offer
+	OfferType() int
+
+	// OfferIdentifier is the promotional offer ID or offer code reference name
+	OfferIdentifier() string
+
+	// OfferDiscountType tells free trials, pay-as-you-go and pay-up-front offers apart with the
+	// receipt.OfferDiscount constants. It's empty when receipts don't say, and for full price.
+	OfferDiscountType() string
+}
+
+type ProductChangeEvent interface {
+	Subscription
+
+	// PreviousProductID is the product changed from, if known. The product changed to is
+	// ProductID for immediate changes, or else AutoRenewProduct.
+	PreviousProductID() string
+	ProductChangedAt() time.Time
+
+	// IsProductChangeImmediate is true for changes that took effect right away with a prorated
+	// refund, like upgrades, and false for changes that take effect at the next renewal
+	IsProductChangeImmediate() bool
+}
+
+type PriceIncreaseEvent interface {
+	Subscription
+
+	// PreviousPrice is what the subscription renewed at before the increase, and NewPrice is
+	// what it renews at after, both in Currency. NewPrice is 0 when neither the App Store nor
+	// the catalog has it.
+	PreviousPrice() float64
+	NewPrice() float64
+
+	// PriceConsentChangedAt is when the consent status was seen to change, or when the
+	// subscription expired for declines
+	PriceConsentChangedAt() time.Time
+}
+
+type ExpireEvent interface {
+	Subscription
+	ExpiredAt() time.Time
+}
+
+type BillingRetryEvent interface {
+	Subscription
+	EnteredBillingRetryAt() time.Time
+
+	// AccessExpiresAt is GracePeriodExpiresAt during a billing grace period, or else ExpiresAt
+	AccessExpiresAt() time.Time
 }
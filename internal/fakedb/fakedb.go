@@ -0,0 +1,139 @@
+package fakedb
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"sync"
+)
+
+// DB is a database/sql connector for tests of SQL stores, which answers statements with funcs
+// instead of a database. Open it with sql.OpenDB. Funcs run with DB locked, so they can change
+// test state that the test reads with DB locked.
+type DB struct {
+	sync.Mutex
+
+	// Exec executes a statement, and Query selects rows of values in column order. Either fails
+	// the statement when nil.
+	Exec  func(conn *Conn, query string, args []driver.Value) (driver.Result, error)
+	Query func(conn *Conn, query string, args []driver.Value) ([][]driver.Value, error)
+
+	// OnClose, when set, hears that database/sql closed a session
+	OnClose func(conn *Conn)
+}
+
+// Connect starts a session
+func (db *DB) Connect(ctx context.Context) (driver.Conn, error) {
+	return &Conn{db: db}, nil
+}
+
+// Driver is nil, since DB is only opened with sql.OpenDB
+func (db *DB) Driver() driver.Driver {
+	return nil
+}
+
+// Conn is one session. Statements run without preparing or transactions.
+type Conn struct {
+	db *DB
+
+	// Broken fails pings and statements with driver.ErrBadConn, as if the database ended the
+	// session. Closed is set once database/sql closes it.
+	Broken bool
+	Closed bool
+}
+
+func (conn *Conn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("Should have executed without preparing")
+}
+
+func (conn *Conn) Begin() (driver.Tx, error) {
+	return nil, errors.New("Should not have begun a transaction")
+}
+
+func (conn *Conn) Close() error {
+	conn.db.Lock()
+	defer conn.db.Unlock()
+
+	conn.Closed = true
+	if conn.db.OnClose != nil {
+		conn.db.OnClose(conn)
+	}
+	return nil
+}
+
+func (conn *Conn) Ping(ctx context.Context) error {
+	conn.db.Lock()
+	defer conn.db.Unlock()
+
+	if conn.Broken {
+		return driver.ErrBadConn
+	}
+	return nil
+}
+
+func (conn *Conn) ExecContext(ctx context.Context, query string,
+	args []driver.NamedValue) (driver.Result, error) {
+
+	conn.db.Lock()
+	defer conn.db.Unlock()
+
+	if conn.Broken {
+		return nil, driver.ErrBadConn
+	} else if conn.db.Exec == nil {
+		return nil, errors.New("Should not have executed " + query)
+	}
+	return conn.db.Exec(conn, query, namedValues(args))
+}
+
+func (conn *Conn) QueryContext(ctx context.Context, query string,
+	args []driver.NamedValue) (driver.Rows, error) {
+
+	conn.db.Lock()
+	defer conn.db.Unlock()
+
+	if conn.Broken {
+		return nil, driver.ErrBadConn
+	} else if conn.db.Query == nil {
+		return nil, errors.New("Should not have queried " + query)
+	}
+
+	selected, err := conn.db.Query(conn, query, namedValues(args))
+	if err != nil {
+		return nil, err
+	}
+	return &rows{values: selected}, nil
+}
+
+func namedValues(args []driver.NamedValue) []driver.Value {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	return values
+}
+
+// rows has as many unnamed columns as its first row
+type rows struct {
+	values [][]driver.Value
+}
+
+func (rows *rows) Columns() []string {
+	if len(rows.values) == 0 {
+		return nil
+	}
+	return make([]string, len(rows.values[0]))
+}
+
+func (rows *rows) Close() error {
+	return nil
+}
+
+func (rows *rows) Next(dest []driver.Value) error {
+	if len(rows.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, rows.values[0])
+	rows.values = rows.values[1:]
+	return nil
+}
@@ -0,0 +1,96 @@
+package superscribe
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"time"
+)
+
+var (
+	errUnknownSecret = errors.New("Notification should have had a known shared secret")
+	errNoSandbox     = errors.New("Sandbox notification should have had a Sandbox pipeline")
+	errInProgress    = errors.New("Earlier delivery of notification should have finished")
+)
+
+// Journal persists raw notifications with how processing them turned out, so that they can be
+// replayed through the current updater and listeners after fixing a bug
+type Journal interface {
+
+	// Record persists a notification as soon as it's received, before it's processed
+	Record(ctx context.Context, entry JournalEntry) error
+
+	// Finish records how processing the notification with id turned out
+	Finish(ctx context.Context, id string, outcome Outcome) error
+
+	// Replayed counts a replay of the notification with id and records how it turned out,
+	// keeping how the notification was first processed
+	Replayed(ctx context.Context, id string, outcome Outcome) error
+
+	// Entry returns one notification by id
+	Entry(ctx context.Context, id string) (JournalEntry, error)
+
+	// Entries returns notifications received from start until end, oldest first
+	Entries(ctx context.Context, start, end time.Time) ([]JournalEntry, error)
+}
+
+// JournalEntry is a notification as the App Store sent it. V1 bodies include the shared secret
+// as their password, so keep journals as private as the secret.
+type JournalEntry struct {
+	ID         string    `json:"id"`
+	ReceivedAt time.Time `json:"received_at"`
+	Body       []byte    `json:"body,omitempty"`
+
+	Outcome
+
+	// Replays counts how many times the notification was replayed, and LastReplay is how the
+	// latest replay turned out
+	Replays    int      `json:"replays,omitempty"`
+	LastReplay *Outcome `json:"last_replay,omitempty"`
+}
+
+// Latest is how the latest replay turned out, or else how the notification was first processed
+func (entry JournalEntry) Latest() Outcome {
+	if entry.LastReplay != nil {
+		return *entry.LastReplay
+	}
+	return entry.Outcome
+}
+
+// Failed reports whether the latest replay, or else the first processing, wasn't successful
+func (entry JournalEntry) Failed() bool {
+	return entry.Latest().Failed()
+}
+
+// Outcome is the status a notification was responded to with, and the error when it failed.
+// Status is 0 until processing finishes, such as when the server stopped partway.
+type Outcome struct {
+	Status      int       `json:"status,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	ProcessedAt time.Time `json:"processed_at,omitempty"`
+}
+
+func newOutcome(status int, err error) Outcome {
+	outcome := Outcome{Status: status, ProcessedAt: time.Now().UTC()}
+	if err != nil {
+		outcome.Error = err.Error()
+	}
+	return outcome
+}
+
+// Failed reports whether the notification wasn't processed successfully, or hasn't finished
+func (outcome Outcome) Failed() bool {
+	return outcome.Status != http.StatusOK
+}
+
+// newJournalID identifies one delivery of a notification, since retries of a notification are
+// journaled separately
+func newJournalID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return time.Now().UTC().Format("20060102T150405.000000000")
+	}
+	return hex.EncodeToString(id)
+}
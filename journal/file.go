@@ -0,0 +1,156 @@
+package journal
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	ss "github.com/carpenterscode/superscribe"
+)
+
+// File journals notifications as JSON lines appended to a file. Each notification is a line when
+// received, another line with its outcome and one more per replay, which reads merge.
+type File struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+// NewFile journals notifications to path, creating it if needed
+func NewFile(path string) *File {
+	return &File{Path: path}
+}
+
+// Record appends the notification as received
+func (f *File) Record(ctx context.Context, entry ss.JournalEntry) error {
+	return f.append(entry)
+}
+
+// Finish appends the outcome of the notification with id
+func (f *File) Finish(ctx context.Context, id string, outcome ss.Outcome) error {
+	return f.append(ss.JournalEntry{ID: id, Outcome: outcome})
+}
+
+// Replayed appends the outcome of a replay of the notification with id
+func (f *File) Replayed(ctx context.Context, id string, outcome ss.Outcome) error {
+	return f.append(ss.JournalEntry{ID: id, LastReplay: &outcome})
+}
+
+func (f *File) append(entry ss.JournalEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	file, err := os.OpenFile(f.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Entry finds the notification with id
+func (f *File) Entry(ctx context.Context, id string) (ss.JournalEntry, error) {
+	entries, err := f.read()
+	if err != nil {
+		return ss.JournalEntry{}, err
+	}
+
+	for _, entry := range entries {
+		if entry.ID == id {
+			return entry, nil
+		}
+	}
+	return ss.JournalEntry{}, fmt.Errorf("Journal should have had notification %s", id)
+}
+
+// Entries returns the notifications received from start until end
+func (f *File) Entries(ctx context.Context, start, end time.Time) ([]ss.JournalEntry, error) {
+	entries, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+
+	var matched []ss.JournalEntry
+	for _, entry := range entries {
+		if !entry.ReceivedAt.Before(start) && entry.ReceivedAt.Before(end) {
+			matched = append(matched, entry)
+		}
+	}
+	return matched, nil
+}
+
+// read merges every line into one entry per notification, oldest first
+func (f *File) read() ([]ss.JournalEntry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	file, err := os.Open(f.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	byID := make(map[string]*ss.JournalEntry)
+	var entries []*ss.JournalEntry
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var line ss.JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return nil, fmt.Errorf("Journal %s should have had JSON lines: %v", f.Path, err)
+		}
+
+		entry, ok := byID[line.ID]
+		if !ok {
+			entry = &ss.JournalEntry{ID: line.ID}
+			byID[line.ID] = entry
+			entries = append(entries, entry)
+		}
+		if line.Body != nil {
+			entry.ReceivedAt = line.ReceivedAt
+			entry.Body = line.Body
+		}
+		if !line.ProcessedAt.IsZero() {
+			entry.Outcome = line.Outcome
+		}
+		if line.LastReplay != nil {
+			entry.Replays++
+			entry.LastReplay = line.LastReplay
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	result := make([]ss.JournalEntry, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Body != nil {
+			result = append(result, *entry)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].ReceivedAt.Before(result[j].ReceivedAt)
+	})
+	return result, nil
+}
@@ -0,0 +1,75 @@
+package journal
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	ss "github.com/carpenterscode/superscribe"
+)
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var journal ss.Journal = NewFile(filepath.Join(dir, "notifications.jsonl"))
+	ctx := context.Background()
+	start := time.Date(2019, time.March, 6, 0, 0, 0, 0, time.UTC)
+
+	if entries, err := journal.Entries(ctx, start, start.Add(time.Hour)); err != nil ||
+		len(entries) != 0 {
+		t.Error("Should have read an empty journal before the first notification", entries, err)
+	}
+
+	for i, id := range []string{"first", "second", "third"} {
+		entry := ss.JournalEntry{ID: id, ReceivedAt: start.Add(time.Duration(i) * time.Minute),
+			Body: []byte(`{"notification_type": "RENEWAL"}`)}
+		if err := journal.Record(ctx, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	journal.Finish(ctx, "first", ss.Outcome{Status: http.StatusInternalServerError,
+		Error: "Database unavailable", ProcessedAt: start})
+	journal.Finish(ctx, "second", ss.Outcome{Status: http.StatusOK, ProcessedAt: start})
+
+	// Replaying keeps the original outcome
+	journal.Replayed(ctx, "first", ss.Outcome{Status: http.StatusInternalServerError,
+		Error: "Listener unavailable", ProcessedAt: start.Add(time.Hour)})
+	journal.Replayed(ctx, "first", ss.Outcome{Status: http.StatusOK,
+		ProcessedAt: start.Add(2 * time.Hour)})
+
+	first, err := journal.Entry(ctx, "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Failed() || first.Replays != 2 || !first.LastReplay.ProcessedAt.Equal(start.Add(
+		2*time.Hour)) || string(first.Body) != `{"notification_type": "RENEWAL"}` {
+		t.Error("Should have kept the body with the latest replay", first)
+	} else if first.Status != http.StatusInternalServerError ||
+		first.Error != "Database unavailable" {
+
+		t.Error("Should have kept how the notification was first processed", first.Outcome)
+	}
+
+	entries, err := journal.Entries(ctx, start.Add(time.Minute), start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].ID != "second" || entries[1].ID != "third" {
+		t.Fatal("Should have read notifications received within the range", entries)
+	}
+	if entries[0].Failed() || !entries[1].Failed() || entries[1].Status != 0 {
+		t.Error("Should have told unfinished notifications from processed ones", entries)
+	}
+
+	if _, err := journal.Entry(ctx, "unknown"); err == nil {
+		t.Error("Should not have found an unknown notification")
+	}
+}
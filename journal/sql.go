@@ -0,0 +1,140 @@
+package journal
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	ss "github.com/carpenterscode/superscribe"
+)
+
+// SQL journals notifications to a database table, such as
+//
+//	CREATE TABLE superscribe_journal (
+//	    id VARCHAR(64) PRIMARY KEY,
+//	    received_at TIMESTAMP NOT NULL,
+//	    body BYTEA NOT NULL,
+//	    status INTEGER NOT NULL DEFAULT 0,
+//	    error_message TEXT NOT NULL DEFAULT '',
+//	    processed_at TIMESTAMP NULL,
+//	    replays INTEGER NOT NULL DEFAULT 0,
+//	    replay_status INTEGER NOT NULL DEFAULT 0,
+//	    replay_error TEXT NOT NULL DEFAULT '',
+//	    replayed_at TIMESTAMP NULL
+//	)
+//
+// with an index on received_at, and BLOB rather than BYTEA for MySQL.
+type SQL struct {
+	DB *sql.DB
+
+	// RecordQuery inserts id, received_at and body. FinishQuery sets status, error_message and
+	// processed_at of an id, which is the last argument, and ReplayedQuery increments replays
+	// and sets replay_status, replay_error and replayed_at the same way. EntryQuery and
+	// EntriesQuery select the columns in table order by id or by a received_at range.
+	RecordQuery   string
+	FinishQuery   string
+	ReplayedQuery string
+	EntryQuery    string
+	EntriesQuery  string
+}
+
+const journalColumns = "id, received_at, body, status, error_message, processed_at, replays, " +
+	"replay_status, replay_error, replayed_at"
+
+// NewPostgres journals notifications to table with Postgres placeholders
+func NewPostgres(db *sql.DB, table string) *SQL {
+	return &SQL{
+		DB: db,
+		RecordQuery: fmt.Sprintf("INSERT INTO %s (id, received_at, body) VALUES ($1, $2, $3)",
+			table),
+		FinishQuery: fmt.Sprintf("UPDATE %s SET status = $1, error_message = $2, "+
+			"processed_at = $3 WHERE id = $4", table),
+		ReplayedQuery: fmt.Sprintf("UPDATE %s SET replays = replays + 1, replay_status = $1, "+
+			"replay_error = $2, replayed_at = $3 WHERE id = $4", table),
+		EntryQuery: fmt.Sprintf("SELECT %s FROM %s WHERE id = $1", journalColumns, table),
+		EntriesQuery: fmt.Sprintf("SELECT %s FROM %s WHERE received_at >= $1 AND "+
+			"received_at < $2 ORDER BY received_at", journalColumns, table),
+	}
+}
+
+// NewMySQL journals notifications to table with MySQL placeholders
+func NewMySQL(db *sql.DB, table string) *SQL {
+	return &SQL{
+		DB:          db,
+		RecordQuery: fmt.Sprintf("INSERT INTO %s (id, received_at, body) VALUES (?, ?, ?)", table),
+		FinishQuery: fmt.Sprintf("UPDATE %s SET status = ?, error_message = ?, "+
+			"processed_at = ? WHERE id = ?", table),
+		ReplayedQuery: fmt.Sprintf("UPDATE %s SET replays = replays + 1, replay_status = ?, "+
+			"replay_error = ?, replayed_at = ? WHERE id = ?", table),
+		EntryQuery: fmt.Sprintf("SELECT %s FROM %s WHERE id = ?", journalColumns, table),
+		EntriesQuery: fmt.Sprintf("SELECT %s FROM %s WHERE received_at >= ? AND "+
+			"received_at < ? ORDER BY received_at", journalColumns, table),
+	}
+}
+
+// Record inserts the notification as received
+func (j *SQL) Record(ctx context.Context, entry ss.JournalEntry) error {
+	_, err := j.DB.ExecContext(ctx, j.RecordQuery, entry.ID, entry.ReceivedAt.UTC(), entry.Body)
+	return err
+}
+
+// Finish updates the outcome of the notification with id
+func (j *SQL) Finish(ctx context.Context, id string, outcome ss.Outcome) error {
+	_, err := j.DB.ExecContext(ctx, j.FinishQuery, outcome.Status, outcome.Error,
+		outcome.ProcessedAt.UTC(), id)
+	return err
+}
+
+// Replayed counts a replay of the notification with id and updates its outcome
+func (j *SQL) Replayed(ctx context.Context, id string, outcome ss.Outcome) error {
+	_, err := j.DB.ExecContext(ctx, j.ReplayedQuery, outcome.Status, outcome.Error,
+		outcome.ProcessedAt.UTC(), id)
+	return err
+}
+
+// Entry selects the notification with id
+func (j *SQL) Entry(ctx context.Context, id string) (ss.JournalEntry, error) {
+	return scanEntry(j.DB.QueryRowContext(ctx, j.EntryQuery, id))
+}
+
+// Entries selects the notifications received from start until end
+func (j *SQL) Entries(ctx context.Context, start, end time.Time) ([]ss.JournalEntry, error) {
+	rows, err := j.DB.QueryContext(ctx, j.EntriesQuery, start.UTC(), end.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []ss.JournalEntry
+	for rows.Next() {
+		entry, err := scanEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanEntry(row scanner) (ss.JournalEntry, error) {
+	var entry ss.JournalEntry
+	var replay ss.Outcome
+	var processedAt, replayedAt *time.Time
+	if err := row.Scan(&entry.ID, &entry.ReceivedAt, &entry.Body, &entry.Status, &entry.Error,
+		&processedAt, &entry.Replays, &replay.Status, &replay.Error, &replayedAt); err != nil {
+		return entry, err
+	}
+	if processedAt != nil {
+		entry.ProcessedAt = *processedAt
+	}
+	if replayedAt != nil {
+		replay.ProcessedAt = *replayedAt
+		entry.LastReplay = &replay
+	}
+	return entry, nil
+}
@@ -0,0 +1,219 @@
+package journal
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	ss "github.com/carpenterscode/superscribe"
+	"github.com/carpenterscode/superscribe/internal/fakedb"
+)
+
+// statements are the queries a dialect should send for superscribe_journal
+type statements struct {
+	record, finish, replayed, entry, entries string
+}
+
+var (
+	postgresStatements = statements{
+		record: "INSERT INTO superscribe_journal (id, received_at, body) VALUES ($1, $2, $3)",
+		finish: "UPDATE superscribe_journal SET status = $1, error_message = $2, " +
+			"processed_at = $3 WHERE id = $4",
+		replayed: "UPDATE superscribe_journal SET replays = replays + 1, replay_status = $1, " +
+			"replay_error = $2, replayed_at = $3 WHERE id = $4",
+		entry: "SELECT " + journalColumns + " FROM superscribe_journal WHERE id = $1",
+		entries: "SELECT " + journalColumns + " FROM superscribe_journal WHERE " +
+			"received_at >= $1 AND received_at < $2 ORDER BY received_at",
+	}
+	mySQLStatements = statements{
+		record: "INSERT INTO superscribe_journal (id, received_at, body) VALUES (?, ?, ?)",
+		finish: "UPDATE superscribe_journal SET status = ?, error_message = ?, " +
+			"processed_at = ? WHERE id = ?",
+		replayed: "UPDATE superscribe_journal SET replays = replays + 1, replay_status = ?, " +
+			"replay_error = ?, replayed_at = ? WHERE id = ?",
+		entry: "SELECT " + journalColumns + " FROM superscribe_journal WHERE id = ?",
+		entries: "SELECT " + journalColumns + " FROM superscribe_journal WHERE " +
+			"received_at >= ? AND received_at < ? ORDER BY received_at",
+	}
+)
+
+// fakeTable keeps rows of journal columns in the order they were inserted, and executes only the
+// statements of one dialect, checking their arguments
+type fakeTable struct {
+	fakedb.DB
+
+	t          *testing.T
+	statements statements
+	rows       [][]driver.Value
+}
+
+func newFakeTable(t *testing.T, statements statements) *fakeTable {
+	table := &fakeTable{t: t, statements: statements}
+	table.Exec = table.exec
+	table.Query = table.query
+	return table
+}
+
+// row finds the row with id
+func (table *fakeTable) row(id driver.Value) []driver.Value {
+	for _, row := range table.rows {
+		if row[0] == id {
+			return row
+		}
+	}
+	return nil
+}
+
+func (table *fakeTable) exec(conn *fakedb.Conn, query string,
+	values []driver.Value) (driver.Result, error) {
+
+	switch query {
+	case table.statements.record:
+		if !hasTypes(values, "", time.Time{}, []byte{}) || !isUTC(values[1]) {
+			table.t.Fatal("Should have recorded id, UTC received_at and body", values)
+		}
+		table.rows = append(table.rows, []driver.Value{values[0], values[1], values[2],
+			int64(0), "", nil, int64(0), int64(0), "", nil})
+
+	case table.statements.finish, table.statements.replayed:
+		if !hasTypes(values, int64(0), "", time.Time{}, "") || !isUTC(values[2]) {
+			table.t.Fatal("Should have set status, error, UTC time and then id", values)
+		}
+		row := table.row(values[3])
+		if row == nil {
+			return driver.RowsAffected(0), nil
+		}
+		if query == table.statements.finish {
+			copy(row[3:6], values[:3])
+		} else {
+			row[6] = row[6].(int64) + 1
+			copy(row[7:10], values[:3])
+		}
+
+	default:
+		table.t.Fatal("Should have executed a known statement", query)
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (table *fakeTable) query(conn *fakedb.Conn, query string,
+	values []driver.Value) ([][]driver.Value, error) {
+
+	var rows [][]driver.Value
+	switch query {
+	case table.statements.entry:
+		if !hasTypes(values, "") {
+			table.t.Fatal("Should have selected by id", values)
+		}
+		if row := table.row(values[0]); row != nil {
+			rows = append(rows, row)
+		}
+
+	case table.statements.entries:
+		if !hasTypes(values, time.Time{}, time.Time{}) {
+			table.t.Fatal("Should have selected by a received_at range", values)
+		}
+		start, end := values[0].(time.Time), values[1].(time.Time)
+		for _, row := range table.rows {
+			receivedAt := row[1].(time.Time)
+			if !receivedAt.Before(start) && receivedAt.Before(end) {
+				rows = append(rows, row)
+			}
+		}
+
+	default:
+		table.t.Fatal("Should have queried a known statement", query)
+	}
+	return rows, nil
+}
+
+// hasTypes reports whether values are of the same types as examples, in order
+func hasTypes(values []driver.Value, examples ...interface{}) bool {
+	if len(values) != len(examples) {
+		return false
+	}
+	for i, example := range examples {
+		if reflect.TypeOf(values[i]) != reflect.TypeOf(example) {
+			return false
+		}
+	}
+	return true
+}
+
+func isUTC(value driver.Value) bool {
+	t, ok := value.(time.Time)
+	return ok && t.Location() == time.UTC
+}
+
+func TestSQL(t *testing.T) {
+	dialects := []struct {
+		newSQL     func(*sql.DB, string) *SQL
+		statements statements
+	}{
+		{NewPostgres, postgresStatements},
+		{NewMySQL, mySQLStatements},
+	}
+
+	// Times are converted to UTC before they're written
+	pacific := time.FixedZone("PST", -8*60*60)
+	start := time.Date(2019, time.March, 5, 16, 0, 0, 0, pacific)
+
+	for _, dialect := range dialects {
+		db := sql.OpenDB(newFakeTable(t, dialect.statements))
+		defer db.Close()
+
+		var journal ss.Journal = dialect.newSQL(db, "superscribe_journal")
+		ctx := context.Background()
+
+		for i, id := range []string{"first", "second", "third"} {
+			entry := ss.JournalEntry{ID: id, ReceivedAt: start.Add(time.Duration(i) * time.Minute),
+				Body: []byte(`{"notification_type": "RENEWAL"}`)}
+			if err := journal.Record(ctx, entry); err != nil {
+				t.Fatal(err)
+			}
+		}
+		journal.Finish(ctx, "first", ss.Outcome{Status: http.StatusInternalServerError,
+			Error: "Database unavailable", ProcessedAt: start})
+		journal.Finish(ctx, "second", ss.Outcome{Status: http.StatusOK, ProcessedAt: start})
+		journal.Replayed(ctx, "first", ss.Outcome{Status: http.StatusOK,
+			ProcessedAt: start.Add(time.Hour)})
+
+		first, err := journal.Entry(ctx, "first")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first.Status != http.StatusInternalServerError ||
+			first.Error != "Database unavailable" || !first.ProcessedAt.Equal(start) {
+
+			t.Error("Should have scanned how the notification was first processed", first.Outcome)
+		}
+		if first.Failed() || first.Replays != 1 ||
+			!first.LastReplay.ProcessedAt.Equal(start.Add(time.Hour)) ||
+			string(first.Body) != `{"notification_type": "RENEWAL"}` {
+
+			t.Error("Should have scanned the body with the latest replay", first)
+		}
+
+		entries, err := journal.Entries(ctx, start.Add(time.Minute), start.Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 2 || entries[0].ID != "second" || entries[1].ID != "third" {
+			t.Fatal("Should have selected notifications received within the range", entries)
+		}
+		if entries[0].Failed() || entries[0].LastReplay != nil {
+			t.Error("Should have scanned a notification that wasn't replayed", entries[0])
+		}
+		if third := entries[1]; !third.Failed() || !third.ProcessedAt.IsZero() {
+			t.Error("Should have scanned a null processed_at as unfinished", third)
+		}
+
+		if _, err := journal.Entry(ctx, "unknown"); err != sql.ErrNoRows {
+			t.Error("Should not have found an unknown notification", err)
+		}
+	}
+}
@@ -65,3 +65,111 @@ func (multi MultiEventListener) StartedTrial(evt StartTrialEvent) error {
 	}
 	return nil
 }
+
+func (multi MultiEventListener) Expired(evt ExpireEvent) error {
+	for _, l := range multi.listeners {
+		if err := l.Expired(evt); err != nil {
+			log.Printf("%s listener Expired error: %v\n", l.Name(), err)
+		}
+	}
+	return nil
+}
+
+func (multi MultiEventListener) EnteredBillingRetry(evt BillingRetryEvent) error {
+	for _, l := range multi.listeners {
+		if err := l.EnteredBillingRetry(evt); err != nil {
+			log.Printf("%s listener EnteredBillingRetry error: %v\n", l.Name(), err)
+		}
+	}
+	return nil
+}
+
+func (multi MultiEventListener) EnteredGracePeriod(evt BillingRetryEvent) error {
+	for _, l := range multi.listeners {
+		if err := l.EnteredGracePeriod(evt); err != nil {
+			log.Printf("%s listener EnteredGracePeriod error: %v\n", l.Name(), err)
+		}
+	}
+	return nil
+}
+
+func (multi MultiEventListener) StillInGracePeriod(evt BillingRetryEvent) error {
+	for _, l := range multi.listeners {
+		if err := l.StillInGracePeriod(evt); err != nil {
+			log.Printf("%s listener StillInGracePeriod error: %v\n", l.Name(), err)
+		}
+	}
+	return nil
+}
+
+func (multi MultiEventListener) ExitedGracePeriod(evt BillingRetryEvent) error {
+	for _, l := range multi.listeners {
+		if err := l.ExitedGracePeriod(evt); err != nil {
+			log.Printf("%s listener ExitedGracePeriod error: %v\n", l.Name(), err)
+		}
+	}
+	return nil
+}
+
+func (multi MultiEventListener) Upgraded(evt ProductChangeEvent) error {
+	for _, l := range multi.listeners {
+		if err := l.Upgraded(evt); err != nil {
+			log.Printf("%s listener Upgraded error: %v\n", l.Name(), err)
+		}
+	}
+	return nil
+}
+
+func (multi MultiEventListener) Downgraded(evt ProductChangeEvent) error {
+	for _, l := range multi.listeners {
+		if err := l.Downgraded(evt); err != nil {
+			log.Printf("%s listener Downgraded error: %v\n", l.Name(), err)
+		}
+	}
+	return nil
+}
+
+func (multi MultiEventListener) Crossgraded(evt ProductChangeEvent) error {
+	for _, l := range multi.listeners {
+		if err := l.Crossgraded(evt); err != nil {
+			log.Printf("%s listener Crossgraded error: %v\n", l.Name(), err)
+		}
+	}
+	return nil
+}
+
+func (multi MultiEventListener) RecoveredFromBillingRetry(evt PayEvent) error {
+	for _, l := range multi.listeners {
+		if err := l.RecoveredFromBillingRetry(evt); err != nil {
+			log.Printf("%s listener RecoveredFromBillingRetry error: %v\n", l.Name(), err)
+		}
+	}
+	return nil
+}
+
+func (multi MultiEventListener) PriceIncreaseConsentRequested(evt PriceIncreaseEvent) error {
+	for _, l := range multi.listeners {
+		if err := l.PriceIncreaseConsentRequested(evt); err != nil {
+			log.Printf("%s listener PriceIncreaseConsentRequested error: %v\n", l.Name(), err)
+		}
+	}
+	return nil
+}
+
+func (multi MultiEventListener) PriceIncreaseAccepted(evt PriceIncreaseEvent) error {
+	for _, l := range multi.listeners {
+		if err := l.PriceIncreaseAccepted(evt); err != nil {
+			log.Printf("%s listener PriceIncreaseAccepted error: %v\n", l.Name(), err)
+		}
+	}
+	return nil
+}
+
+func (multi MultiEventListener) PriceIncreaseDeclined(evt PriceIncreaseEvent) error {
+	for _, l := range multi.listeners {
+		if err := l.PriceIncreaseDeclined(evt); err != nil {
+			log.Printf("%s listener PriceIncreaseDeclined error: %v\n", l.Name(), err)
+		}
+	}
+	return nil
+}
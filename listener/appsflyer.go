@@ -2,24 +2,55 @@ package listener
 
 import (
 	"fmt"
+	"strconv"
 
 	af "github.com/carpenterscode/appsflyer-go"
 	ss "github.com/carpenterscode/superscribe"
+	"github.com/carpenterscode/superscribe/receipt"
 )
 
 const (
-	CancelSubscription  af.EventName = "cancel_subscription"
-	CancelTrial         af.EventName = "cancel_trial"
-	ChangeRenewalPref   af.EventName = "change_renewal_pref"
-	RestartSubscription af.EventName = "restart_subscription"
+	BillingGracePeriod     af.EventName = "billing_grace_period"
+	BillingGraceExpired    af.EventName = "billing_grace_period_expired"
+	BillingRecovery        af.EventName = "billing_recovery"
+	BillingRetry           af.EventName = "billing_retry"
+	CancelSubscription     af.EventName = "cancel_subscription"
+	CancelTrial            af.EventName = "cancel_trial"
+	ChangeRenewalPref      af.EventName = "change_renewal_pref"
+	CrossgradeSubscription af.EventName = "crossgrade_subscription"
+	DowngradeSubscription  af.EventName = "downgrade_subscription"
+	ExpireSubscription     af.EventName = "expire_subscription"
+	ExpireTrial            af.EventName = "expire_trial"
+	PriceIncreaseAccept    af.EventName = "price_increase_accepted"
+	PriceIncreaseConsent   af.EventName = "price_increase_consent_requested"
+	PriceIncreaseDecline   af.EventName = "price_increase_declined"
+	RestartSubscription    af.EventName = "restart_subscription"
+	UpgradeSubscription    af.EventName = "upgrade_subscription"
 )
 
 const (
-	ParamExpirationDate af.EventParam = "expiration_date"
+	ParamExpirationDate   af.EventParam = "expiration_date"
+	ParamExpirationIntent af.EventParam = "expiration_intent"
+	ParamNewPrice         af.EventParam = "new_price"
+	ParamOfferType        af.EventParam = "offer_type"
+	ParamOfferID          af.EventParam = "offer_id"
+	ParamOfferDiscount    af.EventParam = "offer_discount_type"
+	ParamPaymentKind      af.EventParam = "payment_kind"
+	ParamPreviousPrice    af.EventParam = "previous_price"
+	ParamPreviousProduct  af.EventParam = "previous_product_id"
+	ParamProduct          af.EventParam = "product_id"
+	ParamProceeds         af.EventParam = "net_proceeds"
+	ParamRenewalCount     af.EventParam = "renewal_count"
 )
 
 const appsflyerKey = "appsflyer_id"
 
+var offerTypeNames = map[int]string{
+	receipt.OfferTypeIntroductory: "introductory",
+	receipt.OfferTypePromotional:  "promotional",
+	receipt.OfferTypeOfferCode:    "offer_code",
+}
+
 type AppsFlyer struct {
 	Tracker *af.Tracker
 }
@@ -41,6 +72,21 @@ func (l AppsFlyer) setup(user ss.User, configure func(*af.Event)) error {
 	return l.Tracker.Send(afEvent)
 }
 
+// setOffer attributes the event to the offer in effect, such as an offer code campaign
+func setOffer(afEvent *af.Event, offer ss.Offer) {
+	name, ok := offerTypeNames[offer.OfferType()]
+	if !ok {
+		return
+	}
+	afEvent.SetValue(ParamOfferType, name)
+	if offer.OfferIdentifier() != "" {
+		afEvent.SetValue(ParamOfferID, offer.OfferIdentifier())
+	}
+	if offer.OfferDiscountType() != "" {
+		afEvent.SetValue(ParamOfferDiscount, offer.OfferDiscountType())
+	}
+}
+
 func (l AppsFlyer) Name() string {
 	return "AppsFlyer"
 }
@@ -68,6 +114,12 @@ func (l AppsFlyer) Paid(evt ss.PayEvent) error {
 		afEvent.SetEventTime(evt.PaidAt())
 		afEvent.SetName(af.Subscribe)
 		afEvent.SetRevenue(evt.Price(), evt.Currency())
+		afEvent.SetValue(ParamPaymentKind, string(evt.PaymentKind()))
+		afEvent.SetValue(ParamProceeds, strconv.FormatFloat(evt.Proceeds(), 'f', 2, 64))
+		if evt.RenewalCount() >= 0 {
+			afEvent.SetValue(ParamRenewalCount, strconv.Itoa(evt.RenewalCount()))
+		}
+		setOffer(afEvent, evt)
 	})
 }
 
@@ -87,5 +139,105 @@ func (l AppsFlyer) StartedTrial(evt ss.StartTrialEvent) error {
 		afEvent.SetEventTime(evt.StartedTrialAt())
 		afEvent.SetName(af.StartTrial)
 		afEvent.SetPrice(evt.Price(), evt.Currency())
+		setOffer(afEvent, evt)
+	})
+}
+
+func (l AppsFlyer) Expired(evt ss.ExpireEvent) error {
+	return l.setup(evt, func(afEvent *af.Event) {
+		if evt.IsTrialPeriod() {
+			afEvent.SetName(ExpireTrial)
+		} else {
+			afEvent.SetName(ExpireSubscription)
+		}
+		afEvent.SetEventTime(evt.ExpiredAt())
+		afEvent.SetValue(ParamExpirationIntent, strconv.Itoa(evt.ExpirationIntent()))
+	})
+}
+
+func (l AppsFlyer) EnteredBillingRetry(evt ss.BillingRetryEvent) error {
+	return l.setup(evt, func(afEvent *af.Event) {
+		afEvent.SetEventTime(evt.EnteredBillingRetryAt())
+		afEvent.SetName(BillingRetry)
+	})
+}
+
+func (l AppsFlyer) EnteredGracePeriod(evt ss.BillingRetryEvent) error {
+	return l.setup(evt, func(afEvent *af.Event) {
+		afEvent.SetEventTime(evt.EnteredBillingRetryAt())
+		afEvent.SetName(BillingGracePeriod)
+		afEvent.SetDateValue(ParamExpirationDate, evt.GracePeriodExpiresAt())
+	})
+}
+
+// StillInGracePeriod isn't attributed, since EnteredGracePeriod already was
+func (l AppsFlyer) StillInGracePeriod(evt ss.BillingRetryEvent) error {
+	return nil
+}
+
+func (l AppsFlyer) ExitedGracePeriod(evt ss.BillingRetryEvent) error {
+	return l.setup(evt, func(afEvent *af.Event) {
+		afEvent.SetEventTime(evt.GracePeriodExpiresAt())
+		afEvent.SetName(BillingGraceExpired)
 	})
 }
+
+func (l AppsFlyer) RecoveredFromBillingRetry(evt ss.PayEvent) error {
+	return l.setup(evt, func(afEvent *af.Event) {
+		afEvent.SetEventTime(evt.PaidAt())
+		afEvent.SetName(BillingRecovery)
+	})
+}
+
+// changeProduct reports the product changed to, which only replaces ProductID once the change
+// takes effect
+func (l AppsFlyer) changeProduct(evt ss.ProductChangeEvent, name af.EventName) error {
+	return l.setup(evt, func(afEvent *af.Event) {
+		afEvent.SetEventTime(evt.ProductChangedAt())
+		afEvent.SetName(name)
+		if evt.PreviousProductID() != "" {
+			afEvent.SetValue(ParamPreviousProduct, evt.PreviousProductID())
+		}
+		if evt.IsProductChangeImmediate() {
+			afEvent.SetValue(ParamProduct, evt.ProductID())
+		} else {
+			afEvent.SetValue(ParamProduct, evt.AutoRenewProduct())
+		}
+	})
+}
+
+func (l AppsFlyer) Upgraded(evt ss.ProductChangeEvent) error {
+	return l.changeProduct(evt, UpgradeSubscription)
+}
+
+func (l AppsFlyer) Downgraded(evt ss.ProductChangeEvent) error {
+	return l.changeProduct(evt, DowngradeSubscription)
+}
+
+func (l AppsFlyer) Crossgraded(evt ss.ProductChangeEvent) error {
+	return l.changeProduct(evt, CrossgradeSubscription)
+}
+
+// changePrice reports a response to a price increase, with the new price as revenue
+func (l AppsFlyer) changePrice(evt ss.PriceIncreaseEvent, name af.EventName) error {
+	return l.setup(evt, func(afEvent *af.Event) {
+		afEvent.SetEventTime(evt.PriceConsentChangedAt())
+		afEvent.SetName(name)
+		afEvent.SetPrice(evt.NewPrice(), evt.Currency())
+		afEvent.SetValue(ParamProduct, evt.AutoRenewProduct())
+		afEvent.SetValue(ParamPreviousPrice, strconv.FormatFloat(evt.PreviousPrice(), 'f', 2, 64))
+		afEvent.SetValue(ParamNewPrice, strconv.FormatFloat(evt.NewPrice(), 'f', 2, 64))
+	})
+}
+
+func (l AppsFlyer) PriceIncreaseConsentRequested(evt ss.PriceIncreaseEvent) error {
+	return l.changePrice(evt, PriceIncreaseConsent)
+}
+
+func (l AppsFlyer) PriceIncreaseAccepted(evt ss.PriceIncreaseEvent) error {
+	return l.changePrice(evt, PriceIncreaseAccept)
+}
+
+func (l AppsFlyer) PriceIncreaseDeclined(evt ss.PriceIncreaseEvent) error {
+	return l.changePrice(evt, PriceIncreaseDecline)
+}
@@ -13,7 +13,8 @@ func (l Stub) Name() string {
 }
 
 func (l Stub) Paid(evt ss.PayEvent) error {
-	log.Println("Paid", evt.PaidAt(), evt.ExpiresAt())
+	log.Println("Paid", evt.PaymentKind(), evt.RenewalCount(), evt.Proceeds(), evt.PaidAt(),
+		evt.ExpiresAt(), evt.OfferType(), evt.OfferIdentifier(), evt.OfferDiscountType())
 	return nil
 }
 
@@ -33,6 +34,69 @@ func (l Stub) Refunded(evt ss.RefundEvent) error {
 }
 
 func (l Stub) StartedTrial(evt ss.StartTrialEvent) error {
-	log.Println("StartTrial", evt.StartedTrialAt())
+	log.Println("StartTrial", evt.StartedTrialAt(), evt.OfferType(), evt.OfferIdentifier())
+	return nil
+}
+
+func (l Stub) Expired(evt ss.ExpireEvent) error {
+	log.Println("Expired", evt.ExpiredAt(), evt.ExpirationIntent())
+	return nil
+}
+
+func (l Stub) EnteredBillingRetry(evt ss.BillingRetryEvent) error {
+	log.Println("EnteredBillingRetry", evt.EnteredBillingRetryAt())
+	return nil
+}
+
+func (l Stub) EnteredGracePeriod(evt ss.BillingRetryEvent) error {
+	log.Println("EnteredGracePeriod", evt.EnteredBillingRetryAt(), evt.GracePeriodExpiresAt())
+	return nil
+}
+
+func (l Stub) StillInGracePeriod(evt ss.BillingRetryEvent) error {
+	log.Println("StillInGracePeriod", evt.AccessExpiresAt())
+	return nil
+}
+
+func (l Stub) ExitedGracePeriod(evt ss.BillingRetryEvent) error {
+	log.Println("ExitedGracePeriod", evt.GracePeriodExpiresAt())
+	return nil
+}
+
+func (l Stub) RecoveredFromBillingRetry(evt ss.PayEvent) error {
+	log.Println("RecoveredFromBillingRetry", evt.PaidAt())
+	return nil
+}
+
+func (l Stub) Upgraded(evt ss.ProductChangeEvent) error {
+	log.Println("Upgraded", evt.PreviousProductID(), evt.ProductID(), evt.ProductChangedAt())
+	return nil
+}
+
+func (l Stub) Downgraded(evt ss.ProductChangeEvent) error {
+	log.Println("Downgraded", evt.PreviousProductID(), evt.AutoRenewProduct(),
+		evt.IsProductChangeImmediate())
+	return nil
+}
+
+func (l Stub) Crossgraded(evt ss.ProductChangeEvent) error {
+	log.Println("Crossgraded", evt.PreviousProductID(), evt.AutoRenewProduct(),
+		evt.IsProductChangeImmediate())
+	return nil
+}
+
+func (l Stub) PriceIncreaseConsentRequested(evt ss.PriceIncreaseEvent) error {
+	log.Println("PriceIncreaseConsentRequested", evt.PreviousPrice(), evt.NewPrice(),
+		evt.Currency())
+	return nil
+}
+
+func (l Stub) PriceIncreaseAccepted(evt ss.PriceIncreaseEvent) error {
+	log.Println("PriceIncreaseAccepted", evt.NewPrice(), evt.PriceConsentChangedAt())
+	return nil
+}
+
+func (l Stub) PriceIncreaseDeclined(evt ss.PriceIncreaseEvent) error {
+	log.Println("PriceIncreaseDeclined", evt.NewPrice(), evt.PriceConsentChangedAt())
 	return nil
 }
@@ -0,0 +1,43 @@
+package locker
+
+import (
+	"sync"
+
+	ss "github.com/carpenterscode/superscribe"
+)
+
+// Election elects one leader among servers running in the same process, such as in tests or
+// when one binary serves several apps.
+type Election struct {
+	mu     sync.Mutex
+	leader *member
+}
+
+// Join returns the Locker for one server to campaign with
+func (e *Election) Join() ss.Locker {
+	return &member{election: e}
+}
+
+type member struct {
+	election *Election
+}
+
+func (m *member) Lock() (bool, error) {
+	m.election.mu.Lock()
+	defer m.election.mu.Unlock()
+
+	if m.election.leader == nil {
+		m.election.leader = m
+	}
+	return m.election.leader == m, nil
+}
+
+func (m *member) Unlock() error {
+	m.election.mu.Lock()
+	defer m.election.mu.Unlock()
+
+	if m.election.leader == m {
+		m.election.leader = nil
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+package locker
+
+import (
+	"testing"
+)
+
+func TestElection(t *testing.T) {
+	var election Election
+	first, second := election.Join(), election.Join()
+
+	if leader, _ := first.Lock(); !leader {
+		t.Error("Should have elected the first candidate")
+	}
+	if leader, _ := first.Lock(); !leader {
+		t.Error("Should have kept the first candidate as leader")
+	}
+	if leader, _ := second.Lock(); leader {
+		t.Error("Should not have elected a second leader")
+	}
+
+	first.Unlock()
+	if leader, _ := second.Lock(); !leader {
+		t.Error("Should have elected the second candidate after the first resigned")
+	}
+}
@@ -0,0 +1,99 @@
+package locker
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+)
+
+// SQL elects a leader with a database advisory lock. Advisory locks belong to a database session,
+// so the leader keeps one connection out of the pool for as long as it leads, and leadership
+// passes to another instance if that connection drops.
+type SQL struct {
+	DB *sql.DB
+
+	// Key identifies the lock, which every instance must share
+	Key interface{}
+
+	// LockQuery tries to take the lock without waiting and selects whether it did. UnlockQuery
+	// releases it. Both take Key as their only argument.
+	LockQuery   string
+	UnlockQuery string
+
+	mu   sync.Mutex
+	conn *sql.Conn
+}
+
+// NewPostgres elects a leader with pg_try_advisory_lock
+func NewPostgres(db *sql.DB, key int64) *SQL {
+	return &SQL{
+		DB:          db,
+		Key:         key,
+		LockQuery:   "SELECT pg_try_advisory_lock($1)",
+		UnlockQuery: "SELECT pg_advisory_unlock($1)",
+	}
+}
+
+// NewMySQL elects a leader with GET_LOCK
+func NewMySQL(db *sql.DB, name string) *SQL {
+	return &SQL{
+		DB:          db,
+		Key:         name,
+		LockQuery:   "SELECT COALESCE(GET_LOCK(?, 0), 0)",
+		UnlockQuery: "SELECT RELEASE_LOCK(?)",
+	}
+}
+
+// Lock takes the advisory lock, or confirms this instance still holds it
+func (l *SQL) Lock() (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ctx := context.Background()
+
+	if l.conn != nil {
+		if err := l.conn.PingContext(ctx); err == nil {
+			return true, nil
+		}
+
+		// The session and its lock are gone, so campaign again on a new connection
+		l.conn.Close()
+		l.conn = nil
+	}
+
+	conn, err := l.DB.Conn(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	var locked bool
+	if err := conn.QueryRowContext(ctx, l.LockQuery, l.Key).Scan(&locked); err != nil {
+		conn.Close()
+		return false, err
+	}
+
+	if !locked {
+		conn.Close()
+		return false, nil
+	}
+
+	l.conn = conn
+	return true, nil
+}
+
+// Unlock releases the advisory lock and returns its connection to the pool
+func (l *SQL) Unlock() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conn == nil {
+		return nil
+	}
+
+	var released sql.NullBool
+	err := l.conn.QueryRowContext(context.Background(), l.UnlockQuery, l.Key).Scan(&released)
+
+	l.conn.Close()
+	l.conn = nil
+	return err
+}
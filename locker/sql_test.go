@@ -0,0 +1,132 @@
+package locker
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"testing"
+
+	"github.com/carpenterscode/superscribe/internal/fakedb"
+)
+
+// fakeLock is one advisory lock, which ends with the session that took it
+type fakeLock struct {
+	fakedb.DB
+
+	holder  *fakedb.Conn
+	queries []string
+	args    [][]driver.Value
+}
+
+func newFakeLock() *fakeLock {
+	lock := &fakeLock{}
+	lock.Query = lock.query
+	lock.OnClose = func(conn *fakedb.Conn) {
+		if lock.holder == conn {
+			lock.holder = nil
+		}
+	}
+	return lock
+}
+
+// query takes or releases the lock for the Postgres and MySQL queries, selecting whether it did
+func (lock *fakeLock) query(conn *fakedb.Conn, query string,
+	args []driver.Value) ([][]driver.Value, error) {
+
+	lock.queries = append(lock.queries, query)
+	lock.args = append(lock.args, args)
+
+	var ok bool
+	switch query {
+	case "SELECT pg_try_advisory_lock($1)", "SELECT COALESCE(GET_LOCK(?, 0), 0)":
+		ok = lock.holder == nil || lock.holder == conn
+		if ok {
+			lock.holder = conn
+		}
+	case "SELECT pg_advisory_unlock($1)", "SELECT RELEASE_LOCK(?)":
+		ok = lock.holder == conn
+		if ok {
+			lock.holder = nil
+		}
+	}
+	return [][]driver.Value{{ok}}, nil
+}
+
+// drop breaks the connection holding the lock as if its database session had ended
+func (lock *fakeLock) drop() *fakedb.Conn {
+	lock.Lock()
+	defer lock.Unlock()
+
+	conn := lock.holder
+	conn.Broken = true
+	lock.holder = nil
+	return conn
+}
+
+func TestSQL(t *testing.T) {
+	lock := newFakeLock()
+	db := sql.OpenDB(lock)
+	defer db.Close()
+
+	leader, follower := NewPostgres(db, 0x5375706572), NewPostgres(db, 0x5375706572)
+
+	if locked, err := leader.Lock(); !locked || err != nil {
+		t.Fatal("Should have taken the lock", err)
+	}
+	if locked, err := follower.Lock(); locked || err != nil {
+		t.Error("Should not have taken the lock another session holds", err)
+	}
+	if locked, _ := leader.Lock(); !locked || len(lock.queries) != 2 {
+		t.Error("Should have kept the lock by pinging the held connection", lock.queries)
+	}
+
+	for i, args := range lock.args {
+		if len(args) != 1 || args[0] != int64(0x5375706572) {
+			t.Errorf("Query %d should have taken the key as its only argument, got %v", i, args)
+		}
+	}
+
+	if err := leader.Unlock(); err != nil {
+		t.Error(err)
+	} else if lock.queries[len(lock.queries)-1] != leader.UnlockQuery || lock.holder != nil {
+		t.Error("Should have released the lock", lock.queries)
+	} else if leader.conn != nil {
+		t.Error("Should have returned the connection to the pool")
+	}
+	if locked, _ := follower.Lock(); !locked {
+		t.Error("Should have taken the lock after the leader released it")
+	}
+}
+
+func TestSQLBrokenConnection(t *testing.T) {
+	lock := newFakeLock()
+	db := sql.OpenDB(lock)
+	defer db.Close()
+
+	leader, follower := NewMySQL(db, "superscribe"), NewMySQL(db, "superscribe")
+	if locked, _ := leader.Lock(); !locked {
+		t.Fatal("Should have taken the lock")
+	}
+
+	// The session ends, and with it the lock
+	held := lock.drop()
+
+	if locked, _ := follower.Lock(); !locked {
+		t.Fatal("Should have taken the lock after the leader's session ended")
+	}
+	if locked, err := leader.Lock(); locked || err != nil {
+		t.Error("Should have campaigned again on a new connection and lost", err)
+	} else if !held.Closed || leader.conn != nil {
+		t.Error("Should have closed the broken connection instead of keeping it")
+	}
+
+	// Unlocking a broken connection still gives it up
+	lock.drop()
+	if err := follower.Unlock(); err == nil {
+		t.Error("Should have returned the error releasing a lost lock")
+	} else if follower.conn != nil {
+		t.Error("Should have given up the broken connection")
+	}
+	if locked, _ := leader.Lock(); !locked {
+		t.Error("Should have taken the lock once no session held it")
+	}
+}
@@ -1,6 +1,8 @@
 package superscribe
 
 import (
+	"sort"
+	"strconv"
 	"time"
 
 	"github.com/carpenterscode/superscribe/receipt"
@@ -24,28 +26,134 @@ type Notification struct {
 	AutoRenewAdamID          string             `json:"auto_renew_adam_id"`
 	AutoRenewProductID       string             `json:"auto_renew_product_id"`
 	ExpirationIntent         string             `json:"expiration_intent"`
+
+	UnifiedReceipt *UnifiedReceipt `json:"unified_receipt,omitempty"`
+}
+
+// UnifiedReceipt replaced the top-level receipt fields of notifications in 2019, and mirrors
+// the verifyReceipt response
+type UnifiedReceipt struct {
+	Env                Env                       `json:"environment"`
+	LatestReceipt      string                    `json:"latest_receipt"`
+	LatestReceiptInfo  []receipt.ReceiptInfoBody `json:"latest_receipt_info"`
+	PendingRenewalInfo []receipt.RenewalInfoBody `json:"pending_renewal_info"`
+	Status             int                       `json:"status"`
 }
 
 type notification struct {
 	body Notification
 }
 
+// newNotification sorts the unified receipt's history oldest first, once, for the accessors
+func newNotification(body Notification) notification {
+	if body.UnifiedReceipt != nil {
+		infoList := body.UnifiedReceipt.LatestReceiptInfo
+		sort.SliceStable(infoList, func(i, j int) bool {
+			return infoList[i].PurchaseDate.Time().Before(infoList[j].PurchaseDate.Time())
+		})
+	}
+	return notification{body}
+}
+
+// latest returns the most recent transaction of the unified receipt, if any
+func (n notification) latest() *receipt.ReceiptInfoBody {
+	if n.body.UnifiedReceipt == nil || len(n.body.UnifiedReceipt.LatestReceiptInfo) == 0 {
+		return nil
+	}
+
+	infoList := n.body.UnifiedReceipt.LatestReceiptInfo
+	return &infoList[len(infoList)-1]
+}
+
+// pendingRenewal returns the unified receipt's renewal info for the latest transaction, if any
+func (n notification) pendingRenewal() *receipt.RenewalInfoBody {
+	latest := n.latest()
+	if latest == nil {
+		return nil
+	}
+
+	for _, info := range n.body.UnifiedReceipt.PendingRenewalInfo {
+		if info.OriginalTransactionID == latest.OriginalTransactionID {
+			return &info
+		}
+	}
+	return nil
+}
+
 func (n notification) AutoRenewStatus() bool {
+	if renewal := n.pendingRenewal(); renewal != nil {
+		return renewal.AutoRenewStatus == 1
+	}
 	return n.body.AutoRenewStatus
 }
 
 func (n notification) AutoRenewProduct() string {
+	if renewal := n.pendingRenewal(); renewal != nil && renewal.AutoRenewProductID != "" {
+		return renewal.AutoRenewProductID
+	}
 	return n.body.AutoRenewProductID
 }
 
+// AutoRenewChangedAt is zero for DID_CHANGE_RENEWAL_PREF, which doesn't say when the product
+// changed, so the server uses when the notification was received instead
 func (n notification) AutoRenewChangedAt() time.Time {
 	if n.body.NotificationType == DidChangeRenewalPref {
-		return time.Now().UTC()
+		return time.Time{}
 	}
 	return n.body.AutoRenewStatusChangedAt.Time()
 }
 
+func (n notification) ExpirationIntent() int {
+	if renewal := n.pendingRenewal(); renewal != nil {
+		return renewal.ExpirationIntent
+	}
+	intent, _ := strconv.Atoi(n.body.ExpirationIntent)
+	return intent
+}
+
+func (n notification) GracePeriodExpiresAt() time.Time {
+	if renewal := n.pendingRenewal(); renewal != nil && renewal.GracePeriodExpiresDate != nil {
+		return renewal.GracePeriodExpiresDate.Time()
+	}
+	return time.Time{}
+}
+
+func (n notification) IsInBillingRetryPeriod() bool {
+	if renewal := n.pendingRenewal(); renewal != nil {
+		return renewal.IsInBillingRetryPeriod == 1
+	}
+	return false
+}
+
+func (n notification) PriceConsentStatus() int {
+	if renewal := n.pendingRenewal(); renewal != nil {
+		return renewal.PriceConsent()
+	}
+	return receipt.PriceConsentNone
+}
+
+func (n notification) OfferCodeRefName() string {
+	if renewal := n.pendingRenewal(); renewal != nil {
+		return renewal.OfferCodeRefName
+	}
+	return ""
+}
+
+func (n notification) PromotionalOfferID() string {
+	if renewal := n.pendingRenewal(); renewal != nil {
+		return renewal.PromotionalOfferID
+	}
+	return ""
+}
+
 func (n notification) CancelledAt() time.Time {
+	if latest := n.latest(); latest != nil {
+		if latest.CancellationDate != nil {
+			return latest.CancellationDate.Time()
+		}
+		return time.Time{}
+	}
+
 	if n.body.CancellationDate != nil {
 		return n.body.CancellationDate.Time()
 	}
@@ -63,10 +171,19 @@ func (n notification) CancelledAt() time.Time {
 }
 
 func (n notification) Environment() Env {
+	if n.body.UnifiedReceipt != nil && n.body.UnifiedReceipt.Env != "" {
+		if n.body.UnifiedReceipt.Env == Production {
+			return Prod
+		}
+		return n.body.UnifiedReceipt.Env
+	}
 	return n.body.Env
 }
 
 func (n notification) ExpiresAt() time.Time {
+	if latest := n.latest(); latest != nil {
+		return latest.ExpiresDate.Time()
+	}
 	if n.body.LatestExpiredReceiptInfo != nil {
 		return n.body.LatestExpiredReceiptInfo.ExpiresDate.Time()
 	}
@@ -74,6 +191,9 @@ func (n notification) ExpiresAt() time.Time {
 }
 
 func (n notification) IsTrialPeriod() bool {
+	if latest := n.latest(); latest != nil {
+		return latest.IsTrialPeriod
+	}
 	if n.body.LatestExpiredReceiptInfo != nil {
 		return n.body.LatestExpiredReceiptInfo.IsTrialPeriod
 	}
@@ -81,6 +201,9 @@ func (n notification) IsTrialPeriod() bool {
 }
 
 func (n notification) OriginalTransactionID() string {
+	if latest := n.latest(); latest != nil {
+		return latest.OriginalTransactionID
+	}
 	if n.body.LatestExpiredReceiptInfo != nil {
 		return n.body.LatestExpiredReceiptInfo.OriginalTransactionID
 	}
@@ -88,6 +211,9 @@ func (n notification) OriginalTransactionID() string {
 }
 
 func (n notification) OriginalPurchaseDate() time.Time {
+	if latest := n.latest(); latest != nil {
+		return latest.OriginalPurchaseDate.Time()
+	}
 	if n.body.LatestExpiredReceiptInfo != nil {
 		return n.body.LatestExpiredReceiptInfo.OriginalPurchaseDate.Time()
 	}
@@ -95,6 +221,9 @@ func (n notification) OriginalPurchaseDate() time.Time {
 }
 
 func (n notification) PaidAt() time.Time {
+	if latest := n.latest(); latest != nil {
+		return latest.PurchaseDate.Time()
+	}
 	if n.body.LatestExpiredReceiptInfo != nil {
 		return n.body.LatestExpiredReceiptInfo.PurchaseDate.Time()
 	}
@@ -102,20 +231,97 @@ func (n notification) PaidAt() time.Time {
 }
 
 func (n notification) ProductID() string {
+	if latest := n.latest(); latest != nil {
+		return latest.ProductID
+	}
 	if n.body.LatestExpiredReceiptInfo != nil {
 		return n.body.LatestExpiredReceiptInfo.ProductID
 	}
 	return n.body.LatestReceiptInfo.ProductID
 }
 
-func (n notification) RefundedAt() time.Time {
+// Transactions lists the unified receipt's history oldest first, or only the latest transaction
+// for notifications from before 2019
+func (n notification) Transactions() []receipt.Transaction {
+	if n.body.UnifiedReceipt != nil && len(n.body.UnifiedReceipt.LatestReceiptInfo) > 0 {
+		var list []receipt.Transaction
+		for _, body := range n.body.UnifiedReceipt.LatestReceiptInfo {
+			list = append(list, body.Transaction())
+		}
+		return list
+	}
+
+	return []receipt.Transaction{n.transaction()}
+}
+
+// transaction is the latest transaction, from the unified receipt if there is one
+func (n notification) transaction() receipt.Transaction {
+	if latest := n.latest(); latest != nil {
+		return latest.Transaction()
+	}
+
+	info := n.body.LatestReceiptInfo
 	if n.body.LatestExpiredReceiptInfo != nil {
-		return (*(n.body.CancellationDate)).Time()
+		info = *n.body.LatestExpiredReceiptInfo
+	}
+
+	txn := receipt.Transaction{
+		TransactionID:         info.TransactionID,
+		OriginalTransactionID: info.OriginalTransactionID,
+		WebOrderLineItemID:    info.WebOrderLineItemID,
+		ProductID:             info.ProductID,
+		PurchasedAt:           info.PurchaseDate.Time(),
+		ExpiresAt:             info.ExpiresDate.Time(),
+		IsTrialPeriod:         info.IsTrialPeriod,
+		IsInIntroOfferPeriod:  info.IsInIntroOfferPeriod,
+		IsUpgraded:            info.IsUpgraded,
+	}
+	if txn.WebOrderLineItemID == "" {
+		txn.WebOrderLineItemID = n.body.WebOrderLineItemID
+	}
+	// Notifications from before 2019 may only have the cancellation date at the top level
+	if info.CancellationDate != nil {
+		txn.CancelledAt = info.CancellationDate.Time()
+	} else if n.body.CancellationDate != nil {
+		txn.CancelledAt = n.body.CancellationDate.Time()
+	}
+	if info.IsTrialPeriod || info.IsInIntroOfferPeriod {
+		txn.OfferType = receipt.OfferTypeIntroductory
+	}
+	if info.IsTrialPeriod {
+		txn.OfferDiscountType = receipt.OfferDiscountFreeTrial
+	}
+	return txn
+}
+
+func (n notification) IsInIntroOfferPeriod() bool {
+	return n.transaction().IsInIntroOfferPeriod
+}
+
+func (n notification) OfferType() int {
+	return n.transaction().OfferType
+}
+
+func (n notification) OfferIdentifier() string {
+	return n.transaction().OfferIdentifier
+}
+
+func (n notification) OfferDiscountType() string {
+	return n.transaction().OfferDiscountType
+}
+
+func (n notification) RefundedAt() time.Time {
+	switch n.body.NotificationType {
+	case Cancel, Refund, Revoke:
+		return n.CancelledAt()
 	}
 	return time.Time{}
 }
 
 func (n notification) StartedTrialAt() time.Time {
+	if latest := n.latest(); latest != nil {
+		return latest.OriginalPurchaseDate.Time()
+	}
 	if n.body.LatestExpiredReceiptInfo != nil {
 		return n.body.LatestExpiredReceiptInfo.OriginalPurchaseDate.Time()
 	}
@@ -123,7 +329,10 @@ func (n notification) StartedTrialAt() time.Time {
 }
 
 func (n notification) Status() int {
-	return receipt.StatusValid // TODO: Update to use unified receipt in Fall 2019
+	if n.body.UnifiedReceipt != nil {
+		return n.body.UnifiedReceipt.Status
+	}
+	return receipt.StatusValid
 }
 
 func (n notification) Type() NoteType {
@@ -135,9 +344,12 @@ type receiptInfo struct {
 	ProductID             string              `json:"product_id"`
 	TransactionID         string              `json:"transaction_id"`
 	OriginalTransactionID string              `json:"original_transaction_id"`
+	WebOrderLineItemID    string              `json:"web_order_line_item_id"`
 	PurchaseDate          receipt.Millistamp  `json:"purchase_date_ms,string"`
 	OriginalPurchaseDate  receipt.Millistamp  `json:"original_purchase_date_ms,string"`
 	CancellationDate      *receipt.Millistamp `json:"cancellation_date_ms,string,omitempty"`
 	IsTrialPeriod         bool                `json:"is_trial_period,string"`
+	IsInIntroOfferPeriod  bool                `json:"is_in_intro_offer_period,string"`
+	IsUpgraded            bool                `json:"is_upgraded,string"`
 	ExpiresDate           receipt.Millistamp  `json:"expires_date,string"`
 }
@@ -6,6 +6,8 @@ import (
 	"io/ioutil"
 	"testing"
 	"time"
+
+	"github.com/carpenterscode/superscribe/receipt"
 )
 
 const (
@@ -35,7 +37,8 @@ func notificationFromFile(fileName string) *notification {
 	if err := json.Unmarshal(dataFromFile(fileName), &body); err != nil {
 		panic(fmt.Errorf("Should have unmarshalled JSON: %s", err.Error()))
 	}
-	return &notification{body}
+	n := newNotification(body)
+	return &n
 }
 
 func TestParseCancel(t *testing.T) {
@@ -56,6 +59,22 @@ func TestParseCancel(t *testing.T) {
 	}
 }
 
+func TestParseLegacyUpgradeCancel(t *testing.T) {
+	n := notificationFromFile("CANCEL_upgrade_legacy.json")
+
+	history := n.Transactions()
+	if len(history) != 1 {
+		t.Fatal("Should have only the latest transaction", history)
+	}
+
+	txn := history[0]
+	if !txn.IsUpgraded || !txn.CancelledAt.Equal(cancellationDate) {
+		t.Error("Should have parsed upgraded transaction cancelled at", cancellationDate, txn)
+	} else if txn.ProductID != "month-basic" {
+		t.Error("Should have parsed product upgraded from", txn.ProductID)
+	}
+}
+
 func TestParseInitialBuy(t *testing.T) {
 	n := notificationFromFile("INITIAL_BUY_to_trial.json")
 
@@ -143,8 +162,8 @@ func TestParseDidChangeRenewalPref(t *testing.T) {
 		t.Error("Should have parsed purchase date as", purchaseDate)
 	} else if n.AutoRenewProduct() != newProductID {
 		t.Error("Should have parsed new product ID as", newProductID)
-	} else if n.AutoRenewChangedAt().IsZero() {
-		t.Error("Should have parsed auto renewed status changed as non-zero")
+	} else if !n.AutoRenewChangedAt().IsZero() {
+		t.Error("Should not have made up when the auto-renew product changed")
 	}
 }
 
@@ -171,3 +190,76 @@ func TestParseDidChangeRenewalStatus(t *testing.T) {
 		t.Error("Should have parsed auto renewed status changed as", autoRenewStatusChangedDate)
 	}
 }
+
+func TestParseUnifiedReceipt(t *testing.T) {
+	n := notificationFromFile("DID_RECOVER.json")
+
+	if n.Environment() != Prod {
+		t.Error("Should have parsed environment: PROD")
+	} else if n.Type() != DidRecover {
+		t.Error("Should have parsed notification type: DID_RECOVER")
+	} else if n.Status() != receipt.StatusValid {
+		t.Error("Should have parsed unified receipt status")
+	} else if !n.AutoRenewStatus() {
+		t.Error("Should have parsed pending renewal autorenew status: true")
+	} else if n.OriginalTransactionID() != originalTransactionID {
+		t.Error("Should have parsed original transaction ID:", originalTransactionID)
+	} else if n.IsTrialPeriod() {
+		t.Error("Should have used latest transaction, which is not in trial period")
+	} else if !n.ExpiresAt().Equal(expiresDate) {
+		t.Error("Should have parsed expires date as", expiresDate)
+	} else if !n.PaidAt().Equal(purchaseDate) {
+		t.Error("Should have parsed purchase date as", purchaseDate)
+	}
+}
+
+func TestNewNotificationSortsHistory(t *testing.T) {
+	var body Notification
+	if err := json.Unmarshal(dataFromFile("DID_RECOVER.json"), &body); err != nil {
+		t.Fatal("Should have unmarshalled JSON", err)
+	}
+	infoList := body.UnifiedReceipt.LatestReceiptInfo
+	for i, j := 0, len(infoList)-1; i < j; i, j = i+1, j-1 {
+		infoList[i], infoList[j] = infoList[j], infoList[i]
+	}
+
+	n := newNotification(body)
+	txns := n.Transactions()
+	for i := 1; i < len(txns); i++ {
+		if txns[i].PurchasedAt.Before(txns[i-1].PurchasedAt) {
+			t.Fatal("Should have sorted transactions oldest first")
+		}
+	}
+	if !n.PaidAt().Equal(purchaseDate) {
+		t.Error("Should have used latest transaction purchased at", purchaseDate)
+	}
+}
+
+func TestParseRefund(t *testing.T) {
+	n := notificationFromFile("REFUND.json")
+
+	if n.Type() != Refund {
+		t.Error("Should have parsed notification type: REFUND")
+	} else if n.AutoRenewStatus() {
+		t.Error("Should have parsed pending renewal autorenew status: false")
+	} else if !n.CancelledAt().Equal(cancellationDate) {
+		t.Error("Should have parsed cancellation date as", cancellationDate)
+	} else if !n.RefundedAt().Equal(cancellationDate) {
+		t.Error("Should have parsed refund date as", cancellationDate)
+	}
+}
+
+func TestParseDidFailToRenew(t *testing.T) {
+	n := notificationFromFile("DID_FAIL_TO_RENEW.json")
+
+	gracePeriodExpiresAt := expiresDate.AddDate(0, 0, 5)
+	if n.Type() != DidFailToRenew {
+		t.Error("Should have parsed notification type: DID_FAIL_TO_RENEW")
+	} else if !n.IsInBillingRetryPeriod() {
+		t.Error("Should have parsed as in billing retry period")
+	} else if n.ExpirationIntent() != receipt.ExpirationIntentBillingError {
+		t.Error("Should have parsed expiration intent as billing error")
+	} else if !n.GracePeriodExpiresAt().Equal(gracePeriodExpiresAt) {
+		t.Error("Should have parsed grace period expires date as", gracePeriodExpiresAt)
+	}
+}
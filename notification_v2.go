@@ -0,0 +1,243 @@
+package superscribe
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/carpenterscode/superscribe/receipt"
+)
+
+// SignedNotification is the request body App Store Server Notifications V2 POSTs
+type SignedNotification struct {
+	SignedPayload string `json:"signedPayload"`
+}
+
+// NotificationV2 is the decoded signedPayload of a V2 notification
+type NotificationV2 struct {
+	NotificationType NoteType    `json:"notificationType"`
+	Subtype          NoteSubtype `json:"subtype"`
+	NotificationUUID string      `json:"notificationUUID"`
+	Version          string      `json:"version"`
+
+	SignedDate receipt.Millistamp `json:"signedDate"`
+
+	Data struct {
+		AppAppleID            int64  `json:"appAppleId"`
+		BundleID              string `json:"bundleId"`
+		BundleVersion         string `json:"bundleVersion"`
+		Env                   Env    `json:"environment"`
+		SignedRenewalInfo     string `json:"signedRenewalInfo"`
+		SignedTransactionInfo string `json:"signedTransactionInfo"`
+		Status                int    `json:"status"`
+	} `json:"data"`
+}
+
+// appIdentity identifies the app that V2 notifications must be about
+type appIdentity struct {
+	bundleID string
+	appleID  int64
+}
+
+// verify rejects notifications about another app, which Apple signs with the same certificates
+func (a appIdentity) verify(body NotificationV2) error {
+	if a.bundleID == "" {
+		return errors.New("Bundle ID should have been set to accept V2 notifications")
+	}
+	if body.Data.BundleID != a.bundleID {
+		return fmt.Errorf("Notification should have been about %s, not %s", a.bundleID,
+			body.Data.BundleID)
+	}
+	if a.appleID != 0 && body.Data.AppAppleID != 0 && body.Data.AppAppleID != a.appleID {
+		return fmt.Errorf("Notification should have been about app %d, not %d", a.appleID,
+			body.Data.AppAppleID)
+	}
+	return nil
+}
+
+// decodeNotificationV2 verifies the signed payload and its nested signed transaction and renewal
+// info against roots, and that the notification is about app.
+func decodeNotificationV2(roots *x509.CertPool, app appIdentity,
+	signed SignedNotification) (*notificationV2, error) {
+
+	var n notificationV2
+	if err := receipt.VerifyJWS(roots, signed.SignedPayload, &n.body); err != nil {
+		return nil, err
+	}
+	if err := app.verify(n.body); err != nil {
+		return nil, err
+	}
+
+	if token := n.body.Data.SignedTransactionInfo; token != "" {
+		if err := receipt.VerifyJWS(roots, token, &n.transaction); err != nil {
+			return nil, err
+		}
+	}
+
+	if token := n.body.Data.SignedRenewalInfo; token != "" {
+		if err := receipt.VerifyJWS(roots, token, &n.renewal); err != nil {
+			return nil, err
+		}
+	}
+
+	return &n, nil
+}
+
+// notificationV2 adapts a V2 notification to Note so listeners don't need to know which version
+// of App Store Server Notifications is configured.
+type notificationV2 struct {
+	body        NotificationV2
+	transaction receipt.JWSTransaction
+	renewal     receipt.JWSRenewalInfo
+}
+
+func (n notificationV2) AutoRenewStatus() bool {
+	return n.renewal.AutoRenewStatus == 1
+}
+
+func (n notificationV2) AutoRenewProduct() string {
+	return n.renewal.AutoRenewProductID
+}
+
+func (n notificationV2) AutoRenewChangedAt() time.Time {
+	switch n.body.NotificationType {
+	case DidChangeRenewalPref, DidChangeRenewalStatus:
+		return n.body.SignedDate.Time()
+	}
+	return time.Time{}
+}
+
+func (n notificationV2) ExpirationIntent() int {
+	return n.renewal.ExpirationIntent
+}
+
+func (n notificationV2) GracePeriodExpiresAt() time.Time {
+	return n.renewal.GracePeriodExpiresAt()
+}
+
+func (n notificationV2) IsInBillingRetryPeriod() bool {
+	return n.renewal.IsInBillingRetryPeriod
+}
+
+func (n notificationV2) PriceConsentStatus() int {
+	return n.renewal.PriceConsent()
+}
+
+func (n notificationV2) NextPrice() (string, float64, bool) {
+	return n.renewal.NextPrice()
+}
+
+func (n notificationV2) OfferCodeRefName() string {
+	return n.renewal.OfferCodeRefName()
+}
+
+func (n notificationV2) PromotionalOfferID() string {
+	return n.renewal.PromotionalOfferID()
+}
+
+func (n notificationV2) CancelledAt() time.Time {
+	if n.transaction.RevocationDate != nil {
+		return n.transaction.RevocationDate.Time()
+	}
+	return time.Time{}
+}
+
+func (n notificationV2) Environment() Env {
+	if n.body.Data.Env == Production {
+		return Prod
+	}
+	return n.body.Data.Env
+}
+
+func (n notificationV2) ExpiresAt() time.Time {
+	return n.transaction.ExpiresDate.Time()
+}
+
+func (n notificationV2) IsTrialPeriod() bool {
+	return n.transaction.IsTrialPeriod()
+}
+
+func (n notificationV2) OriginalTransactionID() string {
+	return n.transaction.OriginalTransactionID
+}
+
+func (n notificationV2) OriginalPurchaseDate() time.Time {
+	return n.transaction.OriginalPurchaseDate.Time()
+}
+
+func (n notificationV2) PaidAt() time.Time {
+	return n.transaction.PurchaseDate.Time()
+}
+
+func (n notificationV2) ProductID() string {
+	return n.transaction.ProductID
+}
+
+// Transactions only has the notification's transaction, since V2 notifications don't include
+// history
+func (n notificationV2) Transactions() []receipt.Transaction {
+	return []receipt.Transaction{n.transaction.Transaction()}
+}
+
+func (n notificationV2) IsInIntroOfferPeriod() bool {
+	return n.transaction.Transaction().IsInIntroOfferPeriod
+}
+
+func (n notificationV2) OfferType() int {
+	return n.transaction.OfferType
+}
+
+func (n notificationV2) OfferIdentifier() string {
+	return n.transaction.OfferIdentifier
+}
+
+func (n notificationV2) OfferDiscountType() string {
+	return n.transaction.Transaction().OfferDiscountType
+}
+
+func (n notificationV2) RefundedAt() time.Time {
+	switch n.body.NotificationType {
+	case Refund, Revoke:
+		return n.CancelledAt()
+	}
+	return time.Time{}
+}
+
+func (n notificationV2) StartedTrialAt() time.Time {
+	return n.transaction.OriginalPurchaseDate.Time()
+}
+
+func (n notificationV2) Status() int {
+	return receipt.StatusValid
+}
+
+// Type maps V2 notification types onto their V1 equivalents where one exists, so the same
+// listener calls fire for both versions.
+func (n notificationV2) Type() NoteType {
+	switch n.body.NotificationType {
+	case Subscribed:
+		if n.body.Subtype == SubtypeResubscribe {
+			return InteractiveRenewal
+		}
+		return InitialBuy
+	case DidRenew:
+		if n.body.Subtype == SubtypeBillingRecovery {
+			return DidRecover
+		}
+		return Renewal
+	}
+	return n.body.NotificationType
+}
+
+func (n notificationV2) SignedAt() time.Time {
+	return n.body.SignedDate.Time()
+}
+
+func (n notificationV2) Subtype() NoteSubtype {
+	return n.body.Subtype
+}
+
+func (n notificationV2) NotificationUUID() string {
+	return n.body.NotificationUUID
+}
@@ -0,0 +1,409 @@
+package superscribe
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+)
+
+// testSigner stands in for Apple's signing certificate chain using a locally generated CA
+type testSigner struct {
+	roots *x509.CertPool
+	key   *ecdsa.PrivateKey
+	x5c   []string
+}
+
+func newTestSigner(t *testing.T) testSigner {
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Root CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	rootDER, err := x509.CreateCertificate(rand.Reader, rootTemplate, rootTemplate,
+		&rootKey.PublicKey, rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, _ := x509.ParseCertificate(rootDER)
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "Test Signing"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTemplate, root, &leafKey.PublicKey,
+		rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+
+	return testSigner{
+		roots: roots,
+		key:   leafKey,
+		x5c: []string{
+			base64.StdEncoding.EncodeToString(leafDER),
+			base64.StdEncoding.EncodeToString(rootDER),
+		},
+	}
+}
+
+func (signer testSigner) sign(t *testing.T, payload interface{}) string {
+	header, _ := json.Marshal(map[string]interface{}{"alg": "ES256", "x5c": signer.x5c})
+	body, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(body)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	r, s, err := ecdsa.Sign(rand.Reader, signer.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sig := make([]byte, 64)
+	rBytes, sBytes := r.Bytes(), s.Bytes()
+	copy(sig[32-len(rBytes):32], rBytes)
+	copy(sig[64-len(sBytes):], sBytes)
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// testApp is the app the test notifications are about
+var testApp = appIdentity{bundleID: "com.example.superscribe", appleID: 1234567890}
+
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func (signer testSigner) notification(t *testing.T, noteType NoteType, subtype NoteSubtype,
+	transaction, renewal map[string]interface{}) []byte {
+
+	payload := map[string]interface{}{
+		"notificationType": noteType,
+		"subtype":          subtype,
+		"notificationUUID": "002e14d5-51f5-4503-b5a8-c3a1af68eb20",
+		"version":          "2.0",
+		"signedDate":       millis(autoRenewStatusChangedDate),
+		"data": map[string]interface{}{
+			"appAppleId":            testApp.appleID,
+			"bundleId":              testApp.bundleID,
+			"environment":           "Production",
+			"signedTransactionInfo": signer.sign(t, transaction),
+			"signedRenewalInfo":     signer.sign(t, renewal),
+		},
+	}
+
+	data, _ := json.Marshal(SignedNotification{signer.sign(t, payload)})
+	return data
+}
+
+func v2Transaction(offerType int) map[string]interface{} {
+	return map[string]interface{}{
+		"originalTransactionId": originalTransactionID,
+		"transactionId":         originalTransactionID,
+		"productId":             productID,
+		"purchaseDate":          millis(purchaseDate),
+		"originalPurchaseDate":  millis(time.Date(2019, time.March, 2, 7, 27, 19, 0, time.UTC)),
+		"expiresDate":           millis(expiresDate),
+		"offerType":             offerType,
+	}
+}
+
+func v2Renewal(autoRenewProductID string, autoRenewStatus int) map[string]interface{} {
+	return map[string]interface{}{
+		"originalTransactionId": originalTransactionID,
+		"productId":             productID,
+		"autoRenewProductId":    autoRenewProductID,
+		"autoRenewStatus":       autoRenewStatus,
+	}
+}
+
+func TestParseNotificationV2(t *testing.T) {
+	signer := newTestSigner(t)
+
+	var signed SignedNotification
+	data := signer.notification(t, Subscribed, SubtypeInitialBuy, v2Transaction(1),
+		v2Renewal(productID, 1))
+	if err := json.Unmarshal(data, &signed); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := decodeNotificationV2(signer.roots, testApp, signed)
+	if err != nil {
+		t.Fatal("Should have verified signed notification", err)
+	}
+
+	if n.Environment() != Prod {
+		t.Error("Should have parsed environment: PROD")
+	} else if !n.AutoRenewStatus() {
+		t.Error("Should have correct autorenew status: true")
+	} else if n.Type() != InitialBuy {
+		t.Error("Should have mapped SUBSCRIBED to INITIAL_BUY")
+	} else if n.OriginalTransactionID() != originalTransactionID {
+		t.Error("Should have parsed original transaction ID:", originalTransactionID)
+	} else if !n.IsTrialPeriod() {
+		t.Error("Should have parsed as in trial period")
+	} else if !n.ExpiresAt().Equal(expiresDate) {
+		t.Error("Should have parsed expires date as", expiresDate)
+	} else if !n.PaidAt().Equal(purchaseDate) {
+		t.Error("Should have parsed purchase date as", purchaseDate)
+	}
+
+	if _, err := decodeNotificationV2(newTestSigner(t).roots, testApp, signed); err == nil {
+		t.Error("Should have rejected notification signed by an untrusted root")
+	}
+
+	// Apple signs notifications about every app alike
+	others := []appIdentity{{}, {bundleID: "com.example.other"},
+		{bundleID: testApp.bundleID, appleID: 987654321}}
+	for _, other := range others {
+		if _, err := decodeNotificationV2(signer.roots, other, signed); err == nil {
+			t.Error("Should have rejected notification about another app", other)
+		}
+	}
+	if _, err := decodeNotificationV2(signer.roots, appIdentity{bundleID: testApp.bundleID},
+		signed); err != nil {
+
+		t.Error("Should have accepted notification without checking an unset Apple ID", err)
+	}
+}
+
+func TestHandleSubscribedV2(t *testing.T) {
+	signer := newTestSigner(t)
+
+	// Load test data
+	dataReader := bytes.NewReader(signer.notification(t, Subscribed, SubtypeInitialBuy,
+		v2Transaction(1), v2Renewal(productID, 1)))
+
+	// Expected result
+	expected := expectedEvent()
+
+	// Set up mocks and fakes
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSub := NewMockSubscription(ctrl)
+	mockSub.EXPECT().Currency().Return(currency).AnyTimes()
+	mockSub.EXPECT().Price().Return(price).AnyTimes()
+
+	mockListener := NewMockEventListener(ctrl)
+	mockListener.EXPECT().StartedTrial(EventMatcher{expected}).Times(1)
+
+	fakeMatcher := func(now time.Time) []string { return []string{} }
+	fakeUpdater := stubUpdater{}
+	fakeFetcher := func(originalTransactionID string) (Subscription, error) {
+		return mockSub, nil
+	}
+
+	srv := NewServer("http://example.com", testValidator, fakeMatcher, fakeFetcher, fakeUpdater, 1)
+	srv.Roots = signer.roots
+	srv.BundleID = testApp.bundleID
+	srv.Listener.Add(mockListener)
+
+	// Test code
+	req := httptest.NewRequest("POST", "http://example.com/superscribe", dataReader)
+	w := httptest.NewRecorder()
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Wrong status code: got %v want %v", w.Code, http.StatusOK)
+	}
+}
+
+func TestHandleDidRenewV2(t *testing.T) {
+	signer := newTestSigner(t)
+
+	// Load test data
+	transaction := v2Transaction(0)
+	transaction["transactionId"] = "123456789012346"
+	dataReader := bytes.NewReader(signer.notification(t, DidRenew, "", transaction,
+		v2Renewal(productID, 1)))
+
+	// Expected result
+	expected := paidEvent()
+	expected.paymentKind = PaidRenewal
+
+	// Set up mocks and fakes
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSub := NewMockSubscription(ctrl)
+	mockSub.EXPECT().Currency().Return(currency).AnyTimes()
+	mockSub.EXPECT().Price().Return(price).AnyTimes()
+
+	mockListener := NewMockEventListener(ctrl)
+	mockListener.EXPECT().Paid(EventMatcher{expected}).Times(1)
+
+	fakeMatcher := func(now time.Time) []string { return []string{} }
+	fakeUpdater := stubUpdater{}
+	fakeFetcher := func(originalTransactionID string) (Subscription, error) {
+		return mockSub, nil
+	}
+
+	srv := NewServer("http://example.com", testValidator, fakeMatcher, fakeFetcher, fakeUpdater, 1)
+	srv.Roots = signer.roots
+	srv.BundleID = testApp.bundleID
+	srv.Listener.Add(mockListener)
+
+	// Test code
+	req := httptest.NewRequest("POST", "http://example.com/superscribe", dataReader)
+	w := httptest.NewRecorder()
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Wrong status code: got %v want %v", w.Code, http.StatusOK)
+	}
+}
+
+func TestHandleUpgradeV2(t *testing.T) {
+	signer := newTestSigner(t)
+
+	// Load test data
+	transaction := v2Transaction(0)
+	transaction["transactionId"] = "123456789012346"
+	dataReader := bytes.NewReader(signer.notification(t, DidChangeRenewalPref, SubtypeUpgrade,
+		transaction, v2Renewal(productID, 1)))
+
+	// Set up mocks and fakes
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// Last known to be subscribed to the product upgraded from
+	mockSub := NewMockSubscription(ctrl)
+	mockSub.EXPECT().ProductID().Return("month-basic").AnyTimes()
+	mockSub.EXPECT().Currency().Return(currency).AnyTimes()
+	mockSub.EXPECT().Price().Return(price).AnyTimes()
+
+	mockListener := NewMockEventListener(ctrl)
+	mockListener.EXPECT().Upgraded(gomock.Any()).DoAndReturn(func(evt ProductChangeEvent) error {
+		if evt.PreviousProductID() != "month-basic" || !evt.IsProductChangeImmediate() {
+			t.Error("Should have upgraded immediately from basic", evt.PreviousProductID())
+		}
+		return nil
+	}).Times(1)
+
+	fakeMatcher := func(now time.Time) []string { return []string{} }
+	fakeUpdater := stubUpdater{}
+	fakeFetcher := func(originalTransactionID string) (Subscription, error) {
+		return mockSub, nil
+	}
+
+	srv := NewServer("http://example.com", testValidator, fakeMatcher, fakeFetcher, fakeUpdater, 1)
+	srv.Roots = signer.roots
+	srv.BundleID = testApp.bundleID
+	srv.Listener.Add(mockListener)
+
+	// Test code
+	req := httptest.NewRequest("POST", "http://example.com/superscribe", dataReader)
+	w := httptest.NewRecorder()
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Wrong status code: got %v want %v", w.Code, http.StatusOK)
+	}
+}
+
+func TestHandlePriceIncreaseAcceptedV2(t *testing.T) {
+	signer := newTestSigner(t)
+
+	// Load test data
+	dataReader := bytes.NewReader(signer.notification(t, PriceIncrease, SubtypeAccepted,
+		v2Transaction(0), v2Renewal(productID, 1)))
+
+	// Set up mocks and fakes
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSub := NewMockSubscription(ctrl)
+	mockSub.EXPECT().Currency().Return(currency).AnyTimes()
+	mockSub.EXPECT().Price().Return(price).AnyTimes()
+
+	mockListener := NewMockEventListener(ctrl)
+	mockListener.EXPECT().PriceIncreaseAccepted(gomock.Any()).DoAndReturn(
+		func(evt PriceIncreaseEvent) error {
+			if !evt.PriceConsentChangedAt().Equal(autoRenewStatusChangedDate) {
+				t.Error("Should have accepted when the notification was signed",
+					evt.PriceConsentChangedAt())
+			}
+			return nil
+		}).Times(1)
+
+	fakeMatcher := func(now time.Time) []string { return []string{} }
+	fakeUpdater := stubUpdater{}
+	fakeFetcher := func(originalTransactionID string) (Subscription, error) {
+		return mockSub, nil
+	}
+
+	srv := NewServer("http://example.com", testValidator, fakeMatcher, fakeFetcher, fakeUpdater, 1)
+	srv.Roots = signer.roots
+	srv.BundleID = testApp.bundleID
+	srv.Listener.Add(mockListener)
+
+	// Test code
+	req := httptest.NewRequest("POST", "http://example.com/superscribe", dataReader)
+	w := httptest.NewRecorder()
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Wrong status code: got %v want %v", w.Code, http.StatusOK)
+	}
+}
+
+func TestHandleUnverifiedV2(t *testing.T) {
+	signer := newTestSigner(t)
+
+	dataReader := bytes.NewReader(signer.notification(t, DidRenew, "", v2Transaction(0),
+		v2Renewal(productID, 1)))
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockListener := NewMockEventListener(ctrl)
+
+	fakeMatcher := func(now time.Time) []string { return []string{} }
+	fakeFetcher := func(originalTransactionID string) (Subscription, error) {
+		t.Error("Should not have fetched subscription for unverified notification")
+		return nil, nil
+	}
+
+	srv := NewServer("http://example.com", testValidator, fakeMatcher, fakeFetcher, stubUpdater{}, 1)
+	srv.Roots = newTestSigner(t).roots
+	srv.BundleID = testApp.bundleID
+	srv.Listener.Add(mockListener)
+
+	req := httptest.NewRequest("POST", "http://example.com/superscribe", dataReader)
+	w := httptest.NewRecorder()
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Wrong status code: got %v want %v", w.Code, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,66 @@
+package superscribe
+
+import (
+	"sort"
+	"time"
+
+	"github.com/carpenterscode/superscribe/receipt"
+)
+
+// resubscribeGap is how long after the previous period expired a purchase counts as the
+// customer coming back rather than an automatic renewal
+const resubscribeGap = 24 * time.Hour
+
+// classifyPayment finds the transaction paid at paidAt in a subscription's history, and returns
+// what kind of payment it was along with how many paid periods preceded it. When the history
+// doesn't include enough of the subscription to tell, it returns fallback and -1.
+func classifyPayment(history []receipt.Transaction, paidAt time.Time,
+	fallback PaymentKind) (PaymentKind, int) {
+
+	sorted := make([]receipt.Transaction, len(history))
+	copy(sorted, history)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].PurchasedAt.Before(sorted[j].PurchasedAt)
+	})
+
+	current := -1
+	for i, txn := range sorted {
+		if txn.PurchasedAt.Equal(paidAt) {
+			current = i
+		}
+	}
+	if current < 0 {
+		return fallback, -1
+	}
+
+	txn := sorted[current]
+	if current == 0 {
+		if txn.TransactionID != txn.OriginalTransactionID {
+			// Earlier transactions are missing, such as with App Store Server API statuses and
+			// notifications from before 2019
+			return fallback, -1
+		}
+		if txn.IsInIntroOfferPeriod {
+			return PaidIntroOffer, 0
+		}
+		return PaidInitialPurchase, 0
+	}
+
+	renewalCount := 0
+	for _, prior := range sorted[:current] {
+		if !prior.IsTrialPeriod {
+			renewalCount++
+		}
+	}
+
+	prior := sorted[current-1]
+	switch {
+	case txn.PurchasedAt.Sub(prior.ExpiresAt) > resubscribeGap:
+		return PaidResubscribe, renewalCount
+	case prior.IsTrialPeriod:
+		return PaidTrialConversion, renewalCount
+	case txn.IsInIntroOfferPeriod:
+		return PaidIntroOffer, renewalCount
+	}
+	return PaidRenewal, renewalCount
+}
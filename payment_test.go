@@ -0,0 +1,63 @@
+package superscribe
+
+import (
+	"testing"
+	"time"
+
+	"github.com/carpenterscode/superscribe/receipt"
+)
+
+func monthlyTransaction(id string, purchasedAt time.Time) receipt.Transaction {
+	return receipt.Transaction{
+		TransactionID:         id,
+		OriginalTransactionID: originalTransactionID,
+		ProductID:             productID,
+		PurchasedAt:           purchasedAt,
+		ExpiresAt:             purchasedAt.AddDate(0, 1, 0),
+	}
+}
+
+func TestClassifyPayment(t *testing.T) {
+	start := time.Date(2019, time.March, 2, 7, 27, 19, 0, time.UTC)
+
+	trial := monthlyTransaction(originalTransactionID, start)
+	trial.IsTrialPeriod = true
+	trial.ExpiresAt = start.AddDate(0, 0, 7)
+
+	first := monthlyTransaction(originalTransactionID, start)
+	intro := first
+	intro.IsInIntroOfferPeriod = true
+	second := monthlyTransaction("2", first.ExpiresAt)
+	third := monthlyTransaction("3", second.ExpiresAt)
+	converted := monthlyTransaction("2", trial.ExpiresAt)
+	lapsed := monthlyTransaction("3", second.ExpiresAt.AddDate(0, 0, 10))
+
+	cases := []struct {
+		name    string
+		history []receipt.Transaction
+		paidAt  time.Time
+		kind    PaymentKind
+		count   int
+	}{
+		{"initial purchase", []receipt.Transaction{first}, first.PurchasedAt,
+			PaidInitialPurchase, 0},
+		{"intro offer", []receipt.Transaction{intro}, intro.PurchasedAt, PaidIntroOffer, 0},
+		{"trial conversion", []receipt.Transaction{trial, converted}, converted.PurchasedAt,
+			PaidTrialConversion, 0},
+		{"renewal", []receipt.Transaction{third, first, second}, third.PurchasedAt,
+			PaidRenewal, 2},
+		{"resubscribe", []receipt.Transaction{first, second, lapsed}, lapsed.PurchasedAt,
+			PaidResubscribe, 2},
+		{"missing history", []receipt.Transaction{third}, third.PurchasedAt, PaidRenewal, -1},
+		{"unknown transaction", []receipt.Transaction{first}, second.PurchasedAt,
+			PaidRenewal, -1},
+	}
+
+	for _, c := range cases {
+		kind, count := classifyPayment(c.history, c.paidAt, PaidRenewal)
+		if kind != c.kind || count != c.count {
+			t.Errorf("%s: should have classified as %s #%d, got %s #%d", c.name, c.kind,
+				c.count, kind, count)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package superscribe
+
+import (
+	"github.com/carpenterscode/superscribe/receipt"
+)
+
+// Pipeline is the subscription store and listeners that notifications from one App Store
+// environment are processed against.
+type Pipeline struct {
+	Fetch    SubscriptionFetch
+	Updater  SubscriptionUpdater
+	Listener *MultiEventListener
+
+	// FetchContext and UpdaterContext take precedence over Fetch and Updater when set
+	FetchContext   SubscriptionFetchContext
+	UpdaterContext SubscriptionUpdaterContext
+
+	// SmallBusinessProgram applies the reduced commission to every payment
+	SmallBusinessProgram bool
+
+	// Deduplicator acknowledges notifications already processed without updating or notifying
+	// listeners again
+	Deduplicator Deduplicator
+
+	// Catalog tells upgrades, downgrades and crossgrades apart. Products also fill in prices the
+	// store doesn't have and estimate renewals that incomplete history can't count.
+	Catalog Catalog
+
+	// DefaultStorefront, when set, is the App Store country that catalog prices are taken from
+	// for subscriptions whose storefront is unknown, such as USA for an app only sold there
+	DefaultStorefront string
+}
+
+// NewPipeline creates a pipeline without listeners, such as for Sandbox notifications sent while
+// testing with TestFlight.
+func NewPipeline(fetch SubscriptionFetch, updater SubscriptionUpdater) *Pipeline {
+	return &Pipeline{
+		Fetch:    fetch,
+		Updater:  updater,
+		Listener: NewMultiEventListener(),
+	}
+}
+
+// NewPipelineContext is NewPipeline for context-aware stores
+func NewPipelineContext(fetch SubscriptionFetchContext,
+	updater SubscriptionUpdaterContext) *Pipeline {
+
+	return &Pipeline{
+		FetchContext:   fetch,
+		UpdaterContext: updater,
+		Listener:       NewMultiEventListener(),
+	}
+}
+
+func (p *Pipeline) AddListener(l EventListener) {
+	p.Listener.Add(l)
+}
+
+func (p Pipeline) fetch() SubscriptionFetchContext {
+	if p.FetchContext != nil {
+		return p.FetchContext
+	}
+	return p.Fetch.WithContext()
+}
+
+func (p Pipeline) updater() SubscriptionUpdaterContext {
+	if p.UpdaterContext != nil {
+		return p.UpdaterContext
+	}
+	return UpdaterWithContext(p.Updater)
+}
+
+func (p Pipeline) product(productID string) (Product, bool) {
+	if p.Catalog == nil {
+		return Product{}, false
+	}
+	return p.Catalog.Product(productID)
+}
+
+// revenue is the price the store has for the subscription, or else the catalog price of the
+// product and offer in effect in the storefront of the latest transaction
+func (p Pipeline) revenue(sub Subscription, info receipt.Info) (string, float64) {
+	if sub.Currency() != "" {
+		return sub.Currency(), sub.Price()
+	}
+
+	product, ok := p.product(info.ProductID())
+	if !ok {
+		return sub.Currency(), sub.Price()
+	}
+
+	storefront := p.storefront(sub, info)
+	price, ok := product.Price(storefront)
+	if !ok {
+		return sub.Currency(), sub.Price()
+	}
+	if offer, ok := product.Offer(info.OfferType(), info.OfferIdentifier()); ok {
+		if discounted, ok := offer.Price(storefront, price); ok {
+			price = discounted
+		}
+	}
+	return price.Currency, price.Amount
+}
+
+// nextPricer is receipt info that knows what the subscription renews at, which signed renewal
+// info does
+type nextPricer interface {
+	NextPrice() (string, float64, bool)
+}
+
+// priceIncrease is the price the subscription renewed at before an increase, and the price it
+// renews at after from the App Store, or else the catalog price of the product set to renew.
+// The new price is 0 unless it's in the same currency.
+func (p Pipeline) priceIncrease(sub Subscription, info receipt.Info) (float64, float64) {
+	currency, previous := p.revenue(sub, info)
+
+	if pricer, ok := info.(nextPricer); ok {
+		if nextCurrency, next, ok := pricer.NextPrice(); ok && nextCurrency == currency {
+			return previous, next
+		}
+	}
+
+	productID := info.AutoRenewProduct()
+	if productID == "" {
+		productID = info.ProductID()
+	}
+	if product, ok := p.product(productID); ok {
+		if price, ok := product.Price(p.storefront(sub, info)); ok && price.Currency == currency {
+			return previous, price.Amount
+		}
+	}
+	return previous, 0
+}
+
+// storefront is where the latest transaction was made, if the store said, or else where the
+// subscription was last known to be. Receipts and V1 notifications don't say, so it's
+// DefaultStorefront otherwise.
+func (p Pipeline) storefront(sub Subscription, info receipt.Info) string {
+	if history := info.Transactions(); len(history) > 0 {
+		if latest := history[len(history)-1].Storefront; latest != "" {
+			return latest
+		}
+	}
+	if sub, ok := sub.(StorefrontSubscription); ok && sub.Storefront() != "" {
+		return sub.Storefront()
+	}
+	return p.DefaultStorefront
+}
+
+// payment classifies the payment at info.PaidAt, estimating how many paid periods preceded it
+// from the product duration when history is incomplete
+func (p Pipeline) payment(info receipt.Info, fallback PaymentKind) (PaymentKind, int) {
+	kind, count := classifyPayment(info.Transactions(), info.PaidAt(), fallback)
+	if count >= 0 {
+		return kind, count
+	}
+	if kind == PaidTrialConversion {
+		return kind, 0
+	}
+
+	product, ok := p.product(info.ProductID())
+	if !ok {
+		return kind, count
+	}
+	if periods, ok := product.Duration.periodsBetween(info.OriginalPurchaseDate(),
+		info.PaidAt()); ok {
+		count = periods
+	}
+	return kind, count
+}
+
+// commission is the rate Apple takes from the payment at info.PaidAt. When history is
+// incomplete, the product duration estimates paid service as continuous since the original
+// purchase.
+func (p Pipeline) commission(info receipt.Info) (float64, bool) {
+	rate, oneYear := commission(info.Transactions(), info.PaidAt(), p.SmallBusinessProgram)
+	if oneYear {
+		return rate, oneYear
+	}
+	if _, count := classifyPayment(info.Transactions(), info.PaidAt(), PaidRenewal); count >= 0 {
+		return rate, oneYear
+	}
+
+	product, ok := p.product(info.ProductID())
+	if !ok {
+		return rate, oneYear
+	}
+	start := info.OriginalPurchaseDate()
+	periods, ok := product.Duration.periodsBetween(start, info.PaidAt())
+	if ok && !product.Duration.AddTo(start, periods).Before(start.Add(paidServiceYear)) {
+		return ReducedCommission, true
+	}
+	return rate, oneYear
+}
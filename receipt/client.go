@@ -0,0 +1,382 @@
+package receipt
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// App Store Server API replaces verifyReceipt by looking subscriptions up by transaction ID.
+// https://developer.apple.com/documentation/appstoreserverapi
+const (
+	ProductionAPIURL = "https://api.storekit.itunes.apple.com"
+	SandboxAPIURL    = "https://api.storekit-sandbox.itunes.apple.com"
+)
+
+// Subscription statuses returned by Get All Subscription Statuses
+const (
+	SubscriptionActive       = 1
+	SubscriptionExpired      = 2
+	SubscriptionBillingRetry = 3
+	SubscriptionGracePeriod  = 4
+	SubscriptionRevoked      = 5
+)
+
+// Client calls the App Store Server API with JWTs signed by an in-app purchase key.
+type Client struct {
+	BaseURL    string
+	BundleID   string
+	IssuerID   string
+	KeyID      string
+	Key        *ecdsa.PrivateKey
+	HTTPClient *http.Client
+
+	// Roots verifies the signed transactions and renewal info in responses
+	Roots *x509.CertPool
+}
+
+// NewClient configures a production App Store Server API client. Set BaseURL to SandboxAPIURL
+// for sandbox transactions.
+func NewClient(issuerID, keyID, bundleID string, key *ecdsa.PrivateKey,
+	roots *x509.CertPool) *Client {
+
+	return &Client{
+		BaseURL:    ProductionAPIURL,
+		BundleID:   bundleID,
+		IssuerID:   issuerID,
+		KeyID:      keyID,
+		Key:        key,
+		HTTPClient: &http.Client{Timeout: time.Second * 20},
+		Roots:      roots,
+	}
+}
+
+// ParsePrivateKey decodes the PEM-encoded .p8 in-app purchase key downloaded from App Store
+// Connect.
+func ParsePrivateKey(data []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("In-app purchase key should have been PEM encoded")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("In-app purchase key should have been an ECDSA key")
+	}
+	return ecKey, nil
+}
+
+type apiClaims struct {
+	Issuer    string `json:"iss"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	Audience  string `json:"aud"`
+	BundleID  string `json:"bid"`
+}
+
+func (c *Client) token() (string, error) {
+	now := time.Now()
+	header := map[string]string{"alg": "ES256", "kid": c.KeyID, "typ": "JWT"}
+	claims := apiClaims{
+		Issuer:    c.IssuerID,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(5 * time.Minute).Unix(),
+		Audience:  "appstoreconnect-v1",
+		BundleID:  c.BundleID,
+	}
+	return signES256(c.Key, header, claims)
+}
+
+// APIError is the error body the App Store Server API returns with non-2xx responses
+type APIError struct {
+	StatusCode   int    `json:"-"`
+	ErrorCode    int    `json:"errorCode"`
+	ErrorMessage string `json:"errorMessage"`
+}
+
+func (e APIError) Error() string {
+	return fmt.Sprintf("App Store Server API %d error %d: %s", e.StatusCode, e.ErrorCode,
+		e.ErrorMessage)
+}
+
+// Temporary reports whether the App Store Server API was rate limiting requests or failing, so
+// it may respond if asked again later
+func (e APIError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+func (c *Client) get(ctx context.Context, path string, query url.Values, v interface{}) error {
+
+	token, err := c.token()
+	if err != nil {
+		return err
+	}
+
+	endpoint := c.BaseURL + path
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Println("Read to []byte", err)
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		apiErr := APIError{StatusCode: resp.StatusCode}
+		json.Unmarshal(data, &apiErr)
+		return apiErr
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+type historyResponse struct {
+	Revision           string   `json:"revision"`
+	HasMore            bool     `json:"hasMore"`
+	SignedTransactions []string `json:"signedTransactions"`
+}
+
+// TransactionHistory pages through Get Transaction History and returns every verified
+// transaction for the customer who made transactionID.
+func (c *Client) TransactionHistory(transactionID string) ([]JWSTransaction, error) {
+	return c.TransactionHistoryContext(context.Background(), transactionID)
+}
+
+// TransactionHistoryContext is TransactionHistory with a context that can cancel the requests
+func (c *Client) TransactionHistoryContext(ctx context.Context,
+	transactionID string) ([]JWSTransaction, error) {
+
+	var transactions []JWSTransaction
+	query := url.Values{}
+
+	for {
+		var resp historyResponse
+		if err := c.get(ctx, "/inApps/v1/history/"+url.PathEscape(transactionID), query,
+			&resp); err != nil {
+			return nil, err
+		}
+
+		for _, signed := range resp.SignedTransactions {
+			var txn JWSTransaction
+			if err := VerifyJWS(c.Roots, signed, &txn); err != nil {
+				return nil, err
+			}
+			transactions = append(transactions, txn)
+		}
+
+		if !resp.HasMore {
+			return transactions, nil
+		}
+		query.Set("revision", resp.Revision)
+	}
+}
+
+type statusResponse struct {
+	Data []struct {
+		SubscriptionGroupIdentifier string `json:"subscriptionGroupIdentifier"`
+		LastTransactions            []struct {
+			OriginalTransactionID string `json:"originalTransactionId"`
+			Status                int    `json:"status"`
+			SignedTransactionInfo string `json:"signedTransactionInfo"`
+			SignedRenewalInfo     string `json:"signedRenewalInfo"`
+		} `json:"lastTransactions"`
+	} `json:"data"`
+}
+
+// SubscriptionStatus calls Get All Subscription Statuses and returns the latest state of the
+// subscription identified by originalTransactionID.
+func (c *Client) SubscriptionStatus(originalTransactionID string) (Info, error) {
+	return c.SubscriptionStatusContext(context.Background(), originalTransactionID)
+}
+
+// SubscriptionStatusContext is SubscriptionStatus with a context that can cancel the request
+func (c *Client) SubscriptionStatusContext(ctx context.Context,
+	originalTransactionID string) (Info, error) {
+
+	var resp statusResponse
+	if err := c.get(ctx, "/inApps/v1/subscriptions/"+url.PathEscape(originalTransactionID), nil,
+		&resp); err != nil {
+		return nil, err
+	}
+
+	for _, group := range resp.Data {
+		for _, last := range group.LastTransactions {
+			if last.OriginalTransactionID != originalTransactionID {
+				continue
+			}
+
+			info := apiInfo{status: last.Status}
+			if err := VerifyJWS(c.Roots, last.SignedTransactionInfo,
+				&info.transaction); err != nil {
+				return nil, err
+			}
+			if err := VerifyJWS(c.Roots, last.SignedRenewalInfo, &info.renewal); err != nil {
+				return nil, err
+			}
+			return info, nil
+		}
+	}
+
+	return nil, fmt.Errorf("No subscription status found for %s", originalTransactionID)
+}
+
+// TransactionInfo calls Get Transaction Info for a single transaction.
+func (c *Client) TransactionInfo(transactionID string) (JWSTransaction, error) {
+	return c.TransactionInfoContext(context.Background(), transactionID)
+}
+
+// TransactionInfoContext is TransactionInfo with a context that can cancel the request
+func (c *Client) TransactionInfoContext(ctx context.Context,
+	transactionID string) (JWSTransaction, error) {
+
+	var resp struct {
+		SignedTransactionInfo string `json:"signedTransactionInfo"`
+	}
+
+	var txn JWSTransaction
+	if err := c.get(ctx, "/inApps/v1/transactions/"+url.PathEscape(transactionID), nil,
+		&resp); err != nil {
+		return txn, err
+	}
+
+	err := VerifyJWS(c.Roots, resp.SignedTransactionInfo, &txn)
+	return txn, err
+}
+
+// apiInfo adapts App Store Server API subscription status to Info
+type apiInfo struct {
+	status      int
+	transaction JWSTransaction
+	renewal     JWSRenewalInfo
+}
+
+func (info apiInfo) Status() int {
+	switch info.status {
+	case SubscriptionExpired, SubscriptionBillingRetry, SubscriptionRevoked:
+		return StatusSubscriptionExpired
+	}
+	return StatusValid
+}
+
+func (info apiInfo) AutoRenewProduct() string {
+	return info.renewal.AutoRenewProductID
+}
+
+func (info apiInfo) AutoRenewStatus() bool {
+	return info.renewal.AutoRenewStatus == 1
+}
+
+func (info apiInfo) ExpirationIntent() int {
+	return info.renewal.ExpirationIntent
+}
+
+func (info apiInfo) GracePeriodExpiresAt() time.Time {
+	return info.renewal.GracePeriodExpiresAt()
+}
+
+func (info apiInfo) IsInBillingRetryPeriod() bool {
+	return info.renewal.IsInBillingRetryPeriod
+}
+
+func (info apiInfo) PriceConsentStatus() int {
+	return info.renewal.PriceConsent()
+}
+
+// NextPrice is what the subscription renews at, since renewal info includes it
+func (info apiInfo) NextPrice() (string, float64, bool) {
+	return info.renewal.NextPrice()
+}
+
+func (info apiInfo) OfferCodeRefName() string {
+	return info.renewal.OfferCodeRefName()
+}
+
+func (info apiInfo) PromotionalOfferID() string {
+	return info.renewal.PromotionalOfferID()
+}
+
+func (info apiInfo) CancelledAt() time.Time {
+	if info.transaction.RevocationDate != nil {
+		return info.transaction.RevocationDate.Time()
+	}
+	return time.Time{}
+}
+
+func (info apiInfo) ExpiresAt() time.Time {
+	return info.transaction.ExpiresDate.Time()
+}
+
+func (info apiInfo) IsTrialPeriod() bool {
+	return info.transaction.IsTrialPeriod()
+}
+
+func (info apiInfo) OriginalTransactionID() string {
+	return info.transaction.OriginalTransactionID
+}
+
+func (info apiInfo) OriginalPurchaseDate() time.Time {
+	return info.transaction.OriginalPurchaseDate.Time()
+}
+
+func (info apiInfo) PaidAt() time.Time {
+	return info.transaction.PurchaseDate.Time()
+}
+
+func (info apiInfo) ProductID() string {
+	return info.transaction.ProductID
+}
+
+func (info apiInfo) IsInIntroOfferPeriod() bool {
+	return info.transaction.Transaction().IsInIntroOfferPeriod
+}
+
+func (info apiInfo) OfferType() int {
+	return info.transaction.OfferType
+}
+
+func (info apiInfo) OfferIdentifier() string {
+	return info.transaction.OfferIdentifier
+}
+
+func (info apiInfo) OfferDiscountType() string {
+	return info.transaction.Transaction().OfferDiscountType
+}
+
+// Transactions only has the latest transaction, since Get All Subscription Statuses doesn't
+// include history
+func (info apiInfo) Transactions() []Transaction {
+	return []Transaction{info.transaction.Transaction()}
+}
@@ -0,0 +1,197 @@
+package receipt
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestClient(t *testing.T, chain testChain, handler http.HandlerFunc) (*Client, func()) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), ".")
+		if len(parts) != 3 {
+			t.Error("Should have sent a bearer JWT")
+		}
+
+		claimsData, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		var claims apiClaims
+		if err := json.Unmarshal(claimsData, &claims); err != nil {
+			t.Error(err)
+		} else if claims.Issuer != "issuer" || claims.BundleID != "com.example" ||
+			claims.Audience != "appstoreconnect-v1" {
+			t.Errorf("Should have sent issuer, bundle ID and audience claims: %+v", claims)
+		}
+
+		handler(w, r)
+	}))
+
+	client := NewClient("issuer", "KEY123", "com.example", key, chain.roots)
+	client.BaseURL = srv.URL
+	return client, srv.Close
+}
+
+func TestParsePrivateKey(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ParsePrivateKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	if err != nil {
+		t.Error("Should have parsed .p8 key", err)
+	} else if parsed.D.Cmp(key.D) != 0 {
+		t.Error("Should have parsed the same key")
+	}
+}
+
+func TestSubscriptionStatus(t *testing.T) {
+	chain := newTestChain(t)
+
+	client, closeServer := newTestClient(t, chain, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/inApps/v1/subscriptions/123456789012345" {
+			t.Error("Wrong path", r.URL.Path)
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": []interface{}{map[string]interface{}{
+				"subscriptionGroupIdentifier": "20000000",
+				"lastTransactions": []interface{}{map[string]interface{}{
+					"originalTransactionId": "123456789012345",
+					"status":                SubscriptionExpired,
+					"signedTransactionInfo": chain.sign(t, map[string]interface{}{
+						"originalTransactionId": "123456789012345",
+						"productId":             "year-premium",
+						"expiresDate":           1552504296000,
+					}),
+					"signedRenewalInfo": chain.sign(t, map[string]interface{}{
+						"originalTransactionId": "123456789012345",
+						"autoRenewStatus":       0,
+					}),
+				}},
+			}},
+		})
+	})
+	defer closeServer()
+
+	info, err := client.SubscriptionStatus("123456789012345")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expiresAt := time.Date(2019, time.March, 13, 19, 11, 36, 0, time.UTC)
+	if !info.ExpiresAt().Equal(expiresAt) {
+		t.Errorf("Should parse %s as %s", info.ExpiresAt(), expiresAt)
+	} else if info.Status() != StatusSubscriptionExpired {
+		t.Error("Should map expired subscription status to 21006 Expired")
+	} else if info.AutoRenewStatus() {
+		t.Error("Should parse auto renew status as off")
+	} else if info.ProductID() != "year-premium" {
+		t.Error("Should parse product ID", info.ProductID())
+	}
+}
+
+func TestTransactionHistory(t *testing.T) {
+	chain := newTestChain(t)
+
+	client, closeServer := newTestClient(t, chain, func(w http.ResponseWriter, r *http.Request) {
+		resp := historyResponse{Revision: "page2", HasMore: true}
+		if r.URL.Query().Get("revision") == "page2" {
+			resp = historyResponse{HasMore: false}
+		}
+		resp.SignedTransactions = []string{
+			chain.sign(t, map[string]string{"transactionId": r.URL.Query().Get("revision")}),
+		}
+		json.NewEncoder(w).Encode(resp)
+	})
+	defer closeServer()
+
+	transactions, err := client.TransactionHistory("123456789012345")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(transactions) != 2 {
+		t.Fatal("Should have followed revision to the second page", len(transactions))
+	} else if transactions[1].TransactionID != "page2" {
+		t.Error("Should have requested the second page by revision")
+	}
+}
+
+func TestTransactionHistoryContext(t *testing.T) {
+	chain := newTestChain(t)
+
+	requests := 0
+	client, closeServer := newTestClient(t, chain, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		json.NewEncoder(w).Encode(historyResponse{})
+	})
+	defer closeServer()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := client.TransactionHistoryContext(ctx, "123456789012345"); err == nil {
+		t.Error("Should have returned the cancelled context's error")
+	} else if requests != 0 {
+		t.Error("Should not have requested history after the context was cancelled")
+	}
+}
+
+func TestAPIError(t *testing.T) {
+	chain := newTestChain(t)
+
+	client, closeServer := newTestClient(t, chain, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"errorCode":4040010,"errorMessage":"Transaction id not found."}`))
+	})
+	defer closeServer()
+
+	_, err := client.TransactionInfo("123456789012345")
+	if apiErr, ok := err.(APIError); !ok {
+		t.Error("Should have returned APIError", err)
+	} else if apiErr.ErrorCode != 4040010 || apiErr.StatusCode != http.StatusNotFound {
+		t.Error("Should have decoded error body", apiErr)
+	}
+}
+
+func TestAPIErrorTemporary(t *testing.T) {
+	chain := newTestChain(t)
+
+	client, closeServer := newTestClient(t, chain, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"errorCode":4290000,"errorMessage":"Rate limit exceeded."}`))
+	})
+	defer closeServer()
+
+	// Without an HTTP client, requests use http.DefaultClient like Validator
+	client.HTTPClient = nil
+
+	_, err := client.TransactionInfo("123456789012345")
+	if apiErr, ok := err.(APIError); !ok || apiErr.StatusCode != http.StatusTooManyRequests {
+		t.Error("Should have requested with the default HTTP client", err)
+	} else if !IsTransient(err) {
+		t.Error("Should have been a temporary error", err)
+	}
+
+	for status, transient := range map[int]bool{500: true, 503: true, 401: false, 404: false} {
+		if IsTransient(APIError{StatusCode: status}) != transient {
+			t.Error("Should have classified HTTP status", status)
+		}
+	}
+}
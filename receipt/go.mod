@@ -1,3 +0,0 @@
-module github.com/carpenterscode/superscribe/receipt
-
-go 1.12
@@ -0,0 +1,251 @@
+package receipt
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// App Store Server API and App Store Server Notifications V2 deliver transaction and renewal
+// data as JWS compact serializations signed with ES256, where the x5c header carries the
+// signing certificate chain issued by Apple Root CA - G3.
+// https://developer.apple.com/documentation/appstoreserverapi/jwstransaction
+
+// Offer types used by signed transactions and renewal info
+const (
+	OfferTypeIntroductory = 1
+	OfferTypePromotional  = 2
+	OfferTypeOfferCode    = 3
+)
+
+// Offer discount types, which tell how a customer pays during an offer
+const (
+	OfferDiscountFreeTrial  = "FREE_TRIAL"
+	OfferDiscountPayAsYouGo = "PAY_AS_YOU_GO"
+	OfferDiscountPayUpFront = "PAY_UP_FRONT"
+)
+
+// JWSTransaction is the decoded payload of a signedTransactionInfo.
+type JWSTransaction struct {
+	AppAccountToken             string      `json:"appAccountToken"`
+	BundleID                    string      `json:"bundleId"`
+	Environment                 string      `json:"environment"`
+	ExpiresDate                 Millistamp  `json:"expiresDate"`
+	InAppOwnershipType          string      `json:"inAppOwnershipType"`
+	IsUpgraded                  bool        `json:"isUpgraded"`
+	OfferDiscountType           string      `json:"offerDiscountType"`
+	OfferIdentifier             string      `json:"offerIdentifier"`
+	OfferType                   int         `json:"offerType"`
+	OriginalPurchaseDate        Millistamp  `json:"originalPurchaseDate"`
+	OriginalTransactionID       string      `json:"originalTransactionId"`
+	ProductID                   string      `json:"productId"`
+	PurchaseDate                Millistamp  `json:"purchaseDate"`
+	Quantity                    int         `json:"quantity"`
+	RevocationDate              *Millistamp `json:"revocationDate,omitempty"`
+	RevocationReason            *int        `json:"revocationReason,omitempty"`
+	SignedDate                  Millistamp  `json:"signedDate"`
+	Storefront                  string      `json:"storefront"`
+	SubscriptionGroupIdentifier string      `json:"subscriptionGroupIdentifier"`
+	TransactionID               string      `json:"transactionId"`
+	Type                        string      `json:"type"`
+	WebOrderLineItemID          string      `json:"webOrderLineItemId"`
+}
+
+// IsTrialPeriod reports whether the transaction is a free trial introductory offer.
+func (t JWSTransaction) IsTrialPeriod() bool {
+	return t.OfferType == OfferTypeIntroductory &&
+		(t.OfferDiscountType == "" || t.OfferDiscountType == OfferDiscountFreeTrial)
+}
+
+// JWSRenewalInfo is the decoded payload of a signedRenewalInfo.
+type JWSRenewalInfo struct {
+	AutoRenewProductID          string     `json:"autoRenewProductId"`
+	AutoRenewStatus             int        `json:"autoRenewStatus"`
+	Currency                    string     `json:"currency"`
+	Environment                 string     `json:"environment"`
+	ExpirationIntent            int        `json:"expirationIntent"`
+	GracePeriodExpiresDate      Millistamp `json:"gracePeriodExpiresDate"`
+	IsInBillingRetryPeriod      bool       `json:"isInBillingRetryPeriod"`
+	OfferIdentifier             string     `json:"offerIdentifier"`
+	OfferType                   int        `json:"offerType"`
+	OriginalTransactionID       string     `json:"originalTransactionId"`
+	PriceIncreaseStatus         *int       `json:"priceIncreaseStatus,omitempty"`
+	ProductID                   string     `json:"productId"`
+	RecentSubscriptionStartDate Millistamp `json:"recentSubscriptionStartDate"`
+	RenewalPrice                int64      `json:"renewalPrice"`
+	SignedDate                  Millistamp `json:"signedDate"`
+}
+
+// GracePeriodExpiresAt is zero unless the subscription entered a billing grace period.
+func (r JWSRenewalInfo) GracePeriodExpiresAt() time.Time {
+	if r.GracePeriodExpiresDate == 0 {
+		return time.Time{}
+	}
+	return r.GracePeriodExpiresDate.Time()
+}
+
+// NextPrice is what the subscription renews at in Currency, which renewalPrice gives in
+// milliunits. It's false when the renewal info doesn't include a price.
+func (r JWSRenewalInfo) NextPrice() (string, float64, bool) {
+	if r.Currency == "" {
+		return "", 0, false
+	}
+	return r.Currency, float64(r.RenewalPrice) / 1000, true
+}
+
+// PriceConsent is PriceConsentNone unless a price increase is pending
+func (r JWSRenewalInfo) PriceConsent() int {
+	if r.PriceIncreaseStatus == nil {
+		return PriceConsentNone
+	}
+	return *r.PriceIncreaseStatus
+}
+
+// OfferCodeRefName is the offer code the subscription will renew with, if any
+func (r JWSRenewalInfo) OfferCodeRefName() string {
+	if r.OfferType != OfferTypeOfferCode {
+		return ""
+	}
+	return r.OfferIdentifier
+}
+
+// PromotionalOfferID is the promotional offer the subscription will renew with, if any
+func (r JWSRenewalInfo) PromotionalOfferID() string {
+	if r.OfferType != OfferTypePromotional {
+		return ""
+	}
+	return r.OfferIdentifier
+}
+
+type jwsHeader struct {
+	Alg string   `json:"alg"`
+	X5C []string `json:"x5c"`
+}
+
+var ErrInvalidSignature = errors.New("JWS signature could not be verified")
+
+// VerifyJWS checks that token is an ES256 JWS whose x5c certificate chain leads to one of roots,
+// then decodes its payload into v. Passing nil roots fails verification rather than trusting
+// the system pool, which does not include Apple Root CA - G3.
+func VerifyJWS(roots *x509.CertPool, token string, v interface{}) error {
+
+	if roots == nil {
+		return errors.New("Apple root certificates should have been configured")
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("JWS should have 3 parts but has %d", len(parts))
+	}
+
+	headerData, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return err
+	}
+
+	var header jwsHeader
+	if err := json.Unmarshal(headerData, &header); err != nil {
+		return err
+	}
+
+	if header.Alg != "ES256" {
+		return fmt.Errorf("JWS alg should be ES256 but is %q", header.Alg)
+	}
+	if len(header.X5C) == 0 {
+		return errors.New("JWS x5c header should have contained a certificate chain")
+	}
+
+	certs := make([]*x509.Certificate, len(header.X5C))
+	for i, encoded := range header.X5C {
+		der, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return err
+		}
+		if certs[i], err = x509.ParseCertificate(der); err != nil {
+			return err
+		}
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	if _, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return err
+	}
+
+	publicKey, ok := certs[0].PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return errors.New("JWS signing certificate should have an ECDSA public key")
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return err
+	}
+	if len(sig) != 64 {
+		return ErrInvalidSignature
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r := new(big.Int).SetBytes(sig[:32])
+	s := new(big.Int).SetBytes(sig[32:])
+	if !ecdsa.Verify(publicKey, digest[:], r, s) {
+		return ErrInvalidSignature
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(payload, v)
+}
+
+// signES256 produces a compact JWS, as used for App Store Server API bearer tokens
+func signES256(key *ecdsa.PrivateKey, header, claims interface{}) (string, error) {
+
+	if key == nil {
+		return "", errors.New("Signing key should have been set")
+	}
+
+	headerData, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+
+	claimsData, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(headerData) + "." +
+		base64.RawURLEncoding.EncodeToString(claimsData)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	// ES256 signatures are the fixed-width concatenation of r and s
+	sig := make([]byte, 64)
+	rBytes, sBytes := r.Bytes(), s.Bytes()
+	copy(sig[32-len(rBytes):32], rBytes)
+	copy(sig[64-len(sBytes):], sBytes)
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
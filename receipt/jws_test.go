@@ -0,0 +1,148 @@
+package receipt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testChain struct {
+	roots *x509.CertPool
+	key   *ecdsa.PrivateKey
+	x5c   []string
+}
+
+func newTestCertificate(t *testing.T, serial int64, template *x509.Certificate,
+	parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template.SerialNumber = big.NewInt(serial)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// newTestChain generates a root, intermediate and leaf resembling Apple's signing chain
+func newTestChain(t *testing.T) testChain {
+	root, rootKey := newTestCertificate(t, 1, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Test Root CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+
+	intermediate, intermediateKey := newTestCertificate(t, 2, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Test Intermediate CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, root, rootKey)
+
+	leaf, leafKey := newTestCertificate(t, 3, &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "Test Signing"},
+		KeyUsage: x509.KeyUsageDigitalSignature,
+	}, intermediate, intermediateKey)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+
+	return testChain{
+		roots: roots,
+		key:   leafKey,
+		x5c: []string{
+			base64.StdEncoding.EncodeToString(leaf.Raw),
+			base64.StdEncoding.EncodeToString(intermediate.Raw),
+			base64.StdEncoding.EncodeToString(root.Raw),
+		},
+	}
+}
+
+func (c testChain) sign(t *testing.T, payload interface{}) string {
+	token, err := signES256(c.key, jwsHeader{Alg: "ES256", X5C: c.x5c}, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestVerifyJWS(t *testing.T) {
+	chain := newTestChain(t)
+
+	token := chain.sign(t, map[string]interface{}{
+		"originalTransactionId": "123456789012345",
+		"productId":             "year-premium",
+		"expiresDate":           1552504296000,
+		"offerType":             OfferTypeIntroductory,
+	})
+
+	var txn JWSTransaction
+	if err := VerifyJWS(chain.roots, token, &txn); err != nil {
+		t.Fatal("Should have verified JWS", err)
+	}
+
+	expiresAt := time.Date(2019, time.March, 13, 19, 11, 36, 0, time.UTC)
+	if txn.OriginalTransactionID != "123456789012345" {
+		t.Error("Should have decoded original transaction ID", txn.OriginalTransactionID)
+	} else if !txn.ExpiresDate.Time().Equal(expiresAt) {
+		t.Errorf("Should parse %s as %s", txn.ExpiresDate.Time(), expiresAt)
+	} else if !txn.IsTrialPeriod() {
+		t.Error("Should have treated introductory offer as trial period")
+	}
+}
+
+func TestVerifyJWSUntrustedRoot(t *testing.T) {
+	chain := newTestChain(t)
+	other := newTestChain(t)
+
+	token := chain.sign(t, map[string]string{"productId": "year-premium"})
+
+	var txn JWSTransaction
+	if err := VerifyJWS(other.roots, token, &txn); err == nil {
+		t.Error("Should have rejected chain from untrusted root")
+	}
+	if err := VerifyJWS(nil, token, &txn); err == nil {
+		t.Error("Should have rejected JWS without configured roots")
+	}
+}
+
+func TestVerifyJWSTamperedPayload(t *testing.T) {
+	chain := newTestChain(t)
+
+	token := chain.sign(t, map[string]string{"productId": "year-premium"})
+	forged := chain.sign(t, map[string]string{"productId": "lifetime-premium"})
+
+	// Splice the forged payload into the original signature
+	parts := strings.Split(token, ".")
+	forgedParts := strings.Split(forged, ".")
+	tampered := parts[0] + "." + forgedParts[1] + "." + parts[2]
+
+	var txn JWSTransaction
+	if err := VerifyJWS(chain.roots, tampered, &txn); err != ErrInvalidSignature {
+		t.Error("Should have rejected tampered payload", err)
+	}
+}
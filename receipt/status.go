@@ -1,5 +1,10 @@
 package receipt
 
+import (
+	"fmt"
+	"net/http"
+)
+
 // https://developer.apple.com/library/archive/releasenotes/General/ValidateAppStoreReceipt/Chapters/ValidateRemotely.html#//apple_ref/doc/uid/TP40010573-CH104-SW1
 const (
 	StatusValid               = 0
@@ -11,5 +16,146 @@ const (
 	StatusSubscriptionExpired = 21006
 	StatusReceiptFromTest     = 21007
 	StatusReceiptFromProd     = 21008
+	StatusInternalDataAccess  = 21009
 	StatusUnauthorized        = 21010
 )
+
+// Statuses 21100-21199 are internal data access errors, which are worth retrying
+const (
+	StatusInternalErrorMin = 21100
+	StatusInternalErrorMax = 21199
+)
+
+// StatusError is a verifyReceipt response whose status means the receipt couldn't be validated
+type StatusError struct {
+	Status int
+}
+
+func (err StatusError) Error() string {
+	return fmt.Sprintf("App Store status %d: %s", err.Status, statusMessage(err.Status))
+}
+
+// Temporary reports whether the App Store may validate the receipt if asked again later
+func (err StatusError) Temporary() bool {
+	switch err.Status {
+	case StatusUnreadable, StatusUnreachable, StatusInternalDataAccess:
+		return true
+	}
+	return err.Status >= StatusInternalErrorMin && err.Status <= StatusInternalErrorMax
+}
+
+// Permanent reports whether the receipt will never validate, such as when it's malformed or the
+// customer's account no longer exists
+func (err StatusError) Permanent() bool {
+	switch err.Status {
+	case StatusReceiptMalformed, StatusNotAuthenticated, StatusUnauthorized:
+		return true
+	}
+	return false
+}
+
+// Configuration reports whether every receipt will fail until the shared secret is fixed
+func (err StatusError) Configuration() bool {
+	return err.Status == StatusMismatchedSecret
+}
+
+// EnvironmentMismatch reports whether the receipt was sent to the wrong verifyReceipt endpoint
+func (err StatusError) EnvironmentMismatch() bool {
+	return err.Status == StatusReceiptFromTest || err.Status == StatusReceiptFromProd
+}
+
+// HTTPError is a verifyReceipt response that wasn't 200 OK, so it has no status to parse
+type HTTPError struct {
+	StatusCode int
+}
+
+func (err HTTPError) Error() string {
+	return fmt.Sprintf("verifyReceipt responded %d %s", err.StatusCode,
+		http.StatusText(err.StatusCode))
+}
+
+// Temporary reports whether the App Store was throttling requests or failing, so it may respond
+// if asked again later
+func (err HTTPError) Temporary() bool {
+	return err.StatusCode == http.StatusTooManyRequests || err.StatusCode >= 500
+}
+
+// IsTransient reports whether err may succeed if the receipt is validated again later, which
+// includes network errors as well as temporary App Store statuses and HTTP errors
+func IsTransient(err error) bool {
+	temporary, ok := err.(interface{ Temporary() bool })
+	return ok && temporary.Temporary()
+}
+
+// IsPermanent reports whether err is a StatusError for a receipt that will never validate
+func IsPermanent(err error) bool {
+	statusErr, ok := err.(StatusError)
+	return ok && statusErr.Permanent()
+}
+
+// IsConfiguration reports whether err is a StatusError caused by a wrong shared secret
+func IsConfiguration(err error) bool {
+	statusErr, ok := err.(StatusError)
+	return ok && statusErr.Configuration()
+}
+
+// IsEnvironmentMismatch reports whether err is a StatusError for a receipt sent to the wrong
+// environment
+func IsEnvironmentMismatch(err error) bool {
+	statusErr, ok := err.(StatusError)
+	return ok && statusErr.EnvironmentMismatch()
+}
+
+func statusMessage(status int) string {
+	switch status {
+	case StatusUnreadable:
+		return "The App Store could not read the JSON object you provided."
+	case StatusReceiptMalformed:
+		return "The data in the receipt-data property was malformed or missing."
+	case StatusNotAuthenticated:
+		return "The receipt could not be authenticated."
+	case StatusMismatchedSecret:
+		return "The shared secret you provided does not match the shared secret on file for your account."
+	case StatusUnreachable:
+		return "The receipt server is not currently available."
+	case StatusSubscriptionExpired:
+		return "This receipt is valid but the subscription has expired."
+	case StatusReceiptFromTest:
+		return "This receipt is from the test environment, but it was sent to the production environment for verification. Send it to the test environment instead."
+	case StatusReceiptFromProd:
+		return "This receipt is from the production environment, but it was sent to the test environment for verification. Send it to the production environment instead."
+	case StatusInternalDataAccess:
+		return "Internal data access error. Try again later."
+	case StatusUnauthorized:
+		return "The user account cannot be found or has been deleted."
+	}
+	if status >= StatusInternalErrorMin && status <= StatusInternalErrorMax {
+		return "Internal data access error."
+	}
+	return ""
+}
+
+// Reasons a transaction was refunded, from cancellation_reason or revocationReason
+const (
+	CancellationReasonOther    = 0
+	CancellationReasonAppIssue = 1
+)
+
+// Whether the customer agreed to a price increase, from pending_renewal_info
+// price_consent_status or priceIncreaseStatus. Declining expires the subscription with
+// ExpirationIntentPriceIncreaseDeclined.
+const (
+	PriceConsentNone     = -1
+	PriceConsentPending  = 0
+	PriceConsentAccepted = 1
+)
+
+// Reasons a subscription expired, from pending_renewal_info expiration_intent
+// https://developer.apple.com/documentation/appstorereceipts/expiration_intent
+const (
+	ExpirationIntentCancelled             = 1
+	ExpirationIntentBillingError          = 2
+	ExpirationIntentPriceIncreaseDeclined = 3
+	ExpirationIntentProductUnavailable    = 4
+	ExpirationIntentUnknown               = 5
+)
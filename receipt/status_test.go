@@ -0,0 +1,52 @@
+package receipt
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestStatusErrorClassification(t *testing.T) {
+	cases := []struct {
+		status                                        int
+		transient, permanent, configuration, mismatch bool
+	}{
+		{StatusUnreadable, true, false, false, false},
+		{StatusReceiptMalformed, false, true, false, false},
+		{StatusNotAuthenticated, false, true, false, false},
+		{StatusMismatchedSecret, false, false, true, false},
+		{StatusUnreachable, true, false, false, false},
+		{StatusReceiptFromTest, false, false, false, true},
+		{StatusReceiptFromProd, false, false, false, true},
+		{StatusInternalDataAccess, true, false, false, false},
+		{StatusUnauthorized, false, true, false, false},
+		{21100, true, false, false, false},
+		{21199, true, false, false, false},
+	}
+
+	for _, c := range cases {
+		var err error = StatusError{c.status}
+		if IsTransient(err) != c.transient || IsPermanent(err) != c.permanent ||
+			IsConfiguration(err) != c.configuration || IsEnvironmentMismatch(err) != c.mismatch {
+			t.Error("Should have classified status", c.status)
+		}
+	}
+
+	for status, transient := range map[int]bool{429: true, 500: true, 503: true, 400: false,
+		401: false} {
+
+		if IsTransient(HTTPError{status}) != transient || IsPermanent(HTTPError{status}) {
+			t.Error("Should have classified HTTP status", status)
+		}
+	}
+
+	if IsTransient(errors.New("other")) || IsPermanent(errors.New("other")) {
+		t.Error("Should not have classified other errors")
+	}
+}
+
+func TestParseStatusError(t *testing.T) {
+	_, err := parseReceiptResponse([]byte(`{"status":21010}`))
+	if statusErr, ok := err.(StatusError); !ok || statusErr.Status != StatusUnauthorized {
+		t.Error("Should have returned StatusError", err)
+	}
+}
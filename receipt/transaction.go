@@ -0,0 +1,128 @@
+package receipt
+
+import (
+	"sort"
+	"time"
+)
+
+// Transaction is one purchase or renewal of a subscription, whichever API it came from
+type Transaction struct {
+	TransactionID         string
+	OriginalTransactionID string
+	WebOrderLineItemID    string
+	ProductID             string
+
+	// Storefront is the App Store country code, like USA, which only signed transactions have
+	Storefront string
+
+	PurchasedAt         time.Time
+	OriginalPurchasedAt time.Time
+	ExpiresAt           time.Time
+
+	IsTrialPeriod        bool
+	IsInIntroOfferPeriod bool
+
+	// OfferType is one of the OfferType constants, or 0 without an offer. OfferIdentifier is the
+	// promotional offer ID or offer code reference name.
+	OfferType         int
+	OfferIdentifier   string
+	OfferDiscountType string
+
+	// IsUpgraded is set on a transaction cancelled by upgrading to a higher level subscription
+	IsUpgraded bool
+
+	// CancelledAt is when Apple refunded the transaction, and CancellationReason is only
+	// meaningful then
+	CancelledAt        time.Time
+	CancellationReason int
+}
+
+func (body ReceiptInfoBody) Transaction() Transaction {
+	txn := Transaction{
+		TransactionID:         body.TransactionID,
+		OriginalTransactionID: body.OriginalTransactionID,
+		WebOrderLineItemID:    body.WebOrderLineItemID,
+		ProductID:             body.ProductID,
+		PurchasedAt:           body.PurchaseDate.Time(),
+		OriginalPurchasedAt:   body.OriginalPurchaseDate.Time(),
+		ExpiresAt:             body.ExpiresDate.Time(),
+		IsTrialPeriod:         body.IsTrialPeriod,
+		IsInIntroOfferPeriod:  body.IsInIntroOfferPeriod,
+		IsUpgraded:            body.IsUpgraded,
+	}
+
+	// verifyReceipt only tells free trials from other intro offers, and offer codes and
+	// promotional offers can be free trials too
+	if body.IsTrialPeriod {
+		txn.OfferDiscountType = OfferDiscountFreeTrial
+	}
+	switch {
+	case body.OfferCodeRefName != "":
+		txn.OfferType = OfferTypeOfferCode
+		txn.OfferIdentifier = body.OfferCodeRefName
+	case body.PromotionalOfferID != "":
+		txn.OfferType = OfferTypePromotional
+		txn.OfferIdentifier = body.PromotionalOfferID
+	case body.IsTrialPeriod || body.IsInIntroOfferPeriod:
+		txn.OfferType = OfferTypeIntroductory
+	}
+
+	if body.CancellationDate != nil {
+		txn.CancelledAt = body.CancellationDate.Time()
+		txn.CancellationReason = body.CancellationReason
+	}
+	return txn
+}
+
+func (t JWSTransaction) Transaction() Transaction {
+	txn := Transaction{
+		TransactionID:         t.TransactionID,
+		OriginalTransactionID: t.OriginalTransactionID,
+		WebOrderLineItemID:    t.WebOrderLineItemID,
+		ProductID:             t.ProductID,
+		Storefront:            t.Storefront,
+		PurchasedAt:           t.PurchaseDate.Time(),
+		OriginalPurchasedAt:   t.OriginalPurchaseDate.Time(),
+		ExpiresAt:             t.ExpiresDate.Time(),
+		IsTrialPeriod:         t.IsTrialPeriod(),
+		IsInIntroOfferPeriod:  t.OfferType == OfferTypeIntroductory && !t.IsTrialPeriod(),
+		IsUpgraded:            t.IsUpgraded,
+		OfferType:             t.OfferType,
+		OfferIdentifier:       t.OfferIdentifier,
+		OfferDiscountType:     t.OfferDiscountType,
+	}
+	if t.IsTrialPeriod() {
+		txn.OfferDiscountType = OfferDiscountFreeTrial
+	}
+	if t.RevocationDate != nil {
+		txn.CancelledAt = t.RevocationDate.Time()
+	}
+	if t.RevocationReason != nil {
+		txn.CancellationReason = *t.RevocationReason
+	}
+	return txn
+}
+
+// transactions converts bodies oldest first
+func transactions(bodies []ReceiptInfoBody) []Transaction {
+	list := make([]Transaction, len(bodies))
+	for i, body := range bodies {
+		list[i] = body.Transaction()
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].PurchasedAt.Before(list[j].PurchasedAt)
+	})
+	return list
+}
+
+// TransactionsFromJWS converts the signed transactions of Client.TransactionHistory oldest first
+func TransactionsFromJWS(signed []JWSTransaction) []Transaction {
+	list := make([]Transaction, len(signed))
+	for i, txn := range signed {
+		list[i] = txn.Transaction()
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].PurchasedAt.Before(list[j].PurchasedAt)
+	})
+	return list
+}
@@ -0,0 +1,46 @@
+package receipt
+
+import (
+	"testing"
+)
+
+func TestTransactionOffer(t *testing.T) {
+	cases := []struct {
+		name         string
+		txn          Transaction
+		offerType    int
+		identifier   string
+		discountType string
+	}{
+		{"full price", ReceiptInfoBody{}.Transaction(), 0, "", ""},
+		{"free trial", ReceiptInfoBody{IsTrialPeriod: true}.Transaction(),
+			OfferTypeIntroductory, "", OfferDiscountFreeTrial},
+		{"intro offer", ReceiptInfoBody{IsInIntroOfferPeriod: true}.Transaction(),
+			OfferTypeIntroductory, "", ""},
+		{"promotional offer", ReceiptInfoBody{PromotionalOfferID: "winback"}.Transaction(),
+			OfferTypePromotional, "winback", ""},
+		{"offer code trial", ReceiptInfoBody{OfferCodeRefName: "SUMMER2019",
+			IsTrialPeriod: true}.Transaction(),
+			OfferTypeOfferCode, "SUMMER2019", OfferDiscountFreeTrial},
+		{"signed pay up front", JWSTransaction{OfferType: OfferTypeIntroductory,
+			OfferDiscountType: OfferDiscountPayUpFront}.Transaction(),
+			OfferTypeIntroductory, "", OfferDiscountPayUpFront},
+		{"signed offer code", JWSTransaction{OfferType: OfferTypeOfferCode,
+			OfferIdentifier: "SUMMER2019", OfferDiscountType: OfferDiscountPayAsYouGo}.Transaction(),
+			OfferTypeOfferCode, "SUMMER2019", OfferDiscountPayAsYouGo},
+	}
+
+	for _, c := range cases {
+		if c.txn.OfferType != c.offerType || c.txn.OfferIdentifier != c.identifier ||
+			c.txn.OfferDiscountType != c.discountType {
+			t.Errorf("Should have parsed %s offer as %d %q %q, got %d %q %q", c.name,
+				c.offerType, c.identifier, c.discountType, c.txn.OfferType,
+				c.txn.OfferIdentifier, c.txn.OfferDiscountType)
+		}
+	}
+
+	if txn := (JWSTransaction{OfferType: OfferTypeIntroductory,
+		OfferDiscountType: OfferDiscountPayAsYouGo}).Transaction(); !txn.IsInIntroOfferPeriod {
+		t.Error("Should have been in a pay as you go intro offer period")
+	}
+}
@@ -1,9 +1,8 @@
 package receipt
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -15,6 +14,7 @@ import (
 
 type Info interface {
 	Status() int
+	AutoRenewProduct() string
 	AutoRenewStatus() bool
 	CancelledAt() time.Time
 	ExpiresAt() time.Time
@@ -23,9 +23,36 @@ type Info interface {
 	OriginalPurchaseDate() time.Time
 	PaidAt() time.Time
 	ProductID() string
+
+	// Transactions lists the known purchases and renewals oldest first, including refunded and
+	// upgraded ones. verifyReceipt only returns the full history when ExcludeOldTransactions is
+	// false; other sources may only know the latest one.
+	Transactions() []Transaction
+
+	// Billing state from pending renewal info, set once a renewal has been attempted
+	ExpirationIntent() int
+	GracePeriodExpiresAt() time.Time
+	IsInBillingRetryPeriod() bool
+
+	// PriceConsentStatus is PriceConsentNone unless a price increase awaits the customer's consent
+	PriceConsentStatus() int
+
+	// Offers the subscription will renew with, if the customer redeemed an offer code or
+	// promotional offer
+	OfferCodeRefName() string
+	PromotionalOfferID() string
+
+	// Offer in effect for the latest transaction. OfferIdentifier is the promotional offer ID or
+	// offer code reference name, and OfferDiscountType is only known for intro offers from the
+	// App Store Server API and V2 notifications, other than free trials.
+	IsInIntroOfferPeriod() bool
+	OfferType() int
+	OfferIdentifier() string
+	OfferDiscountType() string
 }
 
 type receipt interface {
+	Transaction() Transaction
 	ExpiresAt() time.Time
 	IsTrialPeriod() bool
 	OriginalTransactionID() string
@@ -42,8 +69,14 @@ type ReceiptInfoBody struct {
 	PurchaseDate          Millistamp  `json:"purchase_date_ms,string"`
 	OriginalPurchaseDate  Millistamp  `json:"original_purchase_date_ms,string"`
 	CancellationDate      *Millistamp `json:"cancellation_date_ms,string,omitempty"`
+	CancellationReason    int         `json:"cancellation_reason,string"`
 	IsTrialPeriod         bool        `json:"is_trial_period,string"`
+	IsInIntroOfferPeriod  bool        `json:"is_in_intro_offer_period,string"`
+	IsUpgraded            bool        `json:"is_upgraded,string"`
 	ExpiresDate           Millistamp  `json:"expires_date_ms,string"`
+	WebOrderLineItemID    string      `json:"web_order_line_item_id"`
+	OfferCodeRefName      string      `json:"offer_code_ref_name"`
+	PromotionalOfferID    string      `json:"promotional_offer_id"`
 
 	InApp []ReceiptInfoBody `json:"in_app,omitempty"`
 }
@@ -69,7 +102,8 @@ func (info receiptInfo) ProductID() string {
 }
 
 type response struct {
-	info receipt
+	info         receipt
+	transactions []Transaction
 
 	AutoRenewStatus          int             `json:"auto_renew_status"`
 	CancellationDate         *Millistamp     `json:"cancellation_date_ms,string,omitempty"`
@@ -79,7 +113,8 @@ type response struct {
 	Status                   int             `json:"status"`
 
 	PendingRenewalInfo json.RawMessage `json:"pending_renewal_info"`
-	renewalInfo        renewalInfo
+	renewalInfo        RenewalInfoBody
+	hasRenewalInfo     bool
 }
 
 type validation struct {
@@ -89,11 +124,55 @@ type validation struct {
 	price    float64
 }
 
+// HasRenewalInfo is false when pending_renewal_info had no entry for the subscription, so its
+// auto-renew, billing and price consent state are unknown
+func (v validation) HasRenewalInfo() bool {
+	return v.response.hasRenewalInfo
+}
+
+func (v validation) AutoRenewProduct() string {
+	return v.response.renewalInfo.AutoRenewProductID
+}
+
 func (v validation) AutoRenewStatus() bool {
 	return v.response.renewalInfo.AutoRenewStatus == 1
 }
 
+func (v validation) ExpirationIntent() int {
+	return v.response.renewalInfo.ExpirationIntent
+}
+
+func (v validation) GracePeriodExpiresAt() time.Time {
+	if v.response.renewalInfo.GracePeriodExpiresDate != nil {
+		return v.response.renewalInfo.GracePeriodExpiresDate.Time()
+	}
+	return time.Time{}
+}
+
+func (v validation) IsInBillingRetryPeriod() bool {
+	return v.response.renewalInfo.IsInBillingRetryPeriod == 1
+}
+
+func (v validation) PriceConsentStatus() int {
+	return v.response.renewalInfo.PriceConsent()
+}
+
+func (v validation) OfferCodeRefName() string {
+	return v.response.renewalInfo.OfferCodeRefName
+}
+
+func (v validation) PromotionalOfferID() string {
+	return v.response.renewalInfo.PromotionalOfferID
+}
+
+// CancelledAt is when Apple refunded the latest transaction. Only iOS 6 style responses have a
+// top-level cancellation date.
 func (v validation) CancelledAt() time.Time {
+	if v.response.info != nil {
+		if cancelledAt := v.response.info.Transaction().CancelledAt; !cancelledAt.IsZero() {
+			return cancelledAt
+		}
+	}
 	if v.response.CancellationDate != nil {
 		return v.response.CancellationDate.Time()
 	}
@@ -124,6 +203,26 @@ func (v validation) ProductID() string {
 	return v.response.info.ProductID()
 }
 
+func (v validation) IsInIntroOfferPeriod() bool {
+	return v.response.info.Transaction().IsInIntroOfferPeriod
+}
+
+func (v validation) OfferType() int {
+	return v.response.info.Transaction().OfferType
+}
+
+func (v validation) OfferIdentifier() string {
+	return v.response.info.Transaction().OfferIdentifier
+}
+
+func (v validation) OfferDiscountType() string {
+	return v.response.info.Transaction().OfferDiscountType
+}
+
+func (v validation) Transactions() []Transaction {
+	return v.response.transactions
+}
+
 func (v validation) Status() int {
 	return v.response.Status
 }
@@ -134,33 +233,48 @@ func (v validation) HasError() bool {
 }
 
 func (v validation) Error() string {
-	r := v.response
-	switch r.Status {
-	case StatusUnreadable:
-		return "The App Store could not read the JSON object you provided."
-	case StatusReceiptMalformed:
-		return "The data in the receipt-data property was malformed or missing."
-	case StatusNotAuthenticated:
-		return "The receipt could not be authenticated."
-	case StatusMismatchedSecret:
-		return "The shared secret you provided does not match the shared secret on file for your account."
-	case StatusUnreachable:
-		return "The receipt server is not currently available."
-	case StatusSubscriptionExpired:
-		return "This receipt is valid but the subscription has expired."
-	case StatusReceiptFromTest:
-		return "This receipt is from the test environment, but it was sent to the production environment for verification. Send it to the test environment instead."
-	case StatusReceiptFromProd:
-		return "This receipt is from the production environment, but it was sent to the test environment for verification. Send it to the production environment instead."
-	default:
-		return ""
+	return statusMessage(v.response.Status)
+}
+
+// RenewalInfoBody is one pending_renewal_info entry, as found in both verifyReceipt responses
+// and unified_receipt of notifications
+type RenewalInfoBody struct {
+	AutoRenewStatus        int         `json:"auto_renew_status,string"`
+	AutoRenewProductID     string      `json:"auto_renew_product_id"`
+	ExpirationIntent       int         `json:"expiration_intent,string"`
+	GracePeriodExpiresDate *Millistamp `json:"grace_period_expires_date_ms,string,omitempty"`
+	IsInBillingRetryPeriod int         `json:"is_in_billing_retry_period,string"`
+	OfferCodeRefName       string      `json:"offer_code_ref_name"`
+	OriginalTransactionID  string      `json:"original_transaction_id"`
+	PriceConsentStatus     *int        `json:"price_consent_status,string,omitempty"`
+	ProductID              string      `json:"product_id"`
+	PromotionalOfferID     string      `json:"promotional_offer_id"`
+}
+
+// PriceConsent is PriceConsentNone when price_consent_status was left out because no price
+// increase is pending
+func (body RenewalInfoBody) PriceConsent() int {
+	if body.PriceConsentStatus == nil {
+		return PriceConsentNone
 	}
+	return *body.PriceConsentStatus
 }
 
-type renewalInfo struct {
-	AutoRenewStatus    int    `json:"auto_renew_status,string"`
-	AutoRenewProductID string `json:"auto_renew_product_id"`
-	ProductID          string `json:"product_id"`
+// renewalInfoFor finds the pending_renewal_info entry for originalTransactionID. A response with
+// only one subscription falls back to its first entry, in case the ID was left out. Otherwise
+// renewal info is unknown, rather than auto-renew being off.
+func renewalInfoFor(pending []RenewalInfoBody, originalTransactionID string,
+	only bool) (RenewalInfoBody, bool) {
+
+	for _, info := range pending {
+		if info.OriginalTransactionID == originalTransactionID {
+			return info, true
+		}
+	}
+	if only && len(pending) > 0 {
+		return pending[0], true
+	}
+	return RenewalInfoBody{}, false
 }
 
 // These structs model the receipt data from Apple
@@ -176,6 +290,10 @@ type IOS6ReceiptInfo struct {
 	body ReceiptInfoBody
 }
 
+func (info IOS6ReceiptInfo) Transaction() Transaction {
+	return info.body.Transaction()
+}
+
 func (info IOS6ReceiptInfo) ExpiresAt() time.Time {
 	return info.body.ExpiresDate.Time()
 }
@@ -204,6 +322,10 @@ type modernReceiptInfo struct {
 	body ReceiptInfoBody
 }
 
+func (info modernReceiptInfo) Transaction() Transaction {
+	return info.body.Transaction()
+}
+
 func (info modernReceiptInfo) ExpiresAt() time.Time {
 	return info.body.ExpiresDate.Time()
 }
@@ -228,73 +350,33 @@ func (info modernReceiptInfo) ProductID() string {
 	return info.body.ProductID
 }
 
+// verifyReceipt endpoints. Receipts from TestFlight and Xcode only validate against SandboxURL.
 const (
-	sandboxURL    = "https://sandbox.itunes.apple.com/verifyReceipt"
-	productionURL = "https://buy.itunes.apple.com/verifyReceipt"
+	SandboxURL    = "https://sandbox.itunes.apple.com/verifyReceipt"
+	ProductionURL = "https://buy.itunes.apple.com/verifyReceipt"
 )
 
-var fromTestEnvError = errors.New("Test receipt should be retrieved from prod endpoint")
-
+// Validate verifies a receipt with the default Validator for secret
 func Validate(secret, receipt string) (Info, error) {
+	return NewValidator(secret).Validate(receipt)
+}
 
-	if secret == "" {
-		return nil, errors.New("itunes.appSharedSecret should have been set")
-	}
-
-	req := VerifyReceiptRequest{
-		ReceiptData:            receipt,
-		Password:               secret,
-		ExcludeOldTransactions: true,
-	}
-
-	buf := new(bytes.Buffer)
-
-	encoder := json.NewEncoder(buf)
-	if encodeErr := encoder.Encode(&req); encodeErr != nil {
-		log.Println("Should have encoded verifyReceipt request", receipt)
-		return nil, encodeErr
-	}
+// ValidateContext is Validate with a context that can cancel the verifyReceipt requests
+func ValidateContext(ctx context.Context, secret, receipt string) (Info, error) {
+	return NewValidator(secret).ValidateContext(ctx, receipt)
+}
 
-	// Copy encoded data to a bytes.Reader to support multiple read passes
-	postData := bytes.NewReader(buf.Bytes())
+func sendReceiptRequest(ctx context.Context, client *http.Client, verifyUrl string,
+	postData io.Reader) ([]byte, error) {
 
-	client := http.Client{
-		Transport:     nil,              // Use default
-		CheckRedirect: nil,              // Use default
-		Jar:           nil,              // Don't care about cookies
-		Timeout:       time.Second * 20, // 20 second timeout
-	}
-	// According to https://developer.apple.com/library/ios/technotes/tn2259/_index.html#//apple_ref/doc/uid/DTS40009578-CH1-ITUNES_CONNECT
-	// the correct way to verify is to try the prod verify url, and if that fails, then try the
-	// sandbox url.
-	data, sendErr := sendReceiptRequest(&client, productionURL, postData)
-	if sendErr != nil {
-		return nil, sendErr
+	req, reqErr := http.NewRequest("POST", verifyUrl, postData)
+	if reqErr != nil {
+		return nil, reqErr
 	}
+	req.Header.Set("Content-Type", "application/json")
 
-	resp, parseErr := parseReceiptResponse(data)
-	if parseErr == fromTestEnvError {
-		if _, err := postData.Seek(0, io.SeekStart); err != nil {
-			return nil, err
-		}
-		data, sendErr = sendReceiptRequest(&client, sandboxURL, postData)
-		if sendErr != nil {
-			return nil, sendErr
-		}
-		resp, parseErr = parseReceiptResponse(data)
-		if parseErr != nil {
-			return nil, parseErr
-		}
-	} else if parseErr != nil {
-		return nil, parseErr
-	}
-
-	return resp, nil
-}
-
-func sendReceiptRequest(client *http.Client, verifyUrl string, postData io.Reader) ([]byte, error) {
 	// Send the receipt data to Apple for verification
-	verifyResp, responseErr := client.Post(verifyUrl, "application/json", postData)
+	verifyResp, responseErr := client.Do(req.WithContext(ctx))
 	if responseErr != nil {
 		return nil, responseErr
 	}
@@ -306,10 +388,25 @@ func sendReceiptRequest(client *http.Client, verifyUrl string, postData io.Reade
 		return nil, readErr
 	}
 
+	if verifyResp.StatusCode != http.StatusOK {
+		return nil, HTTPError{verifyResp.StatusCode}
+	}
 	return data, nil
 }
 
+// parseReceiptResponse returns the subscription purchased or renewed most recently
 func parseReceiptResponse(data []byte) (Info, error) {
+	infos, err := parseReceiptResponses(data)
+	if err != nil {
+		return nil, err
+	}
+	return infos[len(infos)-1], nil
+}
+
+// parseReceiptResponses returns one Info per original_transaction_id, ordered by their latest
+// purchase, each paired with its own pending_renewal_info entry. Receipts with subscriptions in
+// several subscription groups have one original transaction per group.
+func parseReceiptResponses(data []byte) ([]Info, error) {
 
 	var v validation
 	if err := json.Unmarshal(data, &v.response); err != nil {
@@ -317,17 +414,8 @@ func parseReceiptResponse(data []byte) (Info, error) {
 		return nil, err
 	}
 
-	switch v.Status() {
-	case StatusUnreadable, StatusUnreachable:
-		// TODO: Schedule a retry
-		return nil, fmt.Errorf(v.Error())
-	case StatusReceiptMalformed, StatusNotAuthenticated:
-		// TODO: Flag account with malformed or unauthenticated receipt for follow up
-		return nil, fmt.Errorf(v.Error())
-	case StatusMismatchedSecret:
-		return nil, fmt.Errorf("Tried to verify receipt with wrong password")
-	case StatusReceiptFromTest:
-		return nil, fromTestEnvError
+	if v.HasError() {
+		return nil, StatusError{v.Status()}
 	}
 
 	var receiptInfoData json.RawMessage
@@ -345,17 +433,12 @@ func parseReceiptResponse(data []byte) (Info, error) {
 		return nil, err
 	}
 
-	autoRenewStatus := v.AutoRenewStatus()
-
-	var pendingRenewalInfo []renewalInfo
+	var pendingRenewalInfo []RenewalInfoBody
 	if len(v.response.PendingRenewalInfo) > 0 {
 		if err := json.Unmarshal(v.response.PendingRenewalInfo, &pendingRenewalInfo); err != nil {
 			log.Println("Should have decoded pending renewal info", err, string(data))
 			return nil, err
 		}
-		if len(pendingRenewalInfo) > 0 {
-			autoRenewStatus = autoRenewStatus || pendingRenewalInfo[0].AutoRenewStatus == 1
-		}
 	}
 
 	switch receiptInfo.(type) {
@@ -367,7 +450,14 @@ func parseReceiptResponse(data []byte) (Info, error) {
 		}
 
 		v.response.info = modernReceiptInfo{infoBody}
-		return v, nil
+		if len(infoBody.InApp) > 0 {
+			v.response.transactions = transactions(infoBody.InApp)
+		} else {
+			v.response.transactions = []Transaction{infoBody.Transaction()}
+		}
+		v.response.renewalInfo, v.response.hasRenewalInfo = renewalInfoFor(pendingRenewalInfo,
+			infoBody.OriginalTransactionID, true)
+		return []Info{v}, nil
 
 	case []interface{}:
 		var infoList []ReceiptInfoBody
@@ -375,12 +465,36 @@ func parseReceiptResponse(data []byte) (Info, error) {
 			log.Println("Should have decoded iOS 7+ style receipt")
 			return nil, err
 		}
+		if len(infoList) == 0 {
+			break
+		}
 		sort.Slice(infoList, func(i, j int) bool {
 			return infoList[i].PurchaseDate.Time().Before(infoList[j].PurchaseDate.Time())
 		})
 
-		v.response.info = modernReceiptInfo{infoList[len(infoList)-1]}
-		return v, nil
+		groups := make(map[string][]ReceiptInfoBody)
+		var ids []string
+		for _, body := range infoList {
+			if _, ok := groups[body.OriginalTransactionID]; !ok {
+				ids = append(ids, body.OriginalTransactionID)
+			}
+			groups[body.OriginalTransactionID] = append(groups[body.OriginalTransactionID], body)
+		}
+
+		infos := make([]Info, len(ids))
+		for i, id := range ids {
+			group := groups[id]
+			sub := v
+			sub.response.info = modernReceiptInfo{group[len(group)-1]}
+			sub.response.transactions = transactions(group)
+			sub.response.renewalInfo, sub.response.hasRenewalInfo = renewalInfoFor(
+				pendingRenewalInfo, id, len(ids) == 1)
+			infos[i] = sub
+		}
+		sort.SliceStable(infos, func(i, j int) bool {
+			return infos[i].PaidAt().Before(infos[j].PaidAt())
+		})
+		return infos, nil
 	}
 
 	return nil, fmt.Errorf("Could not parse verifyReceipt response %d\n", v.Status())
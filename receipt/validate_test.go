@@ -115,3 +115,160 @@ func TestParseResponse4(t *testing.T) {
 		t.Error("Should parse status as 0 Valid")
 	}
 }
+
+func TestParseTransactionHistory(t *testing.T) {
+	data, readErr := ioutil.ReadFile("testdata/response5.json")
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+
+	resp, parseErr := parseReceiptResponse(data)
+	if parseErr != nil {
+		t.Fatal(parseErr)
+	}
+
+	history := resp.Transactions()
+	if len(history) != 3 {
+		t.Fatal("Should have parsed every transaction", len(history))
+	}
+
+	for i, id := range []string{"1000000500000001", "1000000500000002", "1000000500000003"} {
+		if history[i].TransactionID != id {
+			t.Errorf("Should have sorted transaction %s at %d, got %s", id, i,
+				history[i].TransactionID)
+		}
+	}
+
+	trial := history[0]
+	if !trial.IsTrialPeriod || !trial.IsUpgraded || !trial.CancelledAt.IsZero() {
+		t.Error("Should have parsed upgraded trial", trial)
+	} else if trial.WebOrderLineItemID != "1000000040000001" {
+		t.Error("Should have parsed web order line item ID", trial.WebOrderLineItemID)
+	}
+
+	refunded := history[1]
+	cancelledAt := time.Date(2019, time.June, 15, 0, 0, 0, 0, time.UTC)
+	if !refunded.CancelledAt.Equal(cancelledAt) {
+		t.Errorf("Should parse %s as %s", refunded.CancelledAt, cancelledAt)
+	} else if refunded.CancellationReason != CancellationReasonAppIssue {
+		t.Error("Should have parsed cancellation reason", refunded.CancellationReason)
+	} else if !refunded.IsInIntroOfferPeriod {
+		t.Error("Should have parsed intro offer period")
+	}
+
+	originalPurchasedAt := time.Date(2019, time.May, 1, 0, 0, 0, 0, time.UTC)
+	if !history[2].OriginalPurchasedAt.Equal(originalPurchasedAt) {
+		t.Errorf("Should parse %s as %s", history[2].OriginalPurchasedAt, originalPurchasedAt)
+	}
+
+	if resp.ProductID() != "month-premium" || !resp.PaidAt().Equal(history[2].PurchasedAt) {
+		t.Error("Should have used the latest transaction for info", resp.PaidAt())
+	}
+}
+
+func TestParseSubscriptionGroups(t *testing.T) {
+	data, readErr := ioutil.ReadFile("testdata/response6.json")
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+
+	infos, parseErr := parseReceiptResponses(data)
+	if parseErr != nil {
+		t.Fatal(parseErr)
+	}
+
+	if len(infos) != 2 {
+		t.Fatal("Should have returned one info per original transaction ID", len(infos))
+	}
+
+	premium, storage := infos[0], infos[1]
+	if premium.ProductID() != "premium-yearly" || storage.ProductID() != "storage-monthly" {
+		t.Fatal("Should have ordered infos by latest purchase", premium.ProductID(),
+			storage.ProductID())
+	}
+
+	if !premium.AutoRenewStatus() || premium.AutoRenewProduct() != "premium-yearly" {
+		t.Error("Should have paired premium with its own renewal info")
+	} else if len(premium.Transactions()) != 1 {
+		t.Error("Should have only premium transactions", premium.Transactions())
+	}
+
+	if storage.AutoRenewStatus() || storage.ExpirationIntent() != ExpirationIntentCancelled {
+		t.Error("Should have paired storage with its own renewal info")
+	} else if len(storage.Transactions()) != 2 || storage.IsTrialPeriod() {
+		t.Error("Should have latest storage transaction after its trial", storage.Transactions())
+	}
+
+	latest, err := parseReceiptResponse(data)
+	if err != nil {
+		t.Fatal(err)
+	} else if latest.OriginalTransactionID() != "2000000600000001" || latest.AutoRenewStatus() {
+		t.Error("Should have returned the latest purchase with its renewal info")
+	}
+}
+
+func TestParseMissingRenewalInfo(t *testing.T) {
+	data, readErr := ioutil.ReadFile("testdata/response6.json")
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+
+	// Leave out renewal info for the storage subscription
+	var body map[string]interface{}
+	if err := json.Unmarshal(data, &body); err != nil {
+		t.Fatal(err)
+	}
+	body["pending_renewal_info"] = body["pending_renewal_info"].([]interface{})[:1]
+	data, _ = json.Marshal(body)
+
+	infos, parseErr := parseReceiptResponses(data)
+	if parseErr != nil {
+		t.Fatal(parseErr)
+	}
+
+	premium, storage := infos[0].(validation), infos[1].(validation)
+	if !premium.HasRenewalInfo() || !premium.AutoRenewStatus() {
+		t.Error("Should have paired premium with its own renewal info")
+	} else if storage.HasRenewalInfo() {
+		t.Error("Should not have paired storage with another subscription's renewal info")
+	}
+}
+
+func TestParsePendingRenewalInfo(t *testing.T) {
+	data, readErr := ioutil.ReadFile("testdata/response7.json")
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+
+	resp, parseErr := parseReceiptResponse(data)
+	if parseErr != nil {
+		t.Fatal(parseErr)
+	}
+
+	if resp.ExpirationIntent() != ExpirationIntentBillingError || !resp.IsInBillingRetryPeriod() {
+		t.Error("Should have parsed billing retry", resp.ExpirationIntent())
+	}
+
+	gracePeriodExpiresAt := time.Date(2019, time.August, 8, 0, 0, 0, 0, time.UTC)
+	if !resp.GracePeriodExpiresAt().Equal(gracePeriodExpiresAt) {
+		t.Errorf("Should parse %s as %s", resp.GracePeriodExpiresAt(), gracePeriodExpiresAt)
+	}
+
+	if resp.PriceConsentStatus() != PriceConsentPending {
+		t.Error("Should have parsed pending price consent", resp.PriceConsentStatus())
+	} else if resp.OfferCodeRefName() != "SUMMER2019" || resp.PromotionalOfferID() != "" {
+		t.Error("Should have parsed offers", resp.OfferCodeRefName(), resp.PromotionalOfferID())
+	}
+
+	data, readErr = ioutil.ReadFile("testdata/response1.json")
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+
+	resp, parseErr = parseReceiptResponse(data)
+	if parseErr != nil {
+		t.Fatal(parseErr)
+	} else if resp.PriceConsentStatus() != PriceConsentNone || resp.IsInBillingRetryPeriod() {
+		t.Error("Should have no price increase or billing retry by default")
+	}
+}
@@ -0,0 +1,182 @@
+package receipt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// Validator verifies receipts with the verifyReceipt endpoint.
+type Validator struct {
+	Secret     string
+	HTTPClient *http.Client
+
+	ProductionURL string
+	SandboxURL    string
+
+	// ExcludeOldTransactions limits responses to the latest transaction of each subscription
+	// instead of the full history, which leaves payments without renewal counts
+	ExcludeOldTransactions bool
+
+	// SandboxFallback retries receipts that production reports are from the test environment
+	// against SandboxURL. Turn it off to keep TestFlight receipts out of production.
+	SandboxFallback bool
+
+	// MaxRetries is how many times network errors and temporary App Store statuses are retried,
+	// waiting a random duration up to RetryBackoff doubled with each attempt. Retries stop early
+	// once waiting would take longer than RetryBudget in total.
+	MaxRetries   int
+	RetryBackoff time.Duration
+	RetryBudget  time.Duration
+}
+
+// temporaryError is a network error, which may succeed if retried
+type temporaryError struct {
+	error
+}
+
+func (err temporaryError) Temporary() bool {
+	return true
+}
+
+// NewValidator verifies receipts against Apple's endpoints with a 20 second timeout, falling back
+// to sandbox for test receipts and retrying temporary failures up to 3 times. Responses include
+// old transactions, which renewal counts and commission rates are estimated from.
+func NewValidator(secret string) *Validator {
+	return &Validator{
+		Secret:          secret,
+		HTTPClient:      &http.Client{Timeout: time.Second * 20},
+		ProductionURL:   ProductionURL,
+		SandboxURL:      SandboxURL,
+		SandboxFallback: true,
+		MaxRetries:      3,
+		RetryBackoff:    time.Second,
+		RetryBudget:     10 * time.Second,
+	}
+}
+
+func (v *Validator) Validate(receipt string) (Info, error) {
+	return v.ValidateContext(context.Background(), receipt)
+}
+
+// ValidateContext is Validate with a context that can cancel the verifyReceipt requests and
+// retries
+func (v *Validator) ValidateContext(ctx context.Context, receipt string) (Info, error) {
+	infos, err := v.ValidateAllContext(ctx, receipt)
+	if err != nil {
+		return nil, err
+	}
+	return infos[len(infos)-1], nil
+}
+
+func (v *Validator) retry(ctx context.Context, validate func() ([]Info, error)) ([]Info, error) {
+
+	var waited time.Duration
+	backoff := v.RetryBackoff
+
+	for attempt := 0; ; attempt++ {
+		infos, err := validate()
+		if err == nil || !IsTransient(err) || attempt >= v.MaxRetries || backoff <= 0 {
+			return infos, err
+		}
+
+		// Full jitter spreads retries from concurrent scan workers apart
+		wait := time.Duration(rand.Int63n(int64(backoff)))
+		if waited+wait > v.RetryBudget {
+			return infos, err
+		}
+		log.Println("Retry receipt validation after", wait, err)
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		waited += wait
+		backoff *= 2
+	}
+}
+
+// ValidateAll verifies a receipt and returns one Info per subscription it contains, ordered by
+// their latest purchase. Receipts have one subscription per subscription group purchased.
+func (v *Validator) ValidateAll(receipt string) ([]Info, error) {
+	return v.ValidateAllContext(context.Background(), receipt)
+}
+
+// ValidateAllContext is ValidateAll with a context that can cancel the verifyReceipt requests
+// and retries
+func (v *Validator) ValidateAllContext(ctx context.Context, receipt string) ([]Info, error) {
+	return v.retry(ctx, func() ([]Info, error) {
+		return v.validate(ctx, receipt)
+	})
+}
+
+func (v *Validator) validate(ctx context.Context, receipt string) ([]Info, error) {
+	if v.Secret == "" {
+		return nil, errors.New("itunes.appSharedSecret should have been set")
+	}
+
+	req := VerifyReceiptRequest{
+		ReceiptData:            receipt,
+		Password:               v.Secret,
+		ExcludeOldTransactions: v.ExcludeOldTransactions,
+	}
+
+	buf := new(bytes.Buffer)
+
+	encoder := json.NewEncoder(buf)
+	if encodeErr := encoder.Encode(&req); encodeErr != nil {
+		log.Println("Should have encoded verifyReceipt request", receipt)
+		return nil, encodeErr
+	}
+
+	// Copy encoded data to a bytes.Reader to support multiple read passes
+	postData := bytes.NewReader(buf.Bytes())
+
+	client := v.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	// According to https://developer.apple.com/library/ios/technotes/tn2259/_index.html#//apple_ref/doc/uid/DTS40009578-CH1-ITUNES_CONNECT
+	// the correct way to verify is to try the prod verify url, and if that fails, then try the
+	// sandbox url.
+	data, sendErr := sendReceiptRequest(ctx, client, v.ProductionURL, postData)
+	if sendErr != nil {
+		return nil, networkError(ctx, sendErr)
+	}
+
+	resp, parseErr := parseReceiptResponses(data)
+	if parseErr == (StatusError{StatusReceiptFromTest}) && v.SandboxFallback {
+		if _, err := postData.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		data, sendErr = sendReceiptRequest(ctx, client, v.SandboxURL, postData)
+		if sendErr != nil {
+			return nil, networkError(ctx, sendErr)
+		}
+		resp, parseErr = parseReceiptResponses(data)
+		if parseErr != nil {
+			return nil, parseErr
+		}
+	} else if parseErr != nil {
+		return nil, parseErr
+	}
+
+	return resp, nil
+}
+
+// networkError marks request failures as temporary, unless the context ended them or the App
+// Store responded with an HTTPError, which classifies itself
+func networkError(ctx context.Context, err error) error {
+	if _, ok := err.(HTTPError); ok || ctx.Err() != nil {
+		return err
+	}
+	return temporaryError{err}
+}
@@ -0,0 +1,132 @@
+package receipt
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestValidator(t *testing.T, sandboxData []byte) (*Validator, func()) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/production", func(w http.ResponseWriter, r *http.Request) {
+		var req VerifyReceiptRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		} else if req.Password != "secret" || req.ExcludeOldTransactions {
+			t.Error("Should have sent secret and included old transactions", req)
+		}
+		w.Write([]byte(`{"status":21007}`))
+	})
+	mux.HandleFunc("/sandbox", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(sandboxData)
+	})
+	srv := httptest.NewServer(mux)
+
+	v := NewValidator("secret")
+	v.HTTPClient = srv.Client()
+	v.ProductionURL = srv.URL + "/production"
+	v.SandboxURL = srv.URL + "/sandbox"
+	return v, srv.Close
+}
+
+func TestValidatorSandboxFallback(t *testing.T) {
+	data, readErr := ioutil.ReadFile("testdata/response1.json")
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+
+	v, closeServer := newTestValidator(t, data)
+	defer closeServer()
+
+	resp, err := v.Validate("receipt123")
+	if err != nil {
+		t.Fatal("Should have validated test receipt against sandbox", err)
+	} else if resp.Status() != StatusValid {
+		t.Error("Should parse status as valid")
+	}
+
+	v.SandboxFallback = false
+	if _, err := v.Validate("receipt123"); !IsEnvironmentMismatch(err) {
+		t.Error("Should not have fallen back to sandbox", err)
+	}
+}
+
+func TestValidatorRetry(t *testing.T) {
+	data, readErr := ioutil.ReadFile("testdata/response1.json")
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		switch attempts {
+		case 1:
+			w.Write([]byte(`{"status":21005}`))
+		case 2:
+			w.Write([]byte(`{"status":21150}`))
+		default:
+			w.Write(data)
+		}
+	}))
+	defer srv.Close()
+
+	v := NewValidator("secret")
+	v.HTTPClient = srv.Client()
+	v.ProductionURL = srv.URL
+	v.RetryBackoff = time.Millisecond
+
+	if _, err := v.Validate("receipt123"); err != nil {
+		t.Error("Should have retried temporary statuses", err)
+	} else if attempts != 3 {
+		t.Error("Should have validated on the third attempt", attempts)
+	}
+
+	attempts = 0
+	v.MaxRetries = 1
+	if _, err := v.Validate("receipt123"); !IsTransient(err) {
+		t.Error("Should have given up with a temporary error", err)
+	} else if attempts != 2 {
+		t.Error("Should have stopped after one retry", attempts)
+	}
+}
+
+func TestValidatorHTTPError(t *testing.T) {
+	data, readErr := ioutil.ReadFile("testdata/response1.json")
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+
+	attempts, statusCode := 0, http.StatusServiceUnavailable
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(statusCode)
+			w.Write([]byte("<html>Service Unavailable</html>"))
+			return
+		}
+		w.Write(data)
+	}))
+	defer srv.Close()
+
+	v := NewValidator("secret")
+	v.HTTPClient = srv.Client()
+	v.ProductionURL = srv.URL
+	v.RetryBackoff = time.Millisecond
+
+	if _, err := v.Validate("receipt123"); err != nil {
+		t.Error("Should have retried an unavailable App Store", err)
+	} else if attempts != 2 {
+		t.Error("Should have validated on the second attempt", attempts)
+	}
+
+	attempts, statusCode = 0, http.StatusBadRequest
+	if _, err := v.Validate("receipt123"); err != (HTTPError{http.StatusBadRequest}) {
+		t.Error("Should have returned the HTTP error", err)
+	} else if attempts != 1 {
+		t.Error("Should not have retried a bad request", attempts)
+	}
+}
@@ -0,0 +1,211 @@
+package superscribe
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Replayer processes journaled notifications again, like the server returned by NewServer
+type Replayer interface {
+	Replay(ctx context.Context, id string) (JournalEntry, error)
+	ReplayRange(ctx context.Context, start, end time.Time, failedOnly bool) ([]JournalEntry, error)
+}
+
+// Replay processes the journaled notification with id again through the current updater and
+// listeners, and records how the replay turned out alongside the original outcome. Replays
+// bypass the Deduplicator, since notifications are replayed after fixing how they were
+// processed, but mark notifications they process successfully so Apple's retries are skipped.
+func (s server) Replay(ctx context.Context, id string) (JournalEntry, error) {
+	if s.Journal == nil {
+		return JournalEntry{}, errors.New("Server should have had a Journal to replay from")
+	}
+
+	entry, err := s.Journal.Entry(ctx, id)
+	if err != nil {
+		return entry, err
+	}
+	return s.replay(ctx, entry)
+}
+
+// ReplayRange replays notifications received from start until end, oldest first. With
+// failedOnly, notifications that were processed successfully are skipped, and so are failed ones
+// that a later delivery of the same notification processed. It stops at the first notification
+// that can't be replayed or journaled, but not at ones that fail again.
+func (s server) ReplayRange(ctx context.Context, start, end time.Time,
+	failedOnly bool) ([]JournalEntry, error) {
+
+	if s.Journal == nil {
+		return nil, errors.New("Server should have had a Journal to replay from")
+	}
+
+	entries, err := s.Journal.Entries(ctx, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	var succeeded map[string]time.Time
+	if failedOnly {
+		// Apple retries failed notifications for days, possibly after end
+		retries := entries
+		if now := time.Now(); end.Before(now) {
+			if retries, err = s.Journal.Entries(ctx, start, now); err != nil {
+				return nil, err
+			}
+		}
+		succeeded = s.succeededAt(retries)
+	}
+
+	var replayed []JournalEntry
+	for _, entry := range entries {
+		if failedOnly && !entry.Failed() {
+			continue
+		}
+		if key := s.entryKey(entry); key != "" && succeeded[key].After(entry.ReceivedAt) {
+			log.Println("Skip notification processed on retry", entry.ID, key)
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return replayed, err
+		}
+
+		entry, err := s.replay(ctx, entry)
+		if err != nil {
+			return replayed, err
+		}
+		replayed = append(replayed, entry)
+	}
+	return replayed, nil
+}
+
+// succeededAt returns when each notification was last received and processed successfully, by
+// the key that identifies it across deliveries
+func (s server) succeededAt(entries []JournalEntry) map[string]time.Time {
+	succeeded := make(map[string]time.Time)
+	for _, entry := range entries {
+		if entry.Failed() {
+			continue
+		}
+		if key := s.entryKey(entry); key != "" && entry.ReceivedAt.After(succeeded[key]) {
+			succeeded[key] = entry.ReceivedAt
+		}
+	}
+	return succeeded
+}
+
+// entryKey identifies a journaled notification like the Deduplicator does, or is empty when it
+// can't be decoded
+func (s server) entryKey(entry JournalEntry) string {
+	n, _, err := decodeNote(entry.Body, s.Roots, s.app(), s.Secrets)
+	if err != nil {
+		return ""
+	}
+	return dedupKey(n)
+}
+
+// acknowledge marks a replayed notification processed, so that Apple's later retries of it are
+// acknowledged without processing it again
+func (s server) acknowledge(ctx context.Context, entry JournalEntry) {
+	n, _, err := decodeNote(entry.Body, s.Roots, s.app(), s.Secrets)
+	if err != nil {
+		return
+	}
+
+	pipeline := s.pipeline()
+	if n.Environment() == Sandbox {
+		if s.Sandbox == nil {
+			return
+		}
+		pipeline = *s.Sandbox
+	}
+
+	if key, claim := pipeline.claim(ctx, n); claim == Claimed {
+		pipeline.complete(ctx, key)
+	}
+}
+
+func (s server) replay(ctx context.Context, entry JournalEntry) (JournalEntry, error) {
+	production := s.pipeline()
+	production.Deduplicator = nil
+
+	var sandbox *Pipeline
+	if s.Sandbox != nil {
+		pipeline := *s.Sandbox
+		pipeline.Deduplicator = nil
+		sandbox = &pipeline
+	}
+
+	status, err := processNotification(ctx, entry.Body, entry.ReceivedAt, production, sandbox,
+		s.Roots, s.app(), s.Secrets)
+	if status == http.StatusOK {
+		s.acknowledge(ctx, entry)
+	}
+
+	outcome := newOutcome(status, err)
+	entry.Replays++
+	entry.LastReplay = &outcome
+	log.Println("Replayed notification", entry.ID, outcome.Status, outcome.Error)
+
+	return entry, s.Journal.Replayed(ctx, entry.ID, outcome)
+}
+
+// ReplayCommand is a command line for replaying notifications, for apps to run from their own
+// main with their updater and listeners configured, like
+//
+//	replay -id 6f1c...
+//	replay -from 2019-03-06T00:00:00Z -to 2019-03-07T00:00:00Z -failed
+//
+// It writes how each replay turned out to out.
+func ReplayCommand(ctx context.Context, replayer Replayer, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	flags.SetOutput(out)
+	id := flags.String("id", "", "journal ID of one notification to replay")
+	from := flags.String("from", "", "replay notifications received at or after this RFC 3339 time")
+	to := flags.String("to", "", "replay notifications received before this RFC 3339 time, "+
+		"or now")
+	failedOnly := flags.Bool("failed", false, "skip notifications processed successfully, "+
+		"including by a later delivery")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var entries []JournalEntry
+	if *id != "" {
+		entry, err := replayer.Replay(ctx, *id)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+	} else if *from != "" {
+		start, err := time.Parse(time.RFC3339, *from)
+		if err != nil {
+			return err
+		}
+		end := time.Now()
+		if *to != "" {
+			if end, err = time.Parse(time.RFC3339, *to); err != nil {
+				return err
+			}
+		}
+
+		entries, err = replayer.ReplayRange(ctx, start, end, *failedOnly)
+		if err != nil {
+			return err
+		}
+	} else {
+		flags.Usage()
+		return errors.New("Replay should have had -id or -from")
+	}
+
+	for _, entry := range entries {
+		outcome := entry.Latest()
+		fmt.Fprintf(out, "%s\t%s\t%d\t%s\n", entry.ID, entry.ReceivedAt.Format(time.RFC3339),
+			outcome.Status, outcome.Error)
+	}
+	return nil
+}
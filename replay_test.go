@@ -0,0 +1,219 @@
+package superscribe
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+)
+
+// fakeJournal keeps entries in memory, in the order they were recorded
+type fakeJournal struct {
+	mu      sync.Mutex
+	entries []JournalEntry
+}
+
+func (j *fakeJournal) Record(ctx context.Context, entry JournalEntry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.entries = append(j.entries, entry)
+	return nil
+}
+
+func (j *fakeJournal) Finish(ctx context.Context, id string, outcome Outcome) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for i := range j.entries {
+		if j.entries[i].ID == id {
+			j.entries[i].Outcome = outcome
+			return nil
+		}
+	}
+	return fmt.Errorf("No notification %s", id)
+}
+
+func (j *fakeJournal) Replayed(ctx context.Context, id string, outcome Outcome) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for i := range j.entries {
+		if j.entries[i].ID == id {
+			j.entries[i].Replays++
+			j.entries[i].LastReplay = &outcome
+			return nil
+		}
+	}
+	return fmt.Errorf("No notification %s", id)
+}
+
+func (j *fakeJournal) Entry(ctx context.Context, id string) (JournalEntry, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, entry := range j.entries {
+		if entry.ID == id {
+			return entry, nil
+		}
+	}
+	return JournalEntry{}, fmt.Errorf("No notification %s", id)
+}
+
+func (j *fakeJournal) Entries(ctx context.Context, start, end time.Time) ([]JournalEntry, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var entries []JournalEntry
+	for _, entry := range j.entries {
+		if !entry.ReceivedAt.Before(start) && entry.ReceivedAt.Before(end) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func TestReplayJournaledNotifications(t *testing.T) {
+
+	// Set up mocks and fakes
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSub := NewMockSubscription(ctrl)
+	mockSub.EXPECT().Currency().Return(currency).AnyTimes()
+	mockSub.EXPECT().Price().Return(price).AnyTimes()
+
+	// Only replays reach listeners, once the fetch bug is fixed
+	mockListener := NewMockEventListener(ctrl)
+	mockListener.EXPECT().Paid(gomock.Any()).Times(2)
+	mockListener.EXPECT().RecoveredFromBillingRetry(gomock.Any()).Times(1)
+
+	fetchErr := errors.New("Subscription unavailable")
+	fakeMatcher := func(now time.Time) []string { return []string{} }
+	fakeFetcher := func(originalTransactionID string) (Subscription, error) {
+		if fetchErr != nil {
+			return nil, fetchErr
+		}
+		return mockSub, nil
+	}
+
+	journal := &fakeJournal{}
+	srv := NewServer("http://example.com", testValidator, fakeMatcher, fakeFetcher, stubUpdater{}, 1)
+	srv.Listener.Add(mockListener)
+	srv.Journal = journal
+	srv.Deduplicator = &fakeDeduplicator{claimed: make(map[string]ClaimStatus)}
+
+	start := time.Now().UTC()
+	for _, fileName := range []string{"DID_RECOVER.json", "RENEWAL.json"} {
+		req := httptest.NewRequest("POST", "http://example.com/superscribe",
+			bytes.NewReader(dataFromFile(fileName)))
+		w := httptest.NewRecorder()
+		srv.mux.ServeHTTP(w, req)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Wrong status code: got %v want %v", w.Code, http.StatusNotFound)
+		}
+	}
+
+	if len(journal.entries) != 2 {
+		t.Fatal("Should have journaled every notification", journal.entries)
+	}
+	recovered := journal.entries[0]
+	if recovered.Status != http.StatusNotFound || recovered.Error != fetchErr.Error() ||
+		!bytes.Equal(recovered.Body, dataFromFile("DID_RECOVER.json")) {
+		t.Error("Should have journaled the body and outcome", recovered)
+	}
+
+	fetchErr = nil
+
+	entry, err := srv.Replay(context.Background(), recovered.ID)
+	if err != nil || entry.Failed() {
+		t.Error("Should have replayed one notification", entry, err)
+	}
+
+	// Apple's retry of a replayed notification is acknowledged without processing it again
+	req := httptest.NewRequest("POST", "http://example.com/superscribe",
+		bytes.NewReader(dataFromFile("DID_RECOVER.json")))
+	w := httptest.NewRecorder()
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Wrong status code: got %v want %v", w.Code, http.StatusOK)
+	}
+
+	var out strings.Builder
+	err = ReplayCommand(context.Background(), srv, []string{"-failed",
+		"-from", start.Add(-time.Second).Format(time.RFC3339)}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fields := strings.Split(out.String(), "\t"); len(fields) != 4 ||
+		fields[0] != journal.entries[1].ID || fields[2] != "200" {
+		t.Error("Should have replayed only the notification still failing", out.String())
+	}
+
+	for _, entry := range journal.entries[:2] {
+		if entry.Failed() || entry.Replays != 1 {
+			t.Error("Should have recorded the outcome of replays", entry)
+		} else if entry.Status != http.StatusNotFound {
+			t.Error("Should have kept how the notification was first processed", entry.Outcome)
+		}
+	}
+
+	if err := ReplayCommand(context.Background(), srv, nil, &out); err == nil {
+		t.Error("Should have required -id or -from")
+	}
+}
+
+func TestReplayRangeSkipsRetriedNotifications(t *testing.T) {
+
+	// Set up mocks and fakes
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSub := NewMockSubscription(ctrl)
+	mockSub.EXPECT().Currency().Return(currency).AnyTimes()
+	mockSub.EXPECT().Price().Return(price).AnyTimes()
+
+	// Only Apple's retry reaches listeners
+	mockListener := NewMockEventListener(ctrl)
+	mockListener.EXPECT().Paid(gomock.Any()).Times(1)
+	mockListener.EXPECT().RecoveredFromBillingRetry(gomock.Any()).Times(1)
+
+	fetchErr := errors.New("Subscription unavailable")
+	fakeMatcher := func(now time.Time) []string { return []string{} }
+	fakeFetcher := func(originalTransactionID string) (Subscription, error) {
+		if fetchErr != nil {
+			return nil, fetchErr
+		}
+		return mockSub, nil
+	}
+
+	journal := &fakeJournal{}
+	srv := NewServer("http://example.com", testValidator, fakeMatcher, fakeFetcher, stubUpdater{}, 1)
+	srv.Listener.Add(mockListener)
+	srv.Journal = journal
+	srv.Deduplicator = &fakeDeduplicator{claimed: make(map[string]ClaimStatus)}
+
+	start := time.Now().UTC()
+	for _, status := range []int{http.StatusNotFound, http.StatusOK} {
+		req := httptest.NewRequest("POST", "http://example.com/superscribe",
+			bytes.NewReader(dataFromFile("DID_RECOVER.json")))
+		w := httptest.NewRecorder()
+		srv.mux.ServeHTTP(w, req)
+		if w.Code != status {
+			t.Errorf("Wrong status code: got %v want %v", w.Code, status)
+		}
+		fetchErr = nil
+	}
+
+	// The retry was received before the range ends, but found even when it's after
+	for _, end := range []time.Time{time.Now().Add(time.Second), journal.entries[1].ReceivedAt} {
+		replayed, err := srv.ReplayRange(context.Background(), start.Add(-time.Second), end, true)
+		if err != nil || len(replayed) != 0 {
+			t.Error("Should have skipped the notification that Apple's retry processed", replayed,
+				err)
+		}
+	}
+}
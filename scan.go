@@ -0,0 +1,96 @@
+package superscribe
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// ScanSummary counts what happened to the subscriptions reviewed by one scan
+type ScanSummary struct {
+	StartedAt time.Time
+	Duration  time.Duration
+
+	// Validated were looked up successfully, of which Renewed had their expiration pushed back
+	Validated int
+	Renewed   int
+
+	// Failed couldn't be looked up, fetched or updated, of which Requeued will be retried by the
+	// next scan. Skipped weren't attempted, such as duplicates within the scan.
+	Failed   int
+	Requeued int
+	Skipped  int
+}
+
+func (summary ScanSummary) String() string {
+	return fmt.Sprintf("Scan at %s took %s: %d validated, %d renewed, %d failed, %d requeued, "+
+		"%d skipped", summary.StartedAt, summary.Duration, summary.Validated, summary.Renewed,
+		summary.Failed, summary.Requeued, summary.Skipped)
+}
+
+// scanOutcome is the result of reviewing one expiring subscription
+type scanOutcome int
+
+const (
+	scanValidated scanOutcome = iota
+	scanRenewed
+	scanFailed
+	scanSkipped
+)
+
+func (summary *ScanSummary) add(outcome scanOutcome) {
+	switch outcome {
+	case scanValidated:
+		summary.Validated++
+	case scanRenewed:
+		summary.Validated++
+		summary.Renewed++
+	case scanFailed:
+		summary.Failed++
+	case scanSkipped:
+		summary.Skipped++
+	}
+}
+
+// retryQueue holds receipts that failed during a scan, so later scans retry them even if Match
+// doesn't return them again
+type retryQueue struct {
+	mu       sync.Mutex
+	attempts map[string]int
+}
+
+func newRetryQueue() *retryQueue {
+	return &retryQueue{attempts: make(map[string]int)}
+}
+
+// add requeues receiptData unless it already failed limit scans in a row
+func (q *retryQueue) add(receiptData string, limit int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.attempts[receiptData] >= limit {
+		log.Println("Should have reviewed after", limit, "retries, giving up on", receiptData)
+		delete(q.attempts, receiptData)
+		return false
+	}
+	q.attempts[receiptData]++
+	return true
+}
+
+func (q *retryQueue) remove(receiptData string) {
+	q.mu.Lock()
+	delete(q.attempts, receiptData)
+	q.mu.Unlock()
+}
+
+func (q *retryQueue) receipts() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	receipts := make([]string, 0, len(q.attempts))
+	for receiptData := range q.attempts {
+		receipts = append(receipts, receiptData)
+	}
+	return receipts
+}
@@ -2,10 +2,15 @@ package superscribe
 
 import (
 	"context"
+	"crypto/subtle"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/carpenterscode/superscribe/receipt"
@@ -13,23 +18,103 @@ import (
 
 type server struct {
 	Match    ExpiringSubscriptions
+	Lookup   LookupSubscription
 	Listener *MultiEventListener
 	Fetch    SubscriptionFetch
 	Updater  SubscriptionUpdater
 	mux      *http.ServeMux
-	secret   string
 	server   *http.Server
 	Ticker   *time.Ticker
+	scanning *int32
+	interval time.Duration
+
+	// MatchContext, LookupContext, FetchContext and UpdaterContext take precedence over their
+	// counterparts without a context when set
+	MatchContext   ExpiringSubscriptionsContext
+	LookupContext  LookupSubscriptionContext
+	FetchContext   SubscriptionFetchContext
+	UpdaterContext SubscriptionUpdaterContext
+
+	// ctx is cancelled by Stop, which waits for scans to drain
+	ctx    context.Context
+	cancel context.CancelFunc
+	scans  *sync.WaitGroup
+
+	// Validator verifies receipts during scans unless Lookup or LookupContext is set
+	Validator *receipt.Validator
+
+	// Roots verifies the certificate chains of App Store Server Notifications V2, and should
+	// contain Apple Root CA - G3 from https://www.apple.com/certificateauthority/
+	Roots *x509.CertPool
+
+	// BundleID and AppAppleID identify the app that V2 notifications must be about, since Apple
+	// signs every app's notifications alike. V2 notifications are rejected until BundleID is set.
+	// AppAppleID is checked when set, as Sandbox notifications don't have one.
+	BundleID   string
+	AppAppleID int64
+
+	// Sandbox processes Sandbox notifications against a separate store and listeners. When nil,
+	// Sandbox notifications are rejected with 403 Forbidden so they never reach production.
+	Sandbox *Pipeline
+
+	// Secrets are the shared secrets accepted as the password of V1 notifications. Append the
+	// previous secret while rotating so notifications in flight aren't rejected.
+	Secrets []string
+
+	// Workers is how many expiring subscriptions are reviewed at once. Fetch, Updater and
+	// listeners must be safe for concurrent use when it's more than 1.
+	Workers int
+
+	// LookupRate limits how many subscriptions are looked up per second during a scan, to stay
+	// within Apple's rate limits. Zero means no limit.
+	LookupRate float64
+
+	// RequeueLimit is how many later scans retry a receipt that failed, such as when the App
+	// Store was unavailable
+	RequeueLimit int
+	retries      *retryQueue
+
+	// Locker, when set, is consulted before each scan so that only the leader among several
+	// instances reviews expiring subscriptions
+	Locker Locker
+
+	// SmallBusinessProgram applies the reduced 15% commission to every payment, for apps whose
+	// developer is enrolled in the App Store Small Business Program
+	SmallBusinessProgram bool
+
+	// Catalog knows the subscription group and level of each product, so that changing products
+	// is reported as Upgraded, Downgraded or Crossgraded
+	Catalog Catalog
+
+	// DefaultStorefront, when set, is the App Store country that catalog prices are taken from
+	// for subscriptions whose storefront is unknown. Otherwise the catalog doesn't price them,
+	// rather than pricing customers elsewhere in another country's currency.
+	DefaultStorefront string
+
+	// Deduplicator, when set, acknowledges notifications Apple delivers more than once with
+	// 200 OK instead of updating and notifying listeners again, and answers deliveries of a
+	// notification still being processed with 409 Conflict so that Apple retries them
+	Deduplicator Deduplicator
+
+	// Journal, when set, persists every notification as received along with how processing it
+	// turned out, so that notifications can be replayed after fixing an updater or listener
+	Journal Journal
 }
 
 func (s server) Start() {
+	s.scans.Add(1)
 	go func() {
-		now := time.Now()
-		log.Println("Scan at", now)
-		s.reviewSubscriptions(s.Match(now))
-		for tick := range s.Ticker.C {
-			log.Println("Scan at", tick)
-			s.reviewSubscriptions(s.Match(tick))
+		defer s.scans.Done()
+
+		// Scan in the background so ticks during a long scan are skipped rather than queued
+		s.startScan(time.Now())
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			case tick := <-s.Ticker.C:
+				s.startScan(tick)
+			}
 		}
 	}()
 
@@ -40,8 +125,17 @@ func (s server) Start() {
 	}()
 }
 
+// Stop cancels any scan in progress and waits for it to drain before shutting down the server
 func (s server) Stop() {
 	s.Ticker.Stop()
+	s.cancel()
+	s.scans.Wait()
+
+	if s.Locker != nil {
+		if err := s.Locker.Unlock(); err != nil {
+			log.Println("Should have given up leadership", err)
+		}
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
 	defer cancel()
@@ -51,8 +145,54 @@ func (s server) Stop() {
 	}
 }
 
-func notificationHandler(w http.ResponseWriter, r *http.Request, listener EventListener,
-	fetch SubscriptionFetch, updater SubscriptionUpdater) {
+func (s server) startScan(now time.Time) {
+	s.scans.Add(1)
+	go func() {
+		defer s.scans.Done()
+		s.ScanContext(s.ctx, now)
+	}()
+}
+
+// Scan reviews subscriptions expiring at now until the server stops
+func (s server) Scan(now time.Time) ScanSummary {
+	return s.ScanContext(s.ctx, now)
+}
+
+// ScanContext reviews subscriptions expiring at now and logs a summary. It skips the scan while
+// a previous one is still running, or when another instance is the leader. Subscriptions not yet
+// reviewed when ctx is cancelled count as skipped.
+func (s server) ScanContext(ctx context.Context, now time.Time) ScanSummary {
+	summary := ScanSummary{StartedAt: now}
+
+	if !atomic.CompareAndSwapInt32(s.scanning, 0, 1) {
+		log.Println("Skip scan while previous scan runs at", now)
+		return summary
+	}
+	defer atomic.StoreInt32(s.scanning, 0)
+
+	if s.Locker != nil {
+		leader, err := s.Locker.Lock()
+		if err != nil {
+			log.Println("Should have checked leadership", err)
+			return summary
+		}
+		if !leader {
+			log.Println("Skip scan as follower at", now)
+			return summary
+		}
+	}
+
+	log.Println("Scan at", now)
+	receipts := append(s.match()(ctx, now), s.retries.receipts()...)
+	summary = s.reviewSubscriptions(ctx, receipts)
+	summary.StartedAt = now
+	log.Println(summary)
+	return summary
+}
+
+func notificationHandler(w http.ResponseWriter, r *http.Request, production Pipeline,
+	sandbox *Pipeline, roots *x509.CertPool, app appIdentity, secrets []string,
+	journal Journal) {
 
 	data, bodyErr := ioutil.ReadAll(r.Body)
 	if bodyErr != nil {
@@ -61,106 +201,643 @@ func notificationHandler(w http.ResponseWriter, r *http.Request, listener EventL
 		return
 	}
 
+	entry := JournalEntry{ID: newJournalID(), ReceivedAt: time.Now().UTC(), Body: data}
+	if journal != nil {
+		if err := journal.Record(r.Context(), entry); err != nil {
+			log.Println("Should have journaled notification", entry.ID, err)
+			journal = nil
+		}
+	}
+
+	status, err := processNotification(r.Context(), data, entry.ReceivedAt, production, sandbox,
+		roots, app, secrets)
+
+	if journal != nil {
+		if err := journal.Finish(context.Background(), entry.ID, newOutcome(status, err)); err != nil {
+			log.Println("Should have journaled notification outcome", entry.ID, err)
+		}
+	}
+
+	w.WriteHeader(status)
+}
+
+// decodeNote verifies and unmarshals a V1 or V2 notification, or returns the status to respond
+// to the App Store with when it can't
+func decodeNote(data []byte, roots *x509.CertPool, app appIdentity,
+	secrets []string) (Note, int, error) {
+
+	var signed SignedNotification
+	if err := json.Unmarshal(data, &signed); err != nil {
+		log.Println("Should have unmarshaled notification", err)
+		return nil, http.StatusInternalServerError, err
+	}
+
+	if signed.SignedPayload != "" {
+		n, err := decodeNotificationV2(roots, app, signed)
+		if err != nil {
+			log.Println("Should have verified signed notification", err)
+			return nil, http.StatusUnauthorized, err
+		}
+		return n, http.StatusOK, nil
+	}
+
 	var body Notification
 	if err := json.Unmarshal(data, &body); err != nil {
-		log.Println("Should have unmarshaled notification", err, r)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		log.Println("Should have unmarshaled notification", err)
+		return nil, http.StatusInternalServerError, err
 	}
 
-	n := notification{body}
+	if !acceptsPassword(body.Password, secrets) {
+		log.Println("Should have received notification with a known shared secret")
+		return nil, http.StatusUnauthorized, errUnknownSecret
+	}
+	return newNotification(body), http.StatusOK, nil
+}
+
+// processNotification updates the subscription and notifies listeners, and returns the status
+// to respond to the App Store with. receivedAt is when the App Store delivered data, which
+// replays keep.
+func processNotification(ctx context.Context, data []byte, receivedAt time.Time,
+	production Pipeline, sandbox *Pipeline, roots *x509.CertPool, app appIdentity,
+	secrets []string) (int, error) {
 
+	n, status, decodeErr := decodeNote(data, roots, app, secrets)
+	if decodeErr != nil {
+		return status, decodeErr
+	}
+
+	pipeline := production
 	if n.Environment() == Sandbox {
 		log.Println("Received Sandbox notification")
-		w.WriteHeader(http.StatusForbidden)
-		return
+		if sandbox == nil {
+			return http.StatusForbidden, errNoSandbox
+		}
+		pipeline = *sandbox
+	}
+
+	listener := pipeline.Listener
+
+	key, claim := pipeline.claim(ctx, n)
+	switch claim {
+	case Processed:
+		log.Println("Skip duplicate notification", key)
+		return http.StatusOK, nil
+
+	case InProgress:
+		// Apple retries until the delivery in progress succeeds, in case it fails
+		log.Println("Should have finished processing notification first", key)
+		return http.StatusConflict, errInProgress
 	}
 
-	if err := updater.UpdateWithNotification(n); err != nil {
+	// Apple retries notifications that fail, which must be processed again even if the request
+	// was cancelled
+	fail := func(status int, err error) (int, error) {
+		pipeline.release(context.Background(), key)
+		return status, err
+	}
+
+	// V2 upgrades change ProductID, so keep the product changed from before updating. A
+	// subscriber the store doesn't have yet has no previous product.
+	subtype, _ := n.(subtyped)
+	upgrade := n.Type() == DidChangeRenewalPref && subtype != nil &&
+		subtype.Subtype() == SubtypeUpgrade
+	var previousProduct string
+	if upgrade {
+		if previous, err := pipeline.fetch()(ctx, n.OriginalTransactionID()); err == nil {
+			previousProduct = previous.ProductID()
+		}
+	}
+
+	if err := pipeline.updater().UpdateWithNotificationContext(ctx, n); err != nil {
 		log.Println(n.OriginalTransactionID(), err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return fail(http.StatusInternalServerError, err)
 	}
 
-	sub, fetchErr := fetch(n.OriginalTransactionID())
+	sub, fetchErr := pipeline.fetch()(ctx, n.OriginalTransactionID())
 	if fetchErr != nil {
 		log.Println(fetchErr, n.OriginalTransactionID())
-		w.WriteHeader(http.StatusNotFound)
-		return
+		return fail(http.StatusNotFound, fetchErr)
 	}
 
 	evt := Event{}
 	evt.SetNote(n)
-	evt.SetRevenue(sub.Currency(), sub.Price())
+	evt.SetRevenue(pipeline.revenue(sub, n))
+	evt.SetCommission(pipeline.commission(n))
 	evt.SetUser(sub)
 
 	var err error
 
 	switch n.Type() {
-	case Cancel:
+	case Cancel, Refund:
+		if previous, ok := upgradedFrom(n.Transactions()); ok {
+			// The App Store cancels the previous product of an immediate upgrade
+			next := n.ProductID()
+			if next == previous.ProductID {
+				next = n.AutoRenewProduct()
+			}
+			change, known := productChange(pipeline.Catalog, previous.ProductID, next)
+			if !known {
+				change = Upgrade
+			}
+			evt.SetProductChange(change, previous.ProductID, previous.CancelledAt, true)
+			err = notifyProductChange(listener, evt)
+		} else {
+			err = listener.Refunded(evt)
+		}
+
+	case Revoke:
+		// Family Sharing access ended, which listeners handle like a refund
 		err = listener.Refunded(evt)
 
-	case Renewal, InteractiveRenewal:
+	case Renewal:
+		evt.SetPayment(pipeline.payment(n, PaidRenewal))
+		err = listener.Paid(evt)
+
+	case InteractiveRenewal:
+		evt.SetPayment(pipeline.payment(n, PaidResubscribe))
 		err = listener.Paid(evt)
 
+	case DidRecover:
+		evt.SetPayment(pipeline.payment(n, PaidRenewal))
+		if err = listener.Paid(evt); err == nil {
+			err = listener.RecoveredFromBillingRetry(evt)
+		}
+
 	case InitialBuy:
 		if n.IsTrialPeriod() {
 			err = listener.StartedTrial(evt)
 		} else {
+			evt.SetPayment(pipeline.payment(n, PaidInitialPurchase))
 			err = listener.Paid(evt)
 		}
 
 	case DidChangeRenewalPref:
-		err = listener.ChangedAutoRenewProduct(evt)
+		if evt.AutoRenewChangedAt().IsZero() {
+			evt.SetAutoRenewChangedAt(sentAt(n, receivedAt))
+		}
+
+		// Product changes that can be classified are reported instead of the auto-renew change,
+		// so listeners count each notification once
+		if upgrade {
+			// V2 notifications report immediate upgrades here, after ProductID changed
+			var previous string
+			if txn, ok := upgradedFrom(n.Transactions()); ok {
+				previous = txn.ProductID
+			} else if previousProduct != n.ProductID() {
+				previous = previousProduct
+			}
+			evt.SetProductChange(Upgrade, previous, n.PaidAt(), true)
+			err = notifyProductChange(listener, evt)
+		} else if change, ok := productChange(pipeline.Catalog, n.ProductID(),
+			n.AutoRenewProduct()); ok {
+
+			evt.SetProductChange(change, n.ProductID(), evt.AutoRenewChangedAt(), false)
+			err = notifyProductChange(listener, evt)
+		} else {
+			err = listener.ChangedAutoRenewProduct(evt)
+		}
 
 	case DidChangeRenewalStatus:
 		err = listener.ChangedAutoRenewStatus(evt)
 
+	case DidFailToRenew:
+		if n.GracePeriodExpiresAt().IsZero() {
+			err = listener.EnteredBillingRetry(evt)
+		} else {
+			err = listener.EnteredGracePeriod(evt)
+		}
+
+	case GracePeriodExpired:
+		err = listener.ExitedGracePeriod(evt)
+
+	case Expired:
+		if declinedPriceIncrease(n) {
+			evt.SetPriceIncrease(pipeline.priceIncrease(sub, n))
+			evt.SetPriceConsentChangedAt(evt.ExpiredAt())
+			if err = listener.PriceIncreaseDeclined(evt); err != nil {
+				break
+			}
+		}
+		err = listener.Expired(evt)
+
+	case PriceIncreaseConsent, PriceIncrease:
+		evt.SetPriceIncrease(pipeline.priceIncrease(sub, n))
+		evt.SetPriceConsentChangedAt(sentAt(n, receivedAt))
+
+		accepted := n.PriceConsentStatus() == receipt.PriceConsentAccepted
+		if subtype, ok := n.(subtyped); ok && subtype.Subtype() == SubtypeAccepted {
+			accepted = true
+		}
+		if accepted {
+			err = listener.PriceIncreaseAccepted(evt)
+		} else {
+			err = listener.PriceIncreaseConsentRequested(evt)
+		}
+
+	default:
+		log.Println("Unhandled notification type", n.Type(), n.OriginalTransactionID())
 	}
 
 	if err != nil {
 		log.Println("Notification handler returns 500", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return fail(http.StatusInternalServerError, err)
 	}
 
-	w.WriteHeader(http.StatusOK)
+	pipeline.complete(context.Background(), key)
+	return http.StatusOK, nil
 }
 
-func (s server) reviewSubscriptions(receipts []string) {
-	for _, receiptData := range receipts {
-		resp, err := receipt.Validate(s.secret, receiptData)
-		if err != nil {
-			log.Println(err, receiptData)
+// subtyped is a Note with a subtype, which only V2 notifications have
+type subtyped interface {
+	Subtype() NoteSubtype
+}
+
+// signedNote is a Note with when the App Store signed it, which only V2 notifications have
+type signedNote interface {
+	SignedAt() time.Time
+}
+
+// sentAt is when the App Store signed n, or else when it was received
+func sentAt(n Note, receivedAt time.Time) time.Time {
+	if signed, ok := n.(signedNote); ok && !signed.SignedAt().IsZero() {
+		return signed.SignedAt()
+	}
+	return receivedAt
+}
+
+// declinedPriceIncrease tells whether a subscription expired because the customer didn't agree to
+// a price increase
+func declinedPriceIncrease(n Note) bool {
+	if subtype, ok := n.(subtyped); ok && subtype.Subtype() == SubtypePriceIncrease {
+		return true
+	}
+	return n.ExpirationIntent() == receipt.ExpirationIntentPriceIncreaseDeclined
+}
+
+// notifyProductChange calls the listener for the kind of product change evt describes
+func notifyProductChange(listener EventListener, evt Event) error {
+	switch evt.ProductChange() {
+	case Upgrade:
+		return listener.Upgraded(evt)
+	case Downgrade:
+		return listener.Downgraded(evt)
+	case Crossgrade:
+		return listener.Crossgraded(evt)
+	}
+	return nil
+}
+
+// acceptsPassword compares password against every secret in constant time, so response timing
+// doesn't reveal how much of a guess was correct
+func acceptsPassword(password string, secrets []string) bool {
+	accepted := 0
+	for _, secret := range secrets {
+		if secret == "" {
 			continue
 		}
+		accepted |= subtle.ConstantTimeCompare([]byte(password), []byte(secret))
+	}
+	return accepted == 1
+}
 
-		if err := s.Updater.UpdateWithReceipt(resp); err != nil {
-			log.Println(resp.OriginalTransactionID(), err)
-			continue
+// reviewSubscriptions spreads receipts across a pool of workers, pacing lookups to LookupRate
+func (s server) reviewSubscriptions(ctx context.Context, receipts []string) ScanSummary {
+	started := time.Now()
+
+	var summary ScanSummary
+	var mu sync.Mutex
+	record := func(outcome scanOutcome) {
+		mu.Lock()
+		summary.add(outcome)
+		mu.Unlock()
+	}
+
+	review := func(receiptData string) {
+		outcome, err := s.reviewSubscription(ctx, receiptData)
+		if outcome != scanFailed || receipt.IsPermanent(err) || receipt.IsEnvironmentMismatch(err) {
+			// Receipts that will never validate aren't worth retrying
+			s.retries.remove(receiptData)
+		} else if s.retries.add(receiptData, s.RequeueLimit) {
+			mu.Lock()
+			summary.Requeued++
+			mu.Unlock()
 		}
+		record(outcome)
+	}
 
-		sub, fetchErr := s.Fetch(resp.OriginalTransactionID())
-		if fetchErr != nil {
-			log.Println(fetchErr, resp.OriginalTransactionID())
-			continue
+	var limit <-chan time.Time
+	if s.LookupRate > 0 {
+		// Rates beyond one lookup per nanosecond round down to a zero interval, which
+		// NewTicker rejects
+		interval := time.Duration(float64(time.Second) / s.LookupRate)
+		if interval < 1 {
+			interval = 1
 		}
+		limiter := time.NewTicker(interval)
+		defer limiter.Stop()
+		limit = limiter.C
+	}
+
+	workers := s.Workers
+	if workers < 1 {
+		workers = 1
+	}
 
-		// Check if expiration was pushed back before marking as paid
-		if !sub.ExpiresAt().Before(resp.ExpiresAt()) {
-			log.Println("Expiring has not renewed", sub.UserID())
+	queue := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for receiptData := range queue {
+				if limit != nil {
+					select {
+					case <-limit:
+					case <-ctx.Done():
+					}
+				}
+				if ctx.Err() != nil {
+					record(scanSkipped)
+					continue
+				}
+				review(receiptData)
+			}
+		}()
+	}
+
+	seen := make(map[string]bool, len(receipts))
+	for _, receiptData := range receipts {
+		if receiptData == "" || seen[receiptData] {
+			record(scanSkipped)
 			continue
 		}
+		seen[receiptData] = true
 
-		evt := Event{}
-		evt.SetReceiptInfo(resp)
-		evt.SetRevenue(sub.Currency(), sub.Price())
-		evt.SetUser(sub)
+		select {
+		case queue <- receiptData:
+		case <-ctx.Done():
+			record(scanSkipped)
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	summary.StartedAt = started
+	summary.Duration = time.Since(started)
+	return summary
+}
+
+func (s server) reviewSubscription(ctx context.Context, receiptData string) (scanOutcome, error) {
+	infos, err := s.lookup()(ctx, receiptData)
+	if err != nil {
+		log.Println(err, receiptData)
+		if receipt.IsConfiguration(err) {
+			log.Println("Should have configured the validator with the app's shared secret")
+		}
+
+		// Let the updater decide what to do about accounts whose receipts fail
+		if updater, ok := s.updater().(LookupErrorUpdaterContext); ok {
+			if updateErr := updater.UpdateWithLookupErrorContext(ctx, receiptData,
+				err); updateErr != nil {
+				log.Println("Should have updated with lookup error", updateErr)
+			}
+		}
+		return scanFailed, err
+	}
 
-		if err := s.Listener.Paid(evt); err != nil {
-			log.Println("Expiring Paid event error", err)
+	// A receipt has the latest transaction of every subscription group the user bought, and the
+	// store may have matched it for any of them, so review each subscription
+	outcome := scanValidated
+	var firstErr error
+	for _, resp := range infos {
+		reviewed, err := s.reviewInfo(ctx, resp)
+		if err != nil && firstErr == nil {
+			outcome, firstErr = reviewed, err
+		} else if firstErr == nil && reviewed == scanRenewed {
+			outcome = scanRenewed
 		}
 	}
+	return outcome, firstErr
+}
+
+// reviewInfo compares one subscription's last known state with fresh receipt info
+func (s server) reviewInfo(ctx context.Context, resp receipt.Info) (scanOutcome, error) {
+	// Fetch the last known state before updating, so changes can be detected
+	sub, fetchErr := s.fetch()(ctx, resp.OriginalTransactionID())
+	if fetchErr != nil {
+		log.Println(fetchErr, resp.OriginalTransactionID())
+		return scanFailed, fetchErr
+	}
+
+	if err := s.updater().UpdateWithReceiptContext(ctx, resp); err != nil {
+		log.Println(resp.OriginalTransactionID(), err)
+		return scanFailed, err
+	}
+
+	evt := Event{}
+	evt.SetReceiptInfo(resp)
+	pipeline := s.pipeline()
+	evt.SetRevenue(pipeline.revenue(sub, resp))
+	evt.SetCommission(pipeline.commission(resp))
+	evt.SetUser(sub)
+
+	// Receipts without full history can still tell a trial ending from a renewal
+	fallback := PaidRenewal
+	if sub.IsTrialPeriod() && !sub.IsInBillingRetryPeriod() {
+		fallback = PaidTrialConversion
+	}
+	evt.SetPayment(pipeline.payment(resp, fallback))
+
+	if evt.PriceConsentStatus() != receipt.PriceConsentNone ||
+		evt.ExpirationIntent() == receipt.ExpirationIntentPriceIncreaseDeclined {
+		evt.SetPriceIncrease(pipeline.priceIncrease(sub, resp))
+	}
+
+	renewed := sub.ExpiresAt().Before(evt.ExpiresAt())
+
+	now := time.Now()
+	if err := reviewChanges(s.Listener, s.Catalog, sub, evt, now); err != nil {
+		log.Println("Expiring event error", err)
+	}
+
+	if renewed {
+		return scanRenewed, nil
+	}
+	return scanValidated, nil
+}
+
+// reviewChanges compares the last known state of an expiring subscription with an event made
+// from fresh receipt info, and calls listeners for whatever happened in between. Notifications
+// may never arrive, so this should produce the same events on its own.
+func reviewChanges(listener EventListener, catalog Catalog, sub Subscription, evt Event,
+	now time.Time) error {
+
+	var firstErr error
+	changed := false
+	fire := func(err error) {
+		changed = true
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if !evt.CancelledAt().IsZero() && sub.CancelledAt().IsZero() {
+		refund := evt
+		refund.SetRefundedAt(evt.CancelledAt())
+		fire(listener.Refunded(refund))
+	}
+
+	// Receipts don't say when auto-renew changed, only that it has since the last scan
+	if !evt.renewalUnknown && sub.AutoRenewStatus() != evt.AutoRenewStatus() {
+		autoRenew := evt
+		autoRenew.SetAutoRenewChangedAt(now)
+		fire(listener.ChangedAutoRenewStatus(autoRenew))
+	}
+
+	// A product change that was pending already took effect when the new product was set to
+	// renew, so only changes that skipped the wait are immediate
+	immediate := false
+	if catalog != nil && sub.ProductID() != evt.ProductID() &&
+		sub.AutoRenewProduct() != evt.ProductID() {
+
+		if change, ok := productChange(catalog, sub.ProductID(), evt.ProductID()); ok {
+			changed := evt
+			changed.SetProductChange(change, sub.ProductID(), evt.PaidAt(), true)
+			fire(notifyProductChange(listener, changed))
+			immediate = true
+		}
+	}
+
+	// Like notifications, product changes that can be classified are reported instead of the
+	// auto-renew change, which an immediate change also made
+	if !immediate && evt.AutoRenewProduct() != "" &&
+		sub.AutoRenewProduct() != evt.AutoRenewProduct() {
+
+		autoRenew := evt
+		autoRenew.SetAutoRenewChangedAt(now)
+		if change, ok := productChange(catalog, evt.ProductID(), evt.AutoRenewProduct()); ok {
+			autoRenew.SetProductChange(change, evt.ProductID(), now, false)
+			fire(notifyProductChange(listener, autoRenew))
+		} else {
+			fire(listener.ChangedAutoRenewProduct(autoRenew))
+		}
+	}
+
+	// Price consent only matters while an increase is pending, or once declining it expired the
+	// subscription. Unknown renewal info has neither consent status nor expiration intent.
+	if evt.PriceConsentStatus() == receipt.PriceConsentPending &&
+		sub.PriceConsentStatus() != receipt.PriceConsentPending {
+
+		requested := evt
+		requested.SetPriceConsentChangedAt(now)
+		fire(listener.PriceIncreaseConsentRequested(requested))
+	} else if evt.PriceConsentStatus() == receipt.PriceConsentAccepted &&
+		sub.PriceConsentStatus() != receipt.PriceConsentAccepted {
+
+		accepted := evt
+		accepted.SetPriceConsentChangedAt(now)
+		fire(listener.PriceIncreaseAccepted(accepted))
+	} else if evt.ExpirationIntent() == receipt.ExpirationIntentPriceIncreaseDeclined &&
+		!evt.IsInBillingRetryPeriod() && !evt.ExpiredAt().After(now) &&
+		sub.ExpirationIntent() != receipt.ExpirationIntentPriceIncreaseDeclined {
+
+		declined := evt
+		declined.SetPriceConsentChangedAt(evt.ExpiredAt())
+		fire(listener.PriceIncreaseDeclined(declined))
+	}
+
+	// Check if expiration was pushed back before marking as paid, which includes converting
+	// from a free trial
+	if sub.ExpiresAt().Before(evt.ExpiresAt()) {
+		fire(listener.Paid(evt))
+		if sub.IsInBillingRetryPeriod() {
+			fire(listener.RecoveredFromBillingRetry(evt))
+		}
+	} else if evt.IsInBillingRetryPeriod() && !sub.IsInBillingRetryPeriod() {
+		if evt.GracePeriodExpiresAt().After(now) {
+			fire(listener.EnteredGracePeriod(evt))
+		} else {
+			fire(listener.EnteredBillingRetry(evt))
+		}
+	} else if evt.IsInBillingRetryPeriod() && !evt.AccessExpiresAt().After(now) &&
+		AccessExpiresAt(sub).After(evt.AccessExpiresAt()) {
+
+		// Billing retry continues with the same state, so only access last known to continue
+		// past when it ended tells the grace period ran out, however often scans run
+		fire(listener.ExitedGracePeriod(evt))
+	} else if evt.IsInBillingRetryPeriod() && evt.GracePeriodExpiresAt().After(now) {
+		fire(listener.StillInGracePeriod(evt))
+	} else if evt.ExpirationIntent() != 0 && !evt.IsInBillingRetryPeriod() &&
+		!evt.ExpiredAt().After(now) {
+
+		// Expiration intent is set during billing retry too, so only retry ending counts then
+		if sub.IsInBillingRetryPeriod() || sub.ExpirationIntent() == 0 {
+			fire(listener.Expired(evt))
+		}
+	}
+
+	if !changed {
+		log.Println("Expiring has not renewed", sub.UserID())
+	}
+	return firstErr
+}
+
+func (s server) match() ExpiringSubscriptionsContext {
+	if s.MatchContext != nil {
+		return s.MatchContext
+	}
+	return s.Match.WithContext()
+}
+
+// lookup validates receipts with Validator unless another lookup is set. Only Validator returns
+// the info of every subscription group on a receipt.
+func (s server) lookup() func(context.Context, string) ([]receipt.Info, error) {
+	if s.LookupContext != nil || s.Lookup != nil {
+		lookup := s.LookupContext
+		if lookup == nil {
+			lookup = s.Lookup.WithContext()
+		}
+		return func(ctx context.Context, receiptData string) ([]receipt.Info, error) {
+			info, err := lookup(ctx, receiptData)
+			if err != nil {
+				return nil, err
+			}
+			return []receipt.Info{info}, nil
+		}
+	}
+	return func(ctx context.Context, receiptData string) ([]receipt.Info, error) {
+		if s.Validator == nil {
+			return nil, errors.New("Receipt validator or lookup should have been set")
+		}
+		return s.Validator.ValidateAllContext(ctx, receiptData)
+	}
+}
+
+func (s server) app() appIdentity {
+	return appIdentity{bundleID: s.BundleID, appleID: s.AppAppleID}
+}
+
+func (s server) fetch() SubscriptionFetchContext {
+	return s.pipeline().fetch()
+}
+
+func (s server) updater() SubscriptionUpdaterContext {
+	return s.pipeline().updater()
+}
+
+// pipeline is the production pipeline that scans and notifications from production use
+func (s server) pipeline() Pipeline {
+	return Pipeline{
+		Fetch:                s.Fetch,
+		Updater:              s.Updater,
+		Listener:             s.Listener,
+		FetchContext:         s.FetchContext,
+		UpdaterContext:       s.UpdaterContext,
+		SmallBusinessProgram: s.SmallBusinessProgram,
+		Catalog:              s.Catalog,
+		DefaultStorefront:    s.DefaultStorefront,
+		Deduplicator:         s.Deduplicator,
+	}
 }
 
 func (s server) AddListener(l EventListener) {
@@ -175,23 +852,60 @@ func (s server) HandleFunc(pattern string, handlerFunc http.HandlerFunc) {
 	s.mux.HandleFunc(pattern, handlerFunc)
 }
 
-func NewServer(addr, secret string, matcher ExpiringSubscriptions,
+// NewServer creates a server that validates receipts and accepts V1 notifications with the
+// validator's shared secret
+func NewServer(addr string, validator *receipt.Validator, matcher ExpiringSubscriptions,
 	fetch SubscriptionFetch, updater SubscriptionUpdater, interval time.Duration) *server {
 
+	srv := newServer(addr, validator, interval)
+	srv.Match = matcher
+	srv.Fetch = fetch
+	srv.Updater = updater
+	return srv
+}
+
+// NewServerContext is NewServer for context-aware stores, whose calls are cancelled when the
+// server stops or a notification request ends
+func NewServerContext(addr string, validator *receipt.Validator,
+	matcher ExpiringSubscriptionsContext, fetch SubscriptionFetchContext,
+	updater SubscriptionUpdaterContext, interval time.Duration) *server {
+
+	srv := newServer(addr, validator, interval)
+	srv.MatchContext = matcher
+	srv.FetchContext = fetch
+	srv.UpdaterContext = updater
+	return srv
+}
+
+func newServer(addr string, validator *receipt.Validator, interval time.Duration) *server {
+
+	ctx, cancel := context.WithCancel(context.Background())
+
 	mux := http.NewServeMux()
 	srv := server{
-		Match:    matcher,
 		Listener: NewMultiEventListener(),
-		Fetch:    fetch,
-		Updater:  updater,
 		mux:      mux,
-		secret:   secret,
 		server:   &http.Server{Addr: addr, Handler: mux},
 		Ticker:   time.NewTicker(interval),
+		scanning: new(int32),
+		interval: interval,
+		ctx:      ctx,
+		cancel:   cancel,
+		scans:    new(sync.WaitGroup),
+		Workers:  1,
+
+		RequeueLimit: 3,
+		retries:      newRetryQueue(),
+	}
+
+	if validator != nil {
+		srv.Validator = validator
+		srv.Secrets = []string{validator.Secret}
 	}
 
 	mux.HandleFunc("/superscribe", func(w http.ResponseWriter, r *http.Request) {
-		notificationHandler(w, r, srv.Listener, fetch, updater)
+		notificationHandler(w, r, srv.pipeline(), srv.Sandbox, srv.Roots, srv.app(),
+			srv.Secrets, srv.Journal)
 	})
 
 	return &srv
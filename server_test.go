@@ -2,6 +2,8 @@ package superscribe
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -13,6 +15,8 @@ import (
 	"github.com/carpenterscode/superscribe/receipt"
 )
 
+var testValidator = receipt.NewValidator("secret")
+
 type EventMatcher struct {
 	a Event
 }
@@ -28,6 +32,9 @@ func (m EventMatcher) Matches(x interface{}) bool {
 			m.a.IsTrialPeriod() == b.IsTrialPeriod() &&
 			m.a.ExpiresAt().Equal(b.ExpiresAt()) &&
 			m.a.PaidAt().Equal(b.PaidAt()) &&
+			m.a.PaymentKind() == b.PaymentKind() &&
+			m.a.OfferType() == b.OfferType() &&
+			m.a.OfferDiscountType() == b.OfferDiscountType() &&
 			m.a.StartedTrialAt().Equal(b.StartedTrialAt()) &&
 			m.a.Price() == b.Price() &&
 			m.a.Currency() == b.Currency()
@@ -51,11 +58,23 @@ func expectedEvent() Event {
 		autoRenewProductID: productID,
 		autoRenewStatus:    true,
 
+		offerType:         receipt.OfferTypeIntroductory,
+		offerDiscountType: receipt.OfferDiscountFreeTrial,
+
 		price:    price,
 		currency: currency,
 	}
 }
 
+// paidEvent is expectedEvent once the free trial has converted
+func paidEvent() Event {
+	evt := expectedEvent()
+	evt.isTrialPeriod = false
+	evt.offerType = 0
+	evt.offerDiscountType = ""
+	return evt
+}
+
 func TestHandleInitialBuyToTrial(t *testing.T) {
 
 	// Load test data
@@ -82,7 +101,7 @@ func TestHandleInitialBuyToTrial(t *testing.T) {
 		return mockSub, nil
 	}
 
-	srv := NewServer("http://example.com", "secret", fakeMatcher, fakeFetcher, fakeUpdater, 1)
+	srv := NewServer("http://example.com", testValidator, fakeMatcher, fakeFetcher, fakeUpdater, 1)
 	srv.Listener.Add(mockListener)
 
 	// Test code
@@ -102,8 +121,8 @@ func TestHandleInitialBuyToSubscribe(t *testing.T) {
 	dataReader := bytes.NewReader(dataFromFile("INITIAL_BUY_to_subscribe.json"))
 
 	// Expected result
-	expected := expectedEvent()
-	expected.isTrialPeriod = false
+	expected := paidEvent()
+	expected.paymentKind = PaidInitialPurchase
 
 	// Set up mocks and fakes
 	ctrl := gomock.NewController(t)
@@ -122,7 +141,63 @@ func TestHandleInitialBuyToSubscribe(t *testing.T) {
 		return mockSub, nil
 	}
 
-	srv := NewServer("http://example.com", "secret", fakeMatcher, fakeFetcher, fakeUpdater, 1)
+	srv := NewServer("http://example.com", testValidator, fakeMatcher, fakeFetcher, fakeUpdater, 1)
+	srv.Listener.Add(mockListener)
+
+	// Test code
+	req := httptest.NewRequest("POST", "http://example.com/superscribe", dataReader)
+	w := httptest.NewRecorder()
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Wrong status code: got %v want %v", w.Code, http.StatusOK)
+	}
+}
+
+// creatingUpdater stores subscribers the first time it hears about them
+type creatingUpdater struct {
+	subs map[string]Subscription
+	sub  Subscription
+}
+
+func (updater creatingUpdater) UpdateWithNotification(note Note) error {
+	updater.subs[note.OriginalTransactionID()] = updater.sub
+	return nil
+}
+
+func (updater creatingUpdater) UpdateWithReceipt(r receipt.Info) error {
+	updater.subs[r.OriginalTransactionID()] = updater.sub
+	return nil
+}
+
+func TestHandleInitialBuyForNewSubscriber(t *testing.T) {
+
+	// Load test data
+	dataReader := bytes.NewReader(dataFromFile("INITIAL_BUY_to_subscribe.json"))
+
+	// Set up mocks and fakes
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSub := NewMockSubscription(ctrl)
+	mockSub.EXPECT().Currency().Return(currency).AnyTimes()
+	mockSub.EXPECT().Price().Return(price).AnyTimes()
+
+	mockListener := NewMockEventListener(ctrl)
+	mockListener.EXPECT().Paid(gomock.Any()).Times(1)
+
+	// The store doesn't have the subscriber until the updater adds it
+	subs := make(map[string]Subscription)
+	fakeMatcher := func(now time.Time) []string { return []string{} }
+	fakeUpdater := creatingUpdater{subs, mockSub}
+	fakeFetcher := func(originalTransactionID string) (Subscription, error) {
+		sub, ok := subs[originalTransactionID]
+		if !ok {
+			return nil, errors.New("Subscription not found")
+		}
+		return sub, nil
+	}
+
+	srv := NewServer("http://example.com", testValidator, fakeMatcher, fakeFetcher, fakeUpdater, 1)
 	srv.Listener.Add(mockListener)
 
 	// Test code
@@ -140,8 +215,8 @@ func TestHandleRenewal(t *testing.T) {
 	dataReader := bytes.NewReader(dataFromFile("RENEWAL.json"))
 
 	// Expected result
-	expected := expectedEvent()
-	expected.isTrialPeriod = false
+	expected := paidEvent()
+	expected.paymentKind = PaidRenewal
 
 	// Set up mocks and fakes
 	ctrl := gomock.NewController(t)
@@ -160,7 +235,7 @@ func TestHandleRenewal(t *testing.T) {
 		return mockSub, nil
 	}
 
-	srv := NewServer("http://example.com", "secret", fakeMatcher, fakeFetcher, fakeUpdater, 1)
+	srv := NewServer("http://example.com", testValidator, fakeMatcher, fakeFetcher, fakeUpdater, 1)
 	srv.Listener.Add(mockListener)
 
 	// Test code
@@ -178,8 +253,8 @@ func TestHandleInteractiveRenewal(t *testing.T) {
 	dataReader := bytes.NewReader(dataFromFile("INTERACTIVE_RENEWAL.json"))
 
 	// Expected result
-	expected := expectedEvent()
-	expected.isTrialPeriod = false
+	expected := paidEvent()
+	expected.paymentKind = PaidResubscribe
 
 	// Set up mocks and fakes
 	ctrl := gomock.NewController(t)
@@ -198,7 +273,7 @@ func TestHandleInteractiveRenewal(t *testing.T) {
 		return mockSub, nil
 	}
 
-	srv := NewServer("http://example.com", "secret", fakeMatcher, fakeFetcher, fakeUpdater, 1)
+	srv := NewServer("http://example.com", testValidator, fakeMatcher, fakeFetcher, fakeUpdater, 1)
 	srv.Listener.Add(mockListener)
 
 	// Test code
@@ -216,9 +291,8 @@ func TestHandleCancel(t *testing.T) {
 	dataReader := bytes.NewReader(dataFromFile("CANCEL.json"))
 
 	// Expected result
-	expected := expectedEvent()
+	expected := paidEvent()
 	expected.autoRenewStatus = false
-	expected.isTrialPeriod = false
 	expected.cancelledAt = cancellationDate
 	expected.expiresAt = expiresDate
 
@@ -239,7 +313,95 @@ func TestHandleCancel(t *testing.T) {
 		return mockSub, nil
 	}
 
-	srv := NewServer("http://example.com", "secret", fakeMatcher, fakeFetcher, fakeUpdater, 1)
+	srv := NewServer("http://example.com", testValidator, fakeMatcher, fakeFetcher, fakeUpdater, 1)
+	srv.Listener.Add(mockListener)
+
+	// Test code
+	req := httptest.NewRequest("POST", "http://example.com/superscribe", dataReader)
+	w := httptest.NewRecorder()
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Wrong status code: got %v want %v", w.Code, http.StatusOK)
+	}
+}
+
+// testCatalog has basic and premium levels of one subscription group
+var testCatalog = Products{
+	"month-basic":   {ID: "month-basic", Group: "app", Level: 2},
+	"month-premium": {ID: "month-premium", Group: "app", Level: 1},
+	"year-premium":  {ID: "year-premium", Group: "app", Level: 1},
+}
+
+func TestHandleUpgradeCancel(t *testing.T) {
+
+	// Load test data
+	dataReader := bytes.NewReader(dataFromFile("CANCEL_upgrade.json"))
+
+	// Set up mocks and fakes
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSub := NewMockSubscription(ctrl)
+	mockSub.EXPECT().Currency().Return(currency).AnyTimes()
+	mockSub.EXPECT().Price().Return(price).AnyTimes()
+
+	mockListener := NewMockEventListener(ctrl)
+	mockListener.EXPECT().Upgraded(gomock.Any()).DoAndReturn(func(evt ProductChangeEvent) error {
+		if evt.PreviousProductID() != "month-basic" || evt.ProductID() != productID {
+			t.Error("Should have upgraded from basic", evt.PreviousProductID(), evt.ProductID())
+		} else if !evt.IsProductChangeImmediate() ||
+			!evt.ProductChangedAt().Equal(cancellationDate) {
+			t.Error("Should have upgraded immediately", evt.ProductChangedAt())
+		}
+		return nil
+	}).Times(1)
+
+	fakeMatcher := func(now time.Time) []string { return []string{} }
+	fakeFetcher := func(originalTransactionID string) (Subscription, error) {
+		return mockSub, nil
+	}
+
+	srv := NewServer("http://example.com", testValidator, fakeMatcher, fakeFetcher, stubUpdater{}, 1)
+	srv.Catalog = testCatalog
+	srv.Listener.Add(mockListener)
+
+	// Test code
+	req := httptest.NewRequest("POST", "http://example.com/superscribe", dataReader)
+	w := httptest.NewRecorder()
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Wrong status code: got %v want %v", w.Code, http.StatusOK)
+	}
+}
+
+func TestHandleLegacyUpgradeCancel(t *testing.T) {
+
+	// Load test data
+	dataReader := bytes.NewReader(dataFromFile("CANCEL_upgrade_legacy.json"))
+
+	// Set up mocks and fakes
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSub := NewMockSubscription(ctrl)
+	mockSub.EXPECT().Currency().Return(currency).AnyTimes()
+	mockSub.EXPECT().Price().Return(price).AnyTimes()
+
+	mockListener := NewMockEventListener(ctrl)
+	mockListener.EXPECT().Upgraded(gomock.Any()).DoAndReturn(func(evt ProductChangeEvent) error {
+		if evt.PreviousProductID() != "month-basic" || !evt.IsProductChangeImmediate() {
+			t.Error("Should have upgraded immediately from basic", evt.PreviousProductID())
+		}
+		return nil
+	}).Times(1)
+
+	fakeMatcher := func(now time.Time) []string { return []string{} }
+	fakeFetcher := func(originalTransactionID string) (Subscription, error) {
+		return mockSub, nil
+	}
+
+	// Without a catalog, upgrades are told from refunds by the cancelled transaction alone
+	srv := NewServer("http://example.com", testValidator, fakeMatcher, fakeFetcher, stubUpdater{}, 1)
 	srv.Listener.Add(mockListener)
 
 	// Test code
@@ -278,7 +440,7 @@ func TestHandleDidChangeRenewalStatusToOff(t *testing.T) {
 		return mockSub, nil
 	}
 
-	srv := NewServer("http://example.com", "secret", fakeMatcher, fakeFetcher, fakeUpdater, 1)
+	srv := NewServer("http://example.com", testValidator, fakeMatcher, fakeFetcher, fakeUpdater, 1)
 	srv.Listener.Add(mockListener)
 
 	// Test code
@@ -317,7 +479,7 @@ func TestHandleDidChangeRenewalStatusToOn(t *testing.T) {
 		return mockSub, nil
 	}
 
-	srv := NewServer("http://example.com", "secret", fakeMatcher, fakeFetcher, fakeUpdater, 1)
+	srv := NewServer("http://example.com", testValidator, fakeMatcher, fakeFetcher, fakeUpdater, 1)
 	srv.Listener.Add(mockListener)
 
 	// Test code
@@ -348,7 +510,15 @@ func TestHandleDidChangeRenewalPref(t *testing.T) {
 	mockSub.EXPECT().Price().Return(price).AnyTimes()
 
 	mockListener := NewMockEventListener(ctrl)
-	mockListener.EXPECT().ChangedAutoRenewProduct(EventMatcher{expected}).Times(1)
+	mockListener.EXPECT().Crossgraded(gomock.Any()).DoAndReturn(
+		func(evt ProductChangeEvent) error {
+			if evt.PreviousProductID() != productID || evt.IsProductChangeImmediate() {
+				t.Error("Should have crossgraded at the next renewal", evt.PreviousProductID())
+			} else if evt.AutoRenewProduct() != newProductID {
+				t.Error("Should have set the product to renew", evt.AutoRenewProduct())
+			}
+			return nil
+		}).Times(1)
 
 	fakeMatcher := func(now time.Time) []string { return []string{} }
 	fakeUpdater := stubUpdater{}
@@ -356,7 +526,8 @@ func TestHandleDidChangeRenewalPref(t *testing.T) {
 		return mockSub, nil
 	}
 
-	srv := NewServer("http://example.com", "secret", fakeMatcher, fakeFetcher, fakeUpdater, 1)
+	srv := NewServer("http://example.com", testValidator, fakeMatcher, fakeFetcher, fakeUpdater, 1)
+	srv.Catalog = testCatalog
 	srv.Listener.Add(mockListener)
 
 	// Test code
@@ -366,6 +537,35 @@ func TestHandleDidChangeRenewalPref(t *testing.T) {
 	if w.Code != http.StatusOK {
 		t.Errorf("Wrong status code: got %v want %v", w.Code, http.StatusOK)
 	}
+
+	// Without a catalog, only the auto-renew product change is known
+	mockListener.EXPECT().ChangedAutoRenewProduct(EventMatcher{expected}).Times(1)
+	srv.Catalog = nil
+
+	req = httptest.NewRequest("POST", "http://example.com/superscribe",
+		bytes.NewReader(dataFromFile("DID_CHANGE_RENEWAL_PREF.json")))
+	w = httptest.NewRecorder()
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Wrong status code: got %v want %v", w.Code, http.StatusOK)
+	}
+
+	// V1 notifications don't say when the product changed, so replays keep when it was received
+	receivedAt := time.Date(2019, time.March, 6, 0, 0, 0, 0, time.UTC)
+	mockListener.EXPECT().ChangedAutoRenewProduct(gomock.Any()).DoAndReturn(
+		func(evt AutoRenewEvent) error {
+			if !evt.AutoRenewChangedAt().Equal(receivedAt) {
+				t.Error("Should have changed the product when received", evt.AutoRenewChangedAt())
+			}
+			return nil
+		}).Times(1)
+
+	status, err := processNotification(context.Background(),
+		dataFromFile("DID_CHANGE_RENEWAL_PREF.json"), receivedAt, srv.pipeline(), nil, nil,
+		srv.app(), srv.Secrets)
+	if status != http.StatusOK || err != nil {
+		t.Error("Should have processed the notification", status, err)
+	}
 }
 
 type stubUpdater struct{}
@@ -377,3 +577,1007 @@ func (updater stubUpdater) UpdateWithNotification(note Note) error {
 func (updater stubUpdater) UpdateWithReceipt(r receipt.Info) error {
 	return nil
 }
+
+// fakeInfo is receipt.Info as looked up during a scan
+type fakeInfo struct {
+	autoRenewProduct       string
+	autoRenewStatus        bool
+	cancelledAt            time.Time
+	expirationIntent       int
+	expiresAt              time.Time
+	gracePeriodExpiresAt   time.Time
+	isInBillingRetryPeriod bool
+	isTrialPeriod          bool
+	offerCodeRefName       string
+	offerIdentifier        string
+	offerType              int
+	originalTransactionID  string
+	paidAt                 time.Time
+	priceConsentStatus     *int
+	productID              string
+	promotionalOfferID     string
+	status                 int
+	transactions           []receipt.Transaction
+}
+
+func (info fakeInfo) Status() int                     { return info.status }
+func (info fakeInfo) AutoRenewProduct() string        { return info.autoRenewProduct }
+func (info fakeInfo) AutoRenewStatus() bool           { return info.autoRenewStatus }
+func (info fakeInfo) CancelledAt() time.Time          { return info.cancelledAt }
+func (info fakeInfo) ExpiresAt() time.Time            { return info.expiresAt }
+func (info fakeInfo) IsTrialPeriod() bool             { return info.isTrialPeriod }
+func (info fakeInfo) OriginalTransactionID() string   { return info.originalTransactionID }
+func (info fakeInfo) OriginalPurchaseDate() time.Time { return info.paidAt }
+func (info fakeInfo) PaidAt() time.Time               { return info.paidAt }
+func (info fakeInfo) ProductID() string               { return info.productID }
+func (info fakeInfo) ExpirationIntent() int           { return info.expirationIntent }
+func (info fakeInfo) GracePeriodExpiresAt() time.Time { return info.gracePeriodExpiresAt }
+func (info fakeInfo) IsInBillingRetryPeriod() bool    { return info.isInBillingRetryPeriod }
+func (info fakeInfo) OfferCodeRefName() string        { return info.offerCodeRefName }
+func (info fakeInfo) PromotionalOfferID() string      { return info.promotionalOfferID }
+
+func (info fakeInfo) PriceConsentStatus() int {
+	if info.priceConsentStatus == nil {
+		return receipt.PriceConsentNone
+	}
+	return *info.priceConsentStatus
+}
+
+func (info fakeInfo) IsInIntroOfferPeriod() bool { return false }
+func (info fakeInfo) OfferType() int             { return info.offerType }
+func (info fakeInfo) OfferIdentifier() string    { return info.offerIdentifier }
+func (info fakeInfo) OfferDiscountType() string  { return "" }
+
+func (info fakeInfo) Transactions() []receipt.Transaction { return info.transactions }
+
+func TestReviewSubscriptionsByTransactionID(t *testing.T) {
+
+	// Expected result
+	expected := paidEvent()
+	expected.paymentKind = PaidRenewal
+	expected.startedTrialAt = time.Time{}
+
+	// Set up mocks and fakes
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSub := NewMockSubscription(ctrl)
+	mockSub.EXPECT().ExpiresAt().Return(expiresDate.AddDate(0, 0, -7)).AnyTimes()
+	mockSub.EXPECT().IsInBillingRetryPeriod().Return(false).AnyTimes()
+	mockSub.EXPECT().IsTrialPeriod().Return(false).AnyTimes()
+	mockSub.EXPECT().AutoRenewStatus().Return(true).AnyTimes()
+	mockSub.EXPECT().AutoRenewProduct().Return(productID).AnyTimes()
+	mockSub.EXPECT().CancelledAt().Return(time.Time{}).AnyTimes()
+	mockSub.EXPECT().Currency().Return(currency).AnyTimes()
+	mockSub.EXPECT().Price().Return(price).AnyTimes()
+
+	mockListener := NewMockEventListener(ctrl)
+	mockListener.EXPECT().Paid(EventMatcher{expected}).Times(1)
+
+	fakeMatcher := func(now time.Time) []string { return []string{originalTransactionID} }
+	fakeFetcher := func(originalTransactionID string) (Subscription, error) {
+		return mockSub, nil
+	}
+
+	srv := NewServer("http://example.com", testValidator, fakeMatcher, fakeFetcher, stubUpdater{}, 1)
+	srv.Lookup = func(id string) (receipt.Info, error) {
+		if id != originalTransactionID {
+			t.Error("Should have looked up by original transaction ID", id)
+		}
+		return fakeInfo{
+			autoRenewProduct:      productID,
+			autoRenewStatus:       true,
+			expiresAt:             expiresDate,
+			originalTransactionID: originalTransactionID,
+			paidAt:                purchaseDate,
+			productID:             productID,
+		}, nil
+	}
+	srv.Listener.Add(mockListener)
+
+	// Test code
+	srv.Scan(time.Now())
+}
+
+func TestHandleDidRecover(t *testing.T) {
+
+	// Load test data
+	dataReader := bytes.NewReader(dataFromFile("DID_RECOVER.json"))
+
+	// Expected result
+	expected := paidEvent()
+	expected.paymentKind = PaidTrialConversion
+
+	// Set up mocks and fakes
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSub := NewMockSubscription(ctrl)
+	mockSub.EXPECT().Currency().Return(currency).AnyTimes()
+	mockSub.EXPECT().Price().Return(price).AnyTimes()
+
+	mockListener := NewMockEventListener(ctrl)
+	mockListener.EXPECT().Paid(EventMatcher{expected}).Times(1)
+	mockListener.EXPECT().RecoveredFromBillingRetry(EventMatcher{expected}).Times(1)
+
+	fakeMatcher := func(now time.Time) []string { return []string{} }
+	fakeFetcher := func(originalTransactionID string) (Subscription, error) {
+		return mockSub, nil
+	}
+
+	srv := NewServer("http://example.com", testValidator, fakeMatcher, fakeFetcher, stubUpdater{}, 1)
+	srv.Listener.Add(mockListener)
+
+	// Test code
+	req := httptest.NewRequest("POST", "http://example.com/superscribe", dataReader)
+	w := httptest.NewRecorder()
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Wrong status code: got %v want %v", w.Code, http.StatusOK)
+	}
+}
+
+func TestHandlePriceIncreaseConsent(t *testing.T) {
+
+	// Load test data
+	dataReader := bytes.NewReader(dataFromFile("PRICE_INCREASE_CONSENT.json"))
+
+	// Set up mocks and fakes
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSub := NewMockSubscription(ctrl)
+	mockSub.EXPECT().Currency().Return(currency).AnyTimes()
+	mockSub.EXPECT().Price().Return(price).AnyTimes()
+
+	var changedAt time.Time
+	mockListener := NewMockEventListener(ctrl)
+	mockListener.EXPECT().PriceIncreaseConsentRequested(gomock.Any()).DoAndReturn(
+		func(evt PriceIncreaseEvent) error {
+			if evt.PriceConsentStatus() != receipt.PriceConsentPending ||
+				evt.PreviousPrice() != price || evt.NewPrice() != 12.99 {
+				t.Error("Should have requested consent from 9.99 to 12.99", evt)
+			}
+			changedAt = evt.PriceConsentChangedAt()
+			return nil
+		}).Times(1)
+
+	fakeMatcher := func(now time.Time) []string { return []string{} }
+	fakeFetcher := func(originalTransactionID string) (Subscription, error) {
+		return mockSub, nil
+	}
+
+	srv := NewServer("http://example.com", testValidator, fakeMatcher, fakeFetcher, stubUpdater{}, 1)
+	srv.Listener.Add(mockListener)
+	srv.Catalog = Products{productID: {ID: productID, Duration: "P1Y",
+		Prices: map[string]Price{"USA": {currency, 12.99}}}}
+	srv.DefaultStorefront = "USA"
+	journal := &fakeJournal{}
+	srv.Journal = journal
+
+	// Test code
+	req := httptest.NewRequest("POST", "http://example.com/superscribe", dataReader)
+	w := httptest.NewRecorder()
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Wrong status code: got %v want %v", w.Code, http.StatusOK)
+	}
+
+	// V1 notifications aren't dated, so consent changed when the notification arrived
+	if len(journal.entries) != 1 || !changedAt.Equal(journal.entries[0].ReceivedAt) {
+		t.Error("Should have changed consent when the notification was received", changedAt)
+	}
+}
+
+// recordingUpdater fails the test if the handler reaches the updater
+type recordingUpdater struct {
+	t *testing.T
+}
+
+func (updater recordingUpdater) UpdateWithNotification(note Note) error {
+	updater.t.Error("Should not have updated with notification", note.Type())
+	return nil
+}
+
+func (updater recordingUpdater) UpdateWithReceipt(r receipt.Info) error {
+	updater.t.Error("Should not have updated with receipt", r.OriginalTransactionID())
+	return nil
+}
+
+func TestHandleMismatchedSecret(t *testing.T) {
+
+	// Set up mocks and fakes
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockListener := NewMockEventListener(ctrl)
+
+	fakeMatcher := func(now time.Time) []string { return []string{} }
+	fakeFetcher := func(originalTransactionID string) (Subscription, error) {
+		t.Error("Should not have fetched subscription")
+		return nil, nil
+	}
+
+	srv := NewServer("http://example.com", receipt.NewValidator("other-secret"), fakeMatcher,
+		fakeFetcher, recordingUpdater{t}, 1)
+	srv.Listener.Add(mockListener)
+
+	// Test code
+	req := httptest.NewRequest("POST", "http://example.com/superscribe",
+		bytes.NewReader(dataFromFile("RENEWAL.json")))
+	w := httptest.NewRecorder()
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Wrong status code: got %v want %v", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestHandleRotatedSecret(t *testing.T) {
+
+	// Set up mocks and fakes
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSub := NewMockSubscription(ctrl)
+	mockSub.EXPECT().Currency().Return(currency).AnyTimes()
+	mockSub.EXPECT().Price().Return(price).AnyTimes()
+
+	mockListener := NewMockEventListener(ctrl)
+	mockListener.EXPECT().Paid(gomock.Any()).Times(1)
+
+	fakeMatcher := func(now time.Time) []string { return []string{} }
+	fakeFetcher := func(originalTransactionID string) (Subscription, error) {
+		return mockSub, nil
+	}
+
+	srv := NewServer("http://example.com", receipt.NewValidator("new-secret"), fakeMatcher,
+		fakeFetcher, stubUpdater{}, 1)
+	srv.Secrets = append(srv.Secrets, "secret")
+	srv.Listener.Add(mockListener)
+
+	// Test code
+	req := httptest.NewRequest("POST", "http://example.com/superscribe",
+		bytes.NewReader(dataFromFile("RENEWAL.json")))
+	w := httptest.NewRecorder()
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Wrong status code: got %v want %v", w.Code, http.StatusOK)
+	}
+}
+
+func TestHandleSandboxWithoutPipeline(t *testing.T) {
+
+	// Set up mocks and fakes
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockListener := NewMockEventListener(ctrl)
+
+	fakeMatcher := func(now time.Time) []string { return []string{} }
+	fakeFetcher := func(originalTransactionID string) (Subscription, error) {
+		t.Error("Should not have fetched subscription")
+		return nil, nil
+	}
+
+	srv := NewServer("http://example.com", testValidator, fakeMatcher, fakeFetcher,
+		recordingUpdater{t}, 1)
+	srv.Listener.Add(mockListener)
+
+	// Test code
+	req := httptest.NewRequest("POST", "http://example.com/superscribe",
+		bytes.NewReader(dataFromFile("RENEWAL_sandbox.json")))
+	w := httptest.NewRecorder()
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Wrong status code: got %v want %v", w.Code, http.StatusForbidden)
+	}
+}
+
+func TestHandleSandboxPipeline(t *testing.T) {
+
+	// Expected result
+	expected := paidEvent()
+	expected.paymentKind = PaidRenewal
+
+	// Set up mocks and fakes
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSub := NewMockSubscription(ctrl)
+	mockSub.EXPECT().Currency().Return(currency).AnyTimes()
+	mockSub.EXPECT().Price().Return(price).AnyTimes()
+
+	prodListener := NewMockEventListener(ctrl)
+	sandboxListener := NewMockEventListener(ctrl)
+	sandboxListener.EXPECT().Paid(EventMatcher{expected}).Times(1)
+
+	fakeMatcher := func(now time.Time) []string { return []string{} }
+	prodFetcher := func(originalTransactionID string) (Subscription, error) {
+		t.Error("Should not have fetched subscription from production")
+		return nil, nil
+	}
+	sandboxFetcher := func(originalTransactionID string) (Subscription, error) {
+		return mockSub, nil
+	}
+
+	srv := NewServer("http://example.com", testValidator, fakeMatcher, prodFetcher,
+		recordingUpdater{t}, 1)
+	srv.Listener.Add(prodListener)
+	srv.Sandbox = NewPipeline(sandboxFetcher, stubUpdater{})
+	srv.Sandbox.AddListener(sandboxListener)
+
+	// Test code
+	req := httptest.NewRequest("POST", "http://example.com/superscribe",
+		bytes.NewReader(dataFromFile("RENEWAL_sandbox.json")))
+	w := httptest.NewRecorder()
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Wrong status code: got %v want %v", w.Code, http.StatusOK)
+	}
+}
+
+func TestHandleDidFailToRenew(t *testing.T) {
+
+	// Set up mocks and fakes
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSub := NewMockSubscription(ctrl)
+	mockSub.EXPECT().Currency().Return(currency).AnyTimes()
+	mockSub.EXPECT().Price().Return(price).AnyTimes()
+
+	mockListener := NewMockEventListener(ctrl)
+	mockListener.EXPECT().EnteredGracePeriod(gomock.Any()).Times(1)
+
+	fakeMatcher := func(now time.Time) []string { return []string{} }
+	fakeFetcher := func(originalTransactionID string) (Subscription, error) {
+		return mockSub, nil
+	}
+
+	srv := NewServer("http://example.com", testValidator, fakeMatcher, fakeFetcher, stubUpdater{}, 1)
+	srv.Listener.Add(mockListener)
+
+	// Test code
+	req := httptest.NewRequest("POST", "http://example.com/superscribe",
+		bytes.NewReader(dataFromFile("DID_FAIL_TO_RENEW.json")))
+	w := httptest.NewRecorder()
+	srv.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Wrong status code: got %v want %v", w.Code, http.StatusOK)
+	}
+}
+
+// expectUnchangedSettings matches a zero Event's auto-renew and cancellation state
+func expectUnchangedSettings(mockSub *MockSubscription) {
+	mockSub.EXPECT().AutoRenewStatus().Return(false).AnyTimes()
+	mockSub.EXPECT().AutoRenewProduct().Return("").AnyTimes()
+	mockSub.EXPECT().CancelledAt().Return(time.Time{}).AnyTimes()
+}
+
+func TestReviewChangesBillingRetry(t *testing.T) {
+	now := expiresDate.Add(time.Hour)
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSub := NewMockSubscription(ctrl)
+	expectUnchangedSettings(mockSub)
+	mockSub.EXPECT().ExpiresAt().Return(expiresDate).AnyTimes()
+	mockSub.EXPECT().IsInBillingRetryPeriod().Return(false).AnyTimes()
+	mockSub.EXPECT().ExpirationIntent().Return(0).AnyTimes()
+
+	mockListener := NewMockEventListener(ctrl)
+	mockListener.EXPECT().EnteredBillingRetry(gomock.Any()).Times(1)
+	mockListener.EXPECT().EnteredGracePeriod(gomock.Any()).Times(1)
+
+	evt := Event{
+		expiresAt:              expiresDate,
+		expirationIntent:       receipt.ExpirationIntentBillingError,
+		isInBillingRetryPeriod: true,
+	}
+	if err := reviewChanges(mockListener, nil, mockSub, evt, now); err != nil {
+		t.Error(err)
+	}
+
+	evt.gracePeriodExpiresAt = now.AddDate(0, 0, 6)
+	if err := reviewChanges(mockListener, nil, mockSub, evt, now); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReviewChangesGracePeriod(t *testing.T) {
+	now := expiresDate.AddDate(0, 0, 6)
+	endedAt := now.Add(-time.Second)
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// Last known to be entitled during the grace period
+	entitled := NewMockSubscription(ctrl)
+	expectUnchangedSettings(entitled)
+	entitled.EXPECT().ExpiresAt().Return(expiresDate).AnyTimes()
+	entitled.EXPECT().GracePeriodExpiresAt().Return(now.Add(time.Hour)).AnyTimes()
+	entitled.EXPECT().IsInBillingRetryPeriod().Return(true).AnyTimes()
+	entitled.EXPECT().ExpirationIntent().Return(receipt.ExpirationIntentBillingError).AnyTimes()
+	entitled.EXPECT().UserID().Return("user").AnyTimes()
+
+	// Already updated with the grace period's end by an earlier scan
+	ended := NewMockSubscription(ctrl)
+	expectUnchangedSettings(ended)
+	ended.EXPECT().ExpiresAt().Return(expiresDate).AnyTimes()
+	ended.EXPECT().GracePeriodExpiresAt().Return(endedAt).AnyTimes()
+	ended.EXPECT().IsInBillingRetryPeriod().Return(true).AnyTimes()
+	ended.EXPECT().ExpirationIntent().Return(receipt.ExpirationIntentBillingError).AnyTimes()
+	ended.EXPECT().UserID().Return("user").AnyTimes()
+
+	mockListener := NewMockEventListener(ctrl)
+	mockListener.EXPECT().StillInGracePeriod(gomock.Any()).Times(1)
+	mockListener.EXPECT().ExitedGracePeriod(gomock.Any()).DoAndReturn(
+		func(evt BillingRetryEvent) error {
+			if !evt.AccessExpiresAt().Equal(endedAt) {
+				t.Error("Should have had access until the grace period ended",
+					evt.AccessExpiresAt())
+			}
+			return nil
+		}).Times(1)
+
+	evt := Event{
+		expiresAt:              expiresDate,
+		expirationIntent:       receipt.ExpirationIntentBillingError,
+		isInBillingRetryPeriod: true,
+	}
+
+	// Still entitled
+	evt.gracePeriodExpiresAt = now.Add(time.Hour)
+	if err := reviewChanges(mockListener, nil, entitled, evt, now); err != nil {
+		t.Error(err)
+	}
+
+	// Ended, even if scans were skipped since
+	evt.gracePeriodExpiresAt = endedAt
+	if err := reviewChanges(mockListener, nil, entitled, evt, now.AddDate(0, 0, 1)); err != nil {
+		t.Error(err)
+	}
+
+	// Ended and already reported, even if scanned again right away
+	if err := reviewChanges(mockListener, nil, ended, evt, now); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReviewChangesExpired(t *testing.T) {
+	now := expiresDate.Add(time.Hour)
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// Billing retry ran out, and Apple had already set the billing error expiration intent
+	retrying := NewMockSubscription(ctrl)
+	expectUnchangedSettings(retrying)
+	retrying.EXPECT().ExpiresAt().Return(expiresDate).AnyTimes()
+	retrying.EXPECT().IsInBillingRetryPeriod().Return(true).AnyTimes()
+	retrying.EXPECT().ExpirationIntent().Return(receipt.ExpirationIntentBillingError).AnyTimes()
+
+	// Already known to have expired
+	expired := NewMockSubscription(ctrl)
+	expectUnchangedSettings(expired)
+	expired.EXPECT().ExpiresAt().Return(expiresDate).AnyTimes()
+	expired.EXPECT().IsInBillingRetryPeriod().Return(false).AnyTimes()
+	expired.EXPECT().ExpirationIntent().Return(receipt.ExpirationIntentBillingError).AnyTimes()
+	expired.EXPECT().UserID().Return("user").AnyTimes()
+
+	mockListener := NewMockEventListener(ctrl)
+	mockListener.EXPECT().Expired(gomock.Any()).Times(1)
+
+	evt := Event{
+		expiresAt:        expiresDate,
+		expirationIntent: receipt.ExpirationIntentBillingError,
+	}
+	if err := reviewChanges(mockListener, nil, retrying, evt, now); err != nil {
+		t.Error(err)
+	}
+	if err := reviewChanges(mockListener, nil, expired, evt, now); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReviewChangesSettings(t *testing.T) {
+	now := expiresDate.Add(-time.Hour)
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSub := NewMockSubscription(ctrl)
+	mockSub.EXPECT().ExpiresAt().Return(expiresDate).AnyTimes()
+	mockSub.EXPECT().AutoRenewStatus().Return(true).AnyTimes()
+	mockSub.EXPECT().AutoRenewProduct().Return(productID).AnyTimes()
+	mockSub.EXPECT().CancelledAt().Return(time.Time{}).AnyTimes()
+	mockSub.EXPECT().IsInBillingRetryPeriod().Return(false).AnyTimes()
+
+	expected := Event{
+		originalTransactionID: originalTransactionID,
+		productID:             productID,
+		expiresAt:             expiresDate,
+		autoRenewProductID:    newProductID,
+		autoRenewChangedAt:    now,
+		cancelledAt:           cancellationDate,
+		refundedAt:            cancellationDate,
+	}
+
+	mockListener := NewMockEventListener(ctrl)
+	mockListener.EXPECT().Refunded(gomock.Any()).DoAndReturn(func(evt RefundEvent) error {
+		if !evt.RefundedAt().Equal(cancellationDate) {
+			t.Error("Should have refunded at cancellation date", evt.RefundedAt())
+		}
+		return nil
+	})
+	mockListener.EXPECT().ChangedAutoRenewStatus(EventMatcher{expected}).Times(1)
+	mockListener.EXPECT().ChangedAutoRenewProduct(EventMatcher{expected}).Times(1)
+
+	evt := Event{
+		originalTransactionID: originalTransactionID,
+		productID:             productID,
+		expiresAt:             expiresDate,
+		autoRenewProductID:    newProductID,
+		cancelledAt:           cancellationDate,
+	}
+	if err := reviewChanges(mockListener, nil, mockSub, evt, now); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReviewChangesUnknownRenewalInfo(t *testing.T) {
+	now := expiresDate.Add(-time.Hour)
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSub := NewMockSubscription(ctrl)
+	mockSub.EXPECT().ExpiresAt().Return(expiresDate).AnyTimes()
+	mockSub.EXPECT().AutoRenewStatus().Return(true).AnyTimes()
+	mockSub.EXPECT().AutoRenewProduct().Return(productID).AnyTimes()
+	mockSub.EXPECT().CancelledAt().Return(time.Time{}).AnyTimes()
+	mockSub.EXPECT().IsInBillingRetryPeriod().Return(false).AnyTimes()
+	mockSub.EXPECT().UserID().Return("user").AnyTimes()
+
+	// Any listener call fails the test
+	mockListener := NewMockEventListener(ctrl)
+
+	evt := Event{
+		originalTransactionID: originalTransactionID,
+		productID:             productID,
+		expiresAt:             expiresDate,
+		renewalUnknown:        true,
+	}
+	if err := reviewChanges(mockListener, nil, mockSub, evt, now); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReviewChangesTrialConversion(t *testing.T) {
+	now := expiresDate.Add(-time.Hour)
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSub := NewMockSubscription(ctrl)
+	expectUnchangedSettings(mockSub)
+	mockSub.EXPECT().ExpiresAt().Return(purchaseDate).AnyTimes()
+	mockSub.EXPECT().IsTrialPeriod().Return(true).AnyTimes()
+	mockSub.EXPECT().IsInBillingRetryPeriod().Return(false).AnyTimes()
+
+	evt := Event{
+		originalTransactionID: originalTransactionID,
+		productID:             productID,
+		expiresAt:             expiresDate,
+		paidAt:                purchaseDate,
+	}
+
+	mockListener := NewMockEventListener(ctrl)
+	mockListener.EXPECT().Paid(EventMatcher{evt}).Times(1)
+
+	if err := reviewChanges(mockListener, nil, mockSub, evt, now); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReviewChangesUpgrade(t *testing.T) {
+	now := purchaseDate.Add(time.Hour)
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSub := NewMockSubscription(ctrl)
+	mockSub.EXPECT().ProductID().Return("month-basic").AnyTimes()
+	mockSub.EXPECT().AutoRenewProduct().Return("month-basic").AnyTimes()
+	mockSub.EXPECT().AutoRenewStatus().Return(false).AnyTimes()
+	mockSub.EXPECT().CancelledAt().Return(time.Time{}).AnyTimes()
+	mockSub.EXPECT().ExpiresAt().Return(expiresDate).AnyTimes()
+	mockSub.EXPECT().IsInBillingRetryPeriod().Return(false).AnyTimes()
+	mockSub.EXPECT().UserID().Return("user").AnyTimes()
+
+	mockListener := NewMockEventListener(ctrl)
+	mockListener.EXPECT().Upgraded(gomock.Any()).DoAndReturn(func(evt ProductChangeEvent) error {
+		if evt.PreviousProductID() != "month-basic" || !evt.IsProductChangeImmediate() {
+			t.Error("Should have upgraded immediately from basic", evt.PreviousProductID())
+		}
+		return nil
+	}).Times(1)
+
+	evt := Event{
+		originalTransactionID: originalTransactionID,
+		productID:             productID,
+		autoRenewProductID:    productID,
+		expiresAt:             expiresDate,
+		paidAt:                purchaseDate,
+	}
+	if err := reviewChanges(mockListener, testCatalog, mockSub, evt, now); err != nil {
+		t.Error(err)
+	}
+
+	// Without a catalog, changing products can't be classified
+	if err := reviewChanges(mockListener, nil, mockSub, Event{productID: productID}, now); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReviewChangesPriceConsent(t *testing.T) {
+	now := expiresDate.Add(time.Hour)
+	pending, accepted := receipt.PriceConsentPending, receipt.PriceConsentAccepted
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	unasked := NewMockSubscription(ctrl)
+	expectUnchangedSettings(unasked)
+	unasked.EXPECT().ExpiresAt().Return(expiresDate).AnyTimes()
+	unasked.EXPECT().ExpirationIntent().Return(0).AnyTimes()
+	unasked.EXPECT().IsInBillingRetryPeriod().Return(false).AnyTimes()
+	unasked.EXPECT().PriceConsentStatus().Return(receipt.PriceConsentNone).AnyTimes()
+
+	asked := NewMockSubscription(ctrl)
+	expectUnchangedSettings(asked)
+	asked.EXPECT().ExpiresAt().Return(expiresDate).AnyTimes()
+	asked.EXPECT().ExpirationIntent().Return(0).AnyTimes()
+	asked.EXPECT().IsInBillingRetryPeriod().Return(false).AnyTimes()
+	asked.EXPECT().PriceConsentStatus().Return(pending).AnyTimes()
+	asked.EXPECT().UserID().Return("user").AnyTimes()
+
+	mockListener := NewMockEventListener(ctrl)
+	mockListener.EXPECT().PriceIncreaseConsentRequested(gomock.Any()).Times(1)
+	mockListener.EXPECT().PriceIncreaseAccepted(gomock.Any()).Times(1)
+	mockListener.EXPECT().PriceIncreaseDeclined(gomock.Any()).DoAndReturn(
+		func(evt PriceIncreaseEvent) error {
+			if !evt.PriceConsentChangedAt().Equal(expiresDate) {
+				t.Error("Should have declined when the subscription expired", evt)
+			}
+			return nil
+		}).Times(1)
+	mockListener.EXPECT().Expired(gomock.Any()).Times(1)
+
+	evt := Event{expiresAt: expiresDate, priceConsentStatus: &pending}
+	if err := reviewChanges(mockListener, nil, unasked, evt, now); err != nil {
+		t.Error(err)
+	}
+
+	// Still waiting on the customer isn't a change
+	if err := reviewChanges(mockListener, nil, asked, evt, now); err != nil {
+		t.Error(err)
+	}
+
+	evt = Event{expiresAt: expiresDate, priceConsentStatus: &accepted}
+	if err := reviewChanges(mockListener, nil, asked, evt, now); err != nil {
+		t.Error(err)
+	}
+
+	evt = Event{expiresAt: expiresDate,
+		expirationIntent: receipt.ExpirationIntentPriceIncreaseDeclined}
+	if err := reviewChanges(mockListener, nil, asked, evt, now); err != nil {
+		t.Error(err)
+	}
+}
+
+type fakeLocker bool
+
+func (leader fakeLocker) Lock() (bool, error) { return bool(leader), nil }
+func (leader fakeLocker) Unlock() error       { return nil }
+
+func TestScanAsFollower(t *testing.T) {
+	fakeMatcher := func(now time.Time) []string {
+		t.Error("Should not have matched expiring subscriptions as follower")
+		return nil
+	}
+
+	srv := NewServer("http://example.com", testValidator, fakeMatcher, nil, stubUpdater{}, 1)
+	srv.Locker = fakeLocker(false)
+	srv.Scan(time.Now())
+
+	scanned := false
+	srv.Match = func(now time.Time) []string {
+		scanned = true
+		return nil
+	}
+	srv.Locker = fakeLocker(true)
+	srv.Scan(time.Now())
+	if !scanned {
+		t.Error("Should have scanned as leader")
+	}
+}
+
+func TestScanSummary(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSub := NewMockSubscription(ctrl)
+	expectUnchangedSettings(mockSub)
+	mockSub.EXPECT().ExpiresAt().Return(expiresDate.AddDate(0, 0, -7)).AnyTimes()
+	mockSub.EXPECT().IsInBillingRetryPeriod().Return(false).AnyTimes()
+	mockSub.EXPECT().IsTrialPeriod().Return(false).AnyTimes()
+	mockSub.EXPECT().ExpirationIntent().Return(0).AnyTimes()
+	mockSub.EXPECT().Currency().Return(currency).AnyTimes()
+	mockSub.EXPECT().Price().Return(price).AnyTimes()
+	mockSub.EXPECT().UserID().Return("user").AnyTimes()
+
+	mockListener := NewMockEventListener(ctrl)
+	mockListener.EXPECT().Paid(gomock.Any()).Times(1)
+
+	receipts := []string{"renewed", "unchanged", "renewed", "", "failed"}
+	fakeMatcher := func(now time.Time) []string { return receipts }
+	fakeFetcher := func(originalTransactionID string) (Subscription, error) {
+		return mockSub, nil
+	}
+
+	srv := NewServer("http://example.com", testValidator, fakeMatcher, fakeFetcher, stubUpdater{}, 1)
+	srv.Workers = 3
+	srv.LookupRate = 1000
+	srv.Lookup = func(id string) (receipt.Info, error) {
+		switch id {
+		case "renewed":
+			return fakeInfo{autoRenewProduct: "", expiresAt: expiresDate}, nil
+		case "unchanged":
+			return fakeInfo{expiresAt: expiresDate.AddDate(0, 0, -7)}, nil
+		}
+		return nil, fmt.Errorf("Lookup failed for %s", id)
+	}
+	srv.Listener.Add(mockListener)
+
+	summary := srv.Scan(time.Now())
+	if summary.Validated != 2 || summary.Renewed != 1 || summary.Failed != 1 ||
+		summary.Skipped != 2 {
+		t.Error("Should have summarized scan", summary)
+	}
+}
+
+func TestScanWithUnpaceableLookupRate(t *testing.T) {
+	fakeMatcher := func(now time.Time) []string { return []string{"failed"} }
+
+	srv := NewServer("http://example.com", testValidator, fakeMatcher, nil, stubUpdater{}, 1)
+	srv.LookupRate = 2e9
+	srv.Lookup = func(id string) (receipt.Info, error) {
+		return nil, fmt.Errorf("Lookup failed for %s", id)
+	}
+
+	if summary := srv.Scan(time.Now()); summary.Failed != 1 {
+		t.Error("Should have looked up as fast as possible", summary)
+	}
+}
+
+func TestStopDrainsScan(t *testing.T) {
+	looking := make(chan struct{})
+	cancelled := false
+
+	fakeMatcher := func(now time.Time) []string { return []string{"first", "second"} }
+
+	srv := NewServer("http://example.com", testValidator, fakeMatcher, nil, stubUpdater{}, time.Hour)
+	srv.LookupContext = func(ctx context.Context, id string) (receipt.Info, error) {
+		close(looking)
+		<-ctx.Done()
+		cancelled = true
+		return nil, ctx.Err()
+	}
+
+	srv.startScan(time.Now())
+	<-looking
+	srv.Stop()
+
+	if !cancelled {
+		t.Error("Should have cancelled the lookup in progress before Stop returned")
+	}
+}
+
+func TestScanWithValidator(t *testing.T) {
+	requests := 0
+	apple := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(`{"status":21002}`))
+	}))
+	defer apple.Close()
+
+	validator := receipt.NewValidator("secret")
+	validator.HTTPClient = apple.Client()
+	validator.ProductionURL = apple.URL
+
+	fakeMatcher := func(now time.Time) []string { return []string{"receipt"} }
+
+	srv := NewServer("http://example.com", validator, fakeMatcher, nil, stubUpdater{}, 1)
+	if summary := srv.Scan(time.Now()); summary.Failed != 1 || requests != 1 {
+		t.Error("Should have validated receipt with the configured endpoint", summary)
+	}
+}
+
+func TestScanRefundedLatestTransaction(t *testing.T) {
+	refundedAt := purchaseDate.Add(48 * time.Hour)
+	ms := func(t time.Time) int64 { return t.UnixNano() / int64(time.Millisecond) }
+
+	apple := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"status": 0, "latest_receipt_info": [{
+			"product_id": %q, "transaction_id": "123456789012346",
+			"original_transaction_id": %q, "purchase_date_ms": "%d",
+			"original_purchase_date_ms": "%d", "expires_date_ms": "%d",
+			"cancellation_date_ms": "%d", "cancellation_reason": "0"}],
+			"pending_renewal_info": [{"auto_renew_status": "0", "auto_renew_product_id": %q,
+			"original_transaction_id": %q}]}`, productID, originalTransactionID,
+			ms(purchaseDate), ms(originalPurchaseDate), ms(expiresDate), ms(refundedAt),
+			productID, originalTransactionID)
+	}))
+	defer apple.Close()
+
+	validator := receipt.NewValidator("secret")
+	validator.HTTPClient = apple.Client()
+	validator.ProductionURL = apple.URL
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSub := NewMockSubscription(ctrl)
+	mockSub.EXPECT().ExpiresAt().Return(expiresDate).AnyTimes()
+	mockSub.EXPECT().IsTrialPeriod().Return(false).AnyTimes()
+	mockSub.EXPECT().IsInBillingRetryPeriod().Return(false).AnyTimes()
+	mockSub.EXPECT().AutoRenewStatus().Return(false).AnyTimes()
+	mockSub.EXPECT().AutoRenewProduct().Return(productID).AnyTimes()
+	mockSub.EXPECT().CancelledAt().Return(time.Time{}).AnyTimes()
+	mockSub.EXPECT().Currency().Return(currency).AnyTimes()
+	mockSub.EXPECT().Price().Return(price).AnyTimes()
+	mockSub.EXPECT().UserID().Return("user").AnyTimes()
+
+	mockListener := NewMockEventListener(ctrl)
+	mockListener.EXPECT().Refunded(gomock.Any()).DoAndReturn(func(evt RefundEvent) error {
+		if !evt.RefundedAt().Equal(refundedAt) {
+			t.Error("Should have refunded when the latest transaction was", evt.RefundedAt())
+		}
+		return nil
+	}).Times(1)
+
+	fakeMatcher := func(now time.Time) []string { return []string{"receipt"} }
+	fakeFetcher := func(originalTransactionID string) (Subscription, error) {
+		return mockSub, nil
+	}
+
+	srv := NewServer("http://example.com", validator, fakeMatcher, fakeFetcher, stubUpdater{}, 1)
+	srv.Listener.Add(mockListener)
+	if summary := srv.Scan(time.Now()); summary.Validated != 1 {
+		t.Error("Should have validated the refunded receipt", summary)
+	}
+}
+
+func TestScanEverySubscriptionGroup(t *testing.T) {
+	refundedAt := purchaseDate.Add(48 * time.Hour)
+	otherTransactionID := "200000000000001"
+	ms := func(t time.Time) int64 { return t.UnixNano() / int64(time.Millisecond) }
+
+	// The matched subscription was refunded, but another group was bought after it
+	apple := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"status": 0, "latest_receipt_info": [{
+			"product_id": %q, "transaction_id": "123456789012346",
+			"original_transaction_id": %q, "purchase_date_ms": "%d",
+			"original_purchase_date_ms": "%d", "expires_date_ms": "%d",
+			"cancellation_date_ms": "%d", "cancellation_reason": "0"}, {
+			"product_id": %q, "transaction_id": %q,
+			"original_transaction_id": %q, "purchase_date_ms": "%d",
+			"original_purchase_date_ms": "%d", "expires_date_ms": "%d"}],
+			"pending_renewal_info": [{"auto_renew_status": "0", "auto_renew_product_id": %q,
+			"original_transaction_id": %q}, {"auto_renew_status": "0",
+			"auto_renew_product_id": %q, "original_transaction_id": %q}]}`,
+			productID, originalTransactionID, ms(purchaseDate), ms(originalPurchaseDate),
+			ms(expiresDate), ms(refundedAt),
+			productID, otherTransactionID, otherTransactionID, ms(refundedAt), ms(refundedAt),
+			ms(expiresDate),
+			productID, originalTransactionID, productID, otherTransactionID)
+	}))
+	defer apple.Close()
+
+	validator := receipt.NewValidator("secret")
+	validator.HTTPClient = apple.Client()
+	validator.ProductionURL = apple.URL
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSub := NewMockSubscription(ctrl)
+	mockSub.EXPECT().ExpiresAt().Return(expiresDate).AnyTimes()
+	mockSub.EXPECT().IsTrialPeriod().Return(false).AnyTimes()
+	mockSub.EXPECT().IsInBillingRetryPeriod().Return(false).AnyTimes()
+	mockSub.EXPECT().AutoRenewStatus().Return(false).AnyTimes()
+	mockSub.EXPECT().AutoRenewProduct().Return(productID).AnyTimes()
+	mockSub.EXPECT().CancelledAt().Return(time.Time{}).AnyTimes()
+	mockSub.EXPECT().Currency().Return(currency).AnyTimes()
+	mockSub.EXPECT().Price().Return(price).AnyTimes()
+	mockSub.EXPECT().UserID().Return("user").AnyTimes()
+
+	mockListener := NewMockEventListener(ctrl)
+	mockListener.EXPECT().Refunded(gomock.Any()).DoAndReturn(func(evt RefundEvent) error {
+		if evt.OriginalTransactionID() != originalTransactionID {
+			t.Error("Should have refunded the matched subscription", evt.OriginalTransactionID())
+		}
+		return nil
+	}).Times(1)
+
+	fetched := make(map[string]bool)
+	fakeMatcher := func(now time.Time) []string { return []string{"receipt"} }
+	fakeFetcher := func(originalTransactionID string) (Subscription, error) {
+		fetched[originalTransactionID] = true
+		return mockSub, nil
+	}
+
+	srv := NewServer("http://example.com", validator, fakeMatcher, fakeFetcher, stubUpdater{}, 1)
+	srv.Listener.Add(mockListener)
+	if summary := srv.Scan(time.Now()); summary.Validated != 1 {
+		t.Error("Should have validated the receipt once", summary)
+	}
+	if !fetched[originalTransactionID] || !fetched[otherTransactionID] {
+		t.Error("Should have reviewed every subscription group on the receipt", fetched)
+	}
+}
+
+func TestScanRequeuesFailures(t *testing.T) {
+	matched := []string{"flaky"}
+	fakeMatcher := func(now time.Time) []string {
+		defer func() { matched = nil }()
+		return matched
+	}
+
+	lookups := 0
+	srv := NewServer("http://example.com", testValidator, fakeMatcher, nil, stubUpdater{}, 1)
+	srv.RequeueLimit = 2
+	srv.Lookup = func(id string) (receipt.Info, error) {
+		lookups++
+		return nil, fmt.Errorf("App Store unavailable for %s", id)
+	}
+
+	for i, requeued := range []int{1, 1, 0, 0} {
+		if summary := srv.Scan(time.Now()); summary.Requeued != requeued {
+			t.Errorf("Scan %d should have requeued %d, got %v", i+1, requeued, summary)
+		}
+	}
+	if lookups != 3 {
+		t.Error("Should have retried the failed receipt until the requeue limit", lookups)
+	}
+}
+
+// lookupErrorUpdater records the receipts reported by UpdateWithLookupError
+type lookupErrorUpdater struct {
+	stubUpdater
+	failed map[string]error
+}
+
+func (updater lookupErrorUpdater) UpdateWithLookupError(receiptData string, err error) error {
+	updater.failed[receiptData] = err
+	return nil
+}
+
+func TestScanReportsLookupErrors(t *testing.T) {
+	fakeMatcher := func(now time.Time) []string { return []string{"malformed"} }
+	updater := lookupErrorUpdater{failed: make(map[string]error)}
+
+	srv := NewServer("http://example.com", testValidator, fakeMatcher, nil, updater, 1)
+	srv.Lookup = func(id string) (receipt.Info, error) {
+		return nil, receipt.StatusError{Status: receipt.StatusReceiptMalformed}
+	}
+
+	summary := srv.Scan(time.Now())
+	if !receipt.IsPermanent(updater.failed["malformed"]) {
+		t.Error("Should have surfaced the status error to the updater", updater.failed)
+	} else if summary.Failed != 1 || summary.Requeued != 0 {
+		t.Error("Should not have requeued a malformed receipt", summary)
+	}
+}